@@ -3,10 +3,12 @@ package cli
 import (
 	"fmt"
 	"os"
-	"path/filepath"
-	"strconv"
+	"time"
 
 	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/hyprspace/hyprspace/config"
+	"github.com/hyprspace/hyprspace/hosts"
+	"github.com/hyprspace/hyprspace/pidfile"
 	"github.com/hyprspace/hyprspace/tun"
 )
 
@@ -35,28 +37,58 @@ func DownRun(r *cmd.Root, c *cmd.Sub) {
 		configPath = "/etc/hyprspace/" + args.InterfaceName + ".yaml"
 	}
 
-	// Read lock from file system to stop process.
-	lockPath := filepath.Join(filepath.Dir(configPath), args.InterfaceName+".lock")
-	out, err := os.ReadFile(lockPath)
-	checkErr(err)
+	// Only signal the daemon holding the interface's pidfile after
+	// making sure it is still a running Hyprspace process. The daemon
+	// removes its interface and everything else it set up on its way out.
+	killed := false
+	pid, err := pidfile.Owner(pidPath(args.InterfaceName))
+	if err == nil {
+		process, err := os.FindProcess(pid)
+		checkErr(err)
 
-	pid, err := strconv.Atoi(string(out))
-	checkErr(err)
+		err = process.Signal(os.Interrupt)
+		if err == nil {
+			err = waitForExit(args.InterfaceName, 2*drainTimeout+5*time.Second)
+			checkErr(err)
 
-	process, err := os.FindProcess(pid)
-	checkErr(err)
+			fmt.Println("[+] deleted hyprspace " + args.InterfaceName + " daemon")
+			return
+		}
 
-	err0 := process.Signal(os.Interrupt)
+		// Some systems can't interrupt other processes, so stop the
+		// daemon and clean up after it instead.
+		err = process.Kill()
+		checkErr(err)
+		killed = true
+	} else if err != pidfile.ErrNotRunning {
+		checkErr(err)
+	}
 
-	err1 := tun.Delete(args.InterfaceName)
+	// The daemon isn't running, so clean up anything it may have
+	// left behind. Daemons running in userspace leave no interface.
+	err0 := tun.Delete(args.InterfaceName)
 
-	// Different types of systems may need the tun devices destroyed first or
-	// the process to exit first don't worry as long as one of these two has
-	// succeeded.
-	if err0 != nil && err1 != nil {
-		checkErr(err0)
-		checkErr(err1)
+	cfg, err := config.Read(configPath)
+	if err == nil && cfg.Hosts.Enable {
+		err = hosts.Remove(hostsPath(cfg), cfg.Interface.Name)
+		checkErr(err)
+	}
+	if err0 != nil && !killed {
+		checkErr(fmt.Errorf("%s is not running", args.InterfaceName))
 	}
 
 	fmt.Println("[+] deleted hyprspace " + args.InterfaceName + " daemon")
 }
+
+// waitForExit waits for the daemon of an interface to release its
+// pidfile.
+func waitForExit(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := pidfile.Owner(pidPath(name)); err == pidfile.ErrNotRunning {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for %s to shut down", name)
+}
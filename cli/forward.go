@@ -0,0 +1,535 @@
+package cli
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/hyprspace/hyprspace/firewall"
+	"github.com/hyprspace/hyprspace/l2"
+	"github.com/hyprspace/hyprspace/metrics"
+	"github.com/hyprspace/hyprspace/offload"
+	"github.com/hyprspace/hyprspace/p2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// packetOffset is where packets start in the forwarder's buffers. The
+// space ahead of them is left for the packet's length and virtio-net
+// header.
+const packetOffset = 4 + offload.HeaderLen
+
+// maxPacket is the largest packet exchanged with peers without
+// offloads. It leaves room for the Ethernet header of frames in TAP
+// mode.
+const maxPacket = 1420 + l2.HeaderLen
+
+// maxSegment is the size of the largest TCP segment a TUN device with
+// offloads enabled hands over.
+const maxSegment = 65535
+
+// forwarder reads packets from the queues of the TUN device and hands
+// them to a sender for their peer. Each peer has a sender per shard,
+// and packets are sharded by flow so those of one flow stay in order.
+type forwarder struct {
+	ctx     context.Context
+	host    host.Host
+	peers   map[string]peer.ID
+	all     []string
+	shards  int
+	offload bool
+	hops    uint8
+
+	// pool holds buffers for packets on their way from the TUN device
+	// to a peer.
+	pool sync.Pool
+
+	lock    sync.Mutex
+	senders map[senderKey]*sender
+	wg      sync.WaitGroup
+}
+
+type senderKey struct {
+	dst     string
+	shard   int
+	relayed bool
+}
+
+// sender writes packets to a single stream to a peer. Streams to peers
+// without a direct connection go through the relay in via. Packets
+// relayed for other peers have a sender of their own as they keep
+// their hop limit all the way.
+type sender struct {
+	dst     string
+	id      peer.ID
+	relayed bool
+	packets chan packet
+	stream  network.Stream
+	via     string
+}
+
+// packet is a packet read from the TUN device along with the buffer
+// holding it and the virtio-net header describing it. Packets relayed
+// for other peers carry the number of hops they have left instead.
+type packet struct {
+	buf     []byte
+	hdr     offload.Header
+	plen    int
+	relayed bool
+	hops    uint8
+}
+
+// data returns the packet without its header.
+func (p packet) data() []byte {
+	return p.buf[packetOffset : packetOffset+p.plen]
+}
+
+// newForwarder creates a forwarder which sends packets to the peers in
+// peerTable until ctx is cancelled. With offloads enabled the TUN
+// device hands over packets preceded by a virtio-net header. Packets
+// relayed through other peers may pass through up to hops of them.
+func newForwarder(ctx context.Context, node host.Host, peerTable map[string]peer.ID, shards int, offloads bool, hops int) *forwarder {
+	size := packetOffset + maxPacket
+	if offloads {
+		size = packetOffset + maxSegment
+	}
+	all := make([]string, 0, len(peerTable))
+	for ip := range peerTable {
+		all = append(all, ip)
+	}
+	return &forwarder{
+		ctx:     ctx,
+		host:    node,
+		peers:   peerTable,
+		all:     all,
+		shards:  shards,
+		offload: offloads,
+		hops:    uint8(hops),
+		pool: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, size)
+			},
+		},
+		senders: make(map[senderKey]*sender),
+	}
+}
+
+// start starts reading packets from each of the queues.
+func (f *forwarder) start(queues []io.ReadWriteCloser) {
+	for _, q := range queues {
+		go f.read(q)
+	}
+}
+
+// wait waits for every sender to flush its packets after the forwarder
+// has been stopped by cancelling its context.
+func (f *forwarder) wait() {
+	f.wg.Wait()
+}
+
+// read reads packets from a queue of the TUN device and hands them
+// to the sender for their peer and flow.
+func (f *forwarder) read(queue io.Reader) {
+	defer recoverPanic()
+
+	for {
+		buf := f.pool.Get().([]byte)
+		p, err := f.readPacket(queue, buf)
+		if f.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			f.pool.Put(buf)
+			metrics.Drops.WithLabelValues(metrics.DropTUNError).Inc()
+			logger.Warnw("unable to read from tun device", "error", err)
+			continue
+		}
+		if !f.dispatch(p) {
+			f.pool.Put(buf)
+		}
+	}
+}
+
+// readPacket reads a packet from a queue into buf, along with its
+// virtio-net header when offloads are enabled.
+func (f *forwarder) readPacket(queue io.Reader, buf []byte) (packet, error) {
+	p := packet{buf: buf}
+	if !f.offload {
+		n, err := queue.Read(buf[packetOffset:])
+		p.plen = n
+		return p, err
+	}
+
+	n, err := queue.Read(buf[packetOffset-offload.HeaderLen:])
+	if err != nil {
+		return p, err
+	}
+	if n < offload.HeaderLen {
+		return p, io.ErrUnexpectedEOF
+	}
+	p.hdr = offload.Decode(buf[packetOffset-offload.HeaderLen:])
+	p.plen = n - offload.HeaderLen
+
+	// Only large segments are left for the peer's kernel to finish.
+	// Anything else is sent as a complete packet.
+	if !p.hdr.Segmented() {
+		err = offload.Checksum(&p.hdr, p.data())
+		p.hdr = offload.Header{}
+	}
+	return p, err
+}
+
+// dispatch hands a packet to its sender. It reports whether the sender
+// took the packet's buffer.
+func (f *forwarder) dispatch(p packet) bool {
+	if macs != nil {
+		return f.dispatchFrame(p)
+	}
+	if p.plen < 20 {
+		metrics.Drops.WithLabelValues(metrics.DropTUNError).Inc()
+		return false
+	}
+	data := p.data()
+
+	// Decode the packet's destination address
+	dst := net.IPv4(data[16], data[17], data[18], data[19]).String()
+
+	// Forward broadcast and multicast packets to every peer in their
+	// group.
+	if groups != nil {
+		if peers, ok := groups.Peers(net.IP(data[16:20])); ok {
+			return f.dispatchGroup(p, peers)
+		}
+	}
+
+	// Send packets for subnets behind gateways to the gateway.
+	if _, ok := f.peers[dst]; !ok && subnets != nil {
+		if gw, ok := subnets.Lookup(net.IP(data[16:20])); ok {
+			dst = gw
+		}
+	}
+
+	// Drop packets for addresses which aren't peers before the firewall
+	// sees them, so they don't open connections in it.
+	if _, ok := f.peers[dst]; !ok {
+		metrics.Drops.WithLabelValues(metrics.DropNoPeer).Inc()
+		return false
+	}
+
+	// Drop packets the firewall doesn't allow out to the peer.
+	if fw != nil && !fw.Allow(data, dst, firewall.Outbound) {
+		metrics.Drops.WithLabelValues(metrics.DropFirewall).Inc()
+		return false
+	}
+	return f.queue(dst, flowHash(data)%f.shards, p)
+}
+
+// dispatchFrame hands an Ethernet frame to the sender of the peer its
+// destination was learned behind, or floods it to every peer when the
+// destination is a group address or hasn't been learned yet. It
+// reports whether a sender took the frame's buffer.
+func (f *forwarder) dispatchFrame(p packet) bool {
+	if p.plen < l2.HeaderLen {
+		metrics.Drops.WithLabelValues(metrics.DropTUNError).Inc()
+		return false
+	}
+	data := p.data()
+	shard := l2.FlowHash(data) % f.shards
+
+	if ip, ok := macs.Lookup(l2.Dst(data)); ok {
+		return f.queue(ip, shard, p)
+	}
+
+	// Only frames from the local device are flooded, never those
+	// received from peers, so frames can't loop between peers.
+	f.flood(p, shard, f.all)
+	return false
+}
+
+// dispatchGroup hands a broadcast or multicast packet to the senders of
+// the connected peers in its group, or of every connected peer when the
+// group has no peers. Packets which recently passed through are dropped
+// so those received from peers aren't sent back out. It reports whether
+// a sender took the packet's buffer.
+func (f *forwarder) dispatchGroup(p packet, peers []string) bool {
+	data := p.data()
+	if groups.Duplicate(data) {
+		metrics.Drops.WithLabelValues(metrics.DropDuplicate).Inc()
+		return false
+	}
+	if peers == nil {
+		peers = f.all
+	}
+
+	var dsts []string
+	for _, ip := range peers {
+		id, ok := f.peers[ip]
+		if !ok || f.host.Network().Connectedness(id) != network.Connected {
+			continue
+		}
+
+		// Drop packets the firewall doesn't allow out to the peer.
+		if fw != nil && !fw.Allow(data, ip, firewall.Outbound) {
+			metrics.Drops.WithLabelValues(metrics.DropFirewall).Inc()
+			continue
+		}
+		dsts = append(dsts, ip)
+	}
+	f.flood(p, flowHash(data)%f.shards, dsts)
+	return false
+}
+
+// flood hands a copy of a packet to the sender for a shard of each of
+// the peers in dsts.
+func (f *forwarder) flood(p packet, shard int, dsts []string) {
+	for _, ip := range dsts {
+		c := packet{buf: f.pool.Get().([]byte), hdr: p.hdr, plen: p.plen}
+		copy(c.buf, p.buf[:packetOffset+p.plen])
+		if !f.queue(ip, shard, c) {
+			f.pool.Put(c.buf)
+		}
+	}
+}
+
+// relay hands a packet relayed by a peer to the sender for its
+// destination, with the hops it has left.
+func (f *forwarder) relay(data []byte, hops uint8) {
+	buf := f.pool.Get().([]byte)
+	p := packet{buf: buf, plen: copy(buf[packetOffset:], data), relayed: true, hops: hops}
+	dst := net.IP(data[16:20]).String()
+	if !f.queue(dst, flowHash(data)%f.shards, p) {
+		f.pool.Put(buf)
+	}
+}
+
+// queue hands a packet to the sender for a shard of a peer's packets.
+// It reports whether the sender took the packet's buffer.
+func (f *forwarder) queue(dst string, shard int, p packet) bool {
+	// Drop packets over the peer's rate limit or quota.
+	if !withinLimits(dst, p.plen, true) {
+		return false
+	}
+
+	// Check if the destination of the packet is a known peer to
+	// the interface.
+	s := f.sender(dst, shard, p.relayed)
+	if s == nil {
+		metrics.Drops.WithLabelValues(metrics.DropNoPeer).Inc()
+		return false
+	}
+
+	// Drop the packet rather than hold up other peers when the peer
+	// can't keep up.
+	select {
+	case s.packets <- p:
+		return true
+	default:
+		metrics.Drops.WithLabelValues(metrics.DropQueueFull).Inc()
+		return false
+	}
+}
+
+// sender returns the sender for a shard of a peer's packets, starting
+// it if needed. It returns nil if dst isn't a peer or the forwarder has
+// been stopped.
+func (f *forwarder) sender(dst string, shard int, relayed bool) *sender {
+	id, ok := f.peers[dst]
+	if !ok {
+		return nil
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Don't start senders once the forwarder has been stopped.
+	if f.ctx.Err() != nil {
+		return nil
+	}
+	key := senderKey{dst: dst, shard: shard, relayed: relayed}
+	s, ok := f.senders[key]
+	if !ok {
+		s = &sender{dst: dst, id: id, relayed: relayed, packets: make(chan packet, 64)}
+		f.senders[key] = s
+		f.wg.Add(1)
+		go f.send(s)
+	}
+	return s
+}
+
+// send writes a sender's packets to its peer until the forwarder is
+// stopped, then flushes any packets still queued and closes the stream.
+func (f *forwarder) send(s *sender) {
+	defer recoverPanic()
+	defer f.wg.Done()
+
+	for {
+		select {
+		case p := <-s.packets:
+			f.write(s, p)
+		case <-f.ctx.Done():
+			for {
+				select {
+				case p := <-s.packets:
+					f.write(s, p)
+				default:
+					if s.stream != nil {
+						s.stream.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes a packet to the sender's stream, opening a new stream
+// if there's none or the current one has failed.
+func (f *forwarder) write(s *sender, p packet) {
+	defer f.pool.Put(p.buf)
+
+	// Switch back to the direct path as soon as it's available.
+	if s.stream != nil && s.via != "" && f.connected(s.id) {
+		s.stream.Close()
+		s.stream = nil
+	}
+
+	// Packets from the TUN device may be relayed through every hop.
+	hops := f.hops
+	if p.relayed {
+		hops = p.hops
+	}
+
+	// If everyting succeeds with the current stream move on to the
+	// next packet.
+	if s.stream != nil {
+		err := writePacket(s.stream, p, hops)
+		if err == nil {
+			countTx(s.dst, p.plen)
+			return
+		}
+		// If we encounter an error when writing to a stream we should
+		// close that stream and open a new one.
+		s.stream.Close()
+		s.stream = nil
+	}
+
+	// Don't open new streams once the forwarder has been stopped.
+	if f.ctx.Err() != nil {
+		metrics.Drops.WithLabelValues(metrics.DropStreamError).Inc()
+		return
+	}
+
+	stream, via, err := f.open(s)
+	if err != nil {
+		metrics.StreamOpenFailures.WithLabelValues(s.dst).Inc()
+		metrics.Drops.WithLabelValues(metrics.DropStreamError).Inc()
+		return
+	}
+	err = writePacket(stream, p, hops)
+	if err != nil {
+		metrics.Drops.WithLabelValues(metrics.DropStreamError).Inc()
+		stream.Close()
+		return
+	}
+	countTx(s.dst, p.plen)
+
+	// If all succeeds when writing the packet to the stream we should
+	// reuse this stream for the sender's next packets.
+	s.stream, s.via = stream, via
+}
+
+// open opens a stream for a sender's packets. With mesh routing
+// enabled, packets for peers without a direct connection are relayed
+// through the neighbour with the shortest route to them, if any. It
+// returns the address of the relaying neighbour.
+func (f *forwarder) open(s *sender) (network.Stream, string, error) {
+	if routes != nil && !f.connected(s.id) {
+		if via, ok := routes.Next(s.id.Pretty(), f.relayUsable); ok {
+			ip := RevLookup[via]
+			stream, err := f.host.NewStream(f.ctx, f.peers[ip], p2p.RelayProtocol)
+			return stream, ip, err
+		}
+	}
+
+	// Prefer sending large segments in one piece to peers which
+	// support it. Relayed packets keep their hop limit all the way.
+	protocols := []protocol.ID{p2p.Protocol}
+	if s.relayed {
+		protocols = []protocol.ID{p2p.RelayProtocol}
+	} else if f.offload {
+		protocols = []protocol.ID{p2p.OffloadProtocol, p2p.Protocol}
+	}
+	stream, err := f.host.NewStream(f.ctx, s.id, protocols...)
+	return stream, "", err
+}
+
+// writePacket writes a packet to a stream framed for the stream's
+// protocol. Large segments are split up for peers which can't take
+// them in one piece. Relayed packets may pass through hops more peers.
+func writePacket(stream network.Stream, p packet, hops uint8) error {
+	// The offload protocol carries the virtio-net header along with
+	// the packet, behind a 32 bit length as segments can be large.
+	if stream.Protocol() == p2p.OffloadProtocol {
+		frame := p.buf[:packetOffset+p.plen]
+		binary.LittleEndian.PutUint32(frame, uint32(offload.HeaderLen+p.plen))
+		p.hdr.Encode(frame[4:])
+		_, err := stream.Write(frame)
+		return err
+	}
+
+	// The relay protocol carries the hop limit between the length and
+	// the packet.
+	if stream.Protocol() == p2p.RelayProtocol {
+		if p.hdr.Segmented() {
+			return offload.Segment(p.hdr, p.data(), func(segment []byte) error {
+				head := []byte{0, 0, hops}
+				binary.LittleEndian.PutUint16(head, uint16(1+len(segment)))
+				_, err := stream.Write(append(head, segment...))
+				return err
+			})
+		}
+		frame := p.buf[packetOffset-3 : packetOffset+p.plen]
+		binary.LittleEndian.PutUint16(frame, uint16(1+p.plen))
+		frame[2] = hops
+		_, err := stream.Write(frame)
+		return err
+	}
+
+	// Otherwise write out the packet's length ahead of it to ensure
+	// we know the full size of the packet at the other end.
+	if p.hdr.Segmented() {
+		return offload.Segment(p.hdr, p.data(), func(segment []byte) error {
+			err := binary.Write(stream, binary.LittleEndian, uint16(len(segment)))
+			if err == nil {
+				_, err = stream.Write(segment)
+			}
+			return err
+		})
+	}
+	frame := p.buf[packetOffset-2 : packetOffset+p.plen]
+	binary.LittleEndian.PutUint16(frame, uint16(p.plen))
+	_, err := stream.Write(frame)
+	return err
+}
+
+// flowHash hashes the addresses, protocol and ports of an IPv4 packet
+// so packets of the same flow hash the same.
+func flowHash(packet []byte) int {
+	h := fnv.New32a()
+	h.Write(packet[9:10])
+	h.Write(packet[12:20])
+
+	// Include the ports of unfragmented TCP and UDP packets.
+	ihl := int(packet[0]&0x0f) * 4
+	fragment := binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0
+	proto := packet[9]
+	if !fragment && (proto == firewall.TCP || proto == firewall.UDP) && len(packet) >= ihl+4 {
+		h.Write(packet[ihl : ihl+4])
+	}
+	return int(h.Sum32() & 0x7fffffff)
+}
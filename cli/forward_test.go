@@ -0,0 +1,283 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hyprspace/hyprspace/offload"
+	"github.com/hyprspace/hyprspace/p2p"
+	"github.com/hyprspace/hyprspace/tun"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// pipePeers connects two nodes at 10.1.1.1 and 10.1.1.2 over a mock
+// network, each forwarding the packets of an in-memory device with or
+// without offloads. It returns the ends of the devices the test reads
+// and writes packets on.
+func pipePeers(t *testing.T, offloads [2]bool) [2]*tun.Memory {
+	t.Helper()
+	var apps [2]*tun.Memory
+	var devs [2]tun.Device
+	for i := range devs {
+		devs[i], apps[i] = tun.NewPipe("hs0", 0)
+	}
+	linkPeers(t, devs, offloads)
+	return apps
+}
+
+// linkPeers connects two nodes at 10.1.1.1 and 10.1.1.2 over a mock
+// network, each forwarding the packets of a device with or without
+// offloads.
+func linkPeers(t *testing.T, devs [2]tun.Device, offloads [2]bool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	mn := mocknet.New(ctx)
+	var hosts [2]host.Host
+	for i := range hosts {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts[i] = h
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+
+	ips := [2]string{"10.1.1.1", "10.1.1.2"}
+	RevLookup = map[string]string{
+		hosts[0].ID().Pretty(): ips[0],
+		hosts[1].ID().Pretty(): ips[1],
+	}
+
+	var fwds [2]*forwarder
+	for i, h := range hosts {
+		dev := devs[i]
+		rx := &receiver{dev: dev, offload: offloads[i]}
+		h.SetStreamHandler(p2p.Protocol, rx.handle)
+		if offloads[i] {
+			h.SetStreamHandler(p2p.OffloadProtocol, rx.handleOffload)
+		}
+
+		other := hosts[1-i].ID()
+		fwds[i] = newForwarder(ctx, h, map[string]peer.ID{ips[1-i]: other}, 1, offloads[i], 0)
+		fwds[i].start([]io.ReadWriteCloser{dev})
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		for i := range devs {
+			devs[i].Close()
+			fwds[i].wait()
+		}
+		for _, h := range hosts {
+			h.Close()
+		}
+		RevLookup = nil
+	})
+}
+
+// receive reads the packets arriving on a device into a channel.
+func receive(dev *tun.Memory) <-chan []byte {
+	out := make(chan []byte, 64)
+	go func() {
+		buf := make([]byte, offload.HeaderLen+maxSegment)
+		for {
+			n, err := dev.Read(buf)
+			if err != nil {
+				close(out)
+				return
+			}
+			out <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	return out
+}
+
+// next returns the next packet arriving on a device.
+func next(t *testing.T, packets <-chan []byte) []byte {
+	t.Helper()
+	select {
+	case p := <-packets:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet arrived")
+		return nil
+	}
+}
+
+// tcpPacket builds an IPv4 packet from src to dst carrying a TCP
+// segment with complete checksums.
+func tcpPacket(src string, dst string, id uint16, seq uint32, payload []byte) []byte {
+	packet := make([]byte, 40+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:6], id)
+	packet[8], packet[9] = 64, 6
+	copy(packet[12:16], net.ParseIP(src).To4())
+	copy(packet[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(packet[10:12], ^checksum(0, packet[:20]))
+
+	tcp := packet[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 22)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	tcp[12], tcp[13] = 5<<4, 0x10
+	binary.BigEndian.PutUint16(tcp[14:16], 512)
+	copy(tcp[20:], payload)
+	binary.BigEndian.PutUint16(tcp[16:18], ^checksum(pseudo(packet), tcp))
+	return packet
+}
+
+// pseudo returns the sum of the pseudo header of an IPv4 packet
+// carrying TCP.
+func pseudo(packet []byte) uint32 {
+	return uint32(checksum(0, packet[12:20])) + 6 + uint32(len(packet)-20)
+}
+
+// checksum adds b to an internet checksum and folds it to 16 bits.
+func checksum(s uint32, b []byte) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+func TestForward(t *testing.T) {
+	apps := pipePeers(t, [2]bool{false, false})
+	received := [2]<-chan []byte{receive(apps[0]), receive(apps[1])}
+
+	tests := []struct {
+		name    string
+		from    int
+		packet  []byte
+		dropped bool
+	}{
+		{"to peer", 0, tcpPacket("10.1.1.1", "10.1.1.2", 1, 1, []byte("hello")), false},
+		{"reply", 1, tcpPacket("10.1.1.2", "10.1.1.1", 1, 1, []byte("hi")), false},
+		{"spoofed source", 0, tcpPacket("10.1.1.9", "10.1.1.2", 2, 1, []byte("hello")), true},
+		{"unknown peer", 0, tcpPacket("10.1.1.1", "10.1.1.9", 3, 1, []byte("hello")), true},
+		{"runt", 0, []byte{0x45, 0}, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := apps[tt.from].Write(tt.packet); err != nil {
+				t.Fatal(err)
+			}
+
+			// Packets which are dropped never arrive, so the next one
+			// to arrive is the packet following them.
+			want := tt.packet
+			if tt.dropped {
+				want = tcpPacket("10.1.1.1", "10.1.1.2", 100+uint16(i), 1, []byte("after"))
+				if _, err := apps[0].Write(want); err != nil {
+					t.Fatal(err)
+				}
+			}
+			to := 1 - tt.from
+			if tt.dropped {
+				to = 1
+			}
+			if got := next(t, received[to]); !bytes.Equal(got, want) {
+				t.Errorf("got packet\n%x\nwant\n%x", got, want)
+			}
+		})
+	}
+}
+
+func TestForwardOffload(t *testing.T) {
+	// A large segment as the kernel hands it over, with the sum of the
+	// pseudo header in its checksum field.
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	large := tcpPacket("10.1.1.1", "10.1.1.2", 1, 1, payload)
+	tcp := large[20:]
+	binary.BigEndian.PutUint16(tcp[16:18], checksum(pseudo(large), nil))
+	hdr := offload.Header{
+		Flags:      offload.FlagNeedsCsum,
+		GSOType:    offload.GSOTCPv4,
+		HdrLen:     40,
+		GSOSize:    1000,
+		CsumStart:  20,
+		CsumOffset: 16,
+	}
+	frame := make([]byte, offload.HeaderLen+len(large))
+	hdr.Encode(frame)
+	copy(frame[offload.HeaderLen:], large)
+
+	var segments [][]byte
+	offload.Segment(hdr, append([]byte(nil), large...), func(segment []byte) error {
+		segments = append(segments, append([]byte(nil), segment...))
+		return nil
+	})
+
+	tests := []struct {
+		name     string
+		offloads [2]bool
+	}{
+		{"to peer without offloads", [2]bool{true, false}},
+		{"to peer with offloads", [2]bool{true, true}},
+		{"from peer without offloads", [2]bool{false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apps := pipePeers(t, tt.offloads)
+			received := receive(apps[1])
+
+			// Send the segment the way the sending device hands it over.
+			if tt.offloads[0] {
+				if _, err := apps[0].Write(frame); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				for _, s := range segments {
+					if _, err := apps[0].Write(s); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			// Split up whatever arrives to compare it with the packets
+			// which would have been sent on the wire.
+			var got [][]byte
+			for len(got) < len(segments) {
+				p := next(t, received)
+				h := offload.Header{}
+				if tt.offloads[1] {
+					h = offload.Decode(p)
+					p = p[offload.HeaderLen:]
+					if err := h.Validate(p); err != nil {
+						t.Fatalf("invalid offload header: %v", err)
+					}
+				}
+				offload.Segment(h, p, func(segment []byte) error {
+					got = append(got, append([]byte(nil), segment...))
+					return nil
+				})
+			}
+			for i := range segments {
+				if !bytes.Equal(got[i], segments[i]) {
+					t.Errorf("segment %d is\n%x\nwant\n%x", i, got[i], segments[i])
+				}
+			}
+		})
+	}
+}
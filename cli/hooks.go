@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hyprspace/hyprspace/config"
+	"github.com/hyprspace/hyprspace/hooks"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// runHooks runs the commands of a hook, logging their output. Extra
+// environment variables are added to those describing the interface.
+func runHooks(cfg *config.Config, hook string, commands []string, env ...string) error {
+	if len(commands) == 0 {
+		return nil
+	}
+	timeout, err := time.ParseDuration(cfg.Interface.HookTimeout)
+	if err != nil {
+		return err
+	}
+
+	env = append([]string{
+		"HYPRSPACE_HOOK=" + hook,
+		"HYPRSPACE_INTERFACE=" + cfg.Interface.Name,
+		"HYPRSPACE_ADDRESS=" + cfg.Interface.Address,
+		"HYPRSPACE_NETNS=" + cfg.Interface.Netns,
+	}, env...)
+
+	logger.Infow("running hooks", "hook", hook)
+	return hooks.Run(commands, env, timeout, func(command string, line string) {
+		logger.Infow(line, "hook", hook, "command", command)
+	})
+}
+
+// peerEvent is a peer connecting or disconnecting.
+type peerEvent struct {
+	connected bool
+	remote    string
+}
+
+// peerHooks runs the connect and disconnect hooks of peers as they come
+// and go. Each peer's hooks run one at a time in the order of events.
+type peerHooks struct {
+	cfg *config.Config
+
+	lock      sync.Mutex
+	connected map[peer.ID]bool
+	events    map[peer.ID]chan peerEvent
+}
+
+// watchPeers starts running the connect and disconnect hooks of the
+// interface's peers.
+func watchPeers(cfg *config.Config, node host.Host) {
+	h := &peerHooks{
+		cfg:       cfg,
+		connected: make(map[peer.ID]bool),
+		events:    make(map[peer.ID]chan peerEvent),
+	}
+	for ip, p := range cfg.Peers {
+		if len(p.OnConnect) == 0 && len(p.OnDisconnect) == 0 {
+			continue
+		}
+		id, err := peer.Decode(p.ID)
+		if err != nil {
+			continue
+		}
+		ch := make(chan peerEvent, 16)
+		h.events[id] = ch
+		go h.run(ip, p, ch)
+	}
+	if len(h.events) == 0 {
+		return
+	}
+
+	node.Network().Notify(&network.NotifyBundle{
+		ConnectedF:    h.update,
+		DisconnectedF: h.update,
+	})
+}
+
+// update turns changes to a peer's connections into events for when
+// its first connection opens and its last connection closes.
+func (h *peerHooks) update(n network.Network, c network.Conn) {
+	id := c.RemotePeer()
+	ch, ok := h.events[id]
+	if !ok {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	connected := n.Connectedness(id) == network.Connected
+	if connected == h.connected[id] {
+		return
+	}
+	h.connected[id] = connected
+
+	select {
+	case ch <- peerEvent{connected: connected, remote: c.RemoteMultiaddr().String()}:
+	default:
+		logger.Warnw("dropped peer hook event", "ip", RevLookup[id.Pretty()])
+	}
+}
+
+// run runs a peer's hooks for each of its events.
+func (h *peerHooks) run(ip string, p config.Peer, events chan peerEvent) {
+	defer recoverPanic()
+
+	for e := range events {
+		hook, commands := "on_connect", p.OnConnect
+		if !e.connected {
+			hook, commands = "on_disconnect", p.OnDisconnect
+		}
+		err := runHooks(h.cfg, hook, commands,
+			"HYPRSPACE_PEER_ID="+p.ID,
+			"HYPRSPACE_PEER_IP="+ip,
+			"HYPRSPACE_PEER_NAME="+p.Name,
+			"HYPRSPACE_PEER_REMOTE="+e.remote,
+		)
+		if err != nil {
+			logger.Warnw("peer hook failed", "hook", hook, "ip", ip, "error", err)
+		}
+	}
+}
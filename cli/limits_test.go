@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyprspace/hyprspace/config"
+)
+
+// setenv sets an environment variable for the rest of a test.
+func setenv(t *testing.T, key string, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestQuotaState(t *testing.T) {
+	geteuid = func() int { return 1000 }
+	defer func() { geteuid = os.Geteuid }()
+	state := t.TempDir()
+	setenv(t, "XDG_STATE_HOME", state)
+
+	cfg := &config.Config{Path: filepath.Join(t.TempDir(), "hs0.yaml")}
+	cfg.Interface.Name = "hs0"
+	var p config.Peer
+	p.Limits.Quota = "1KB"
+	cfg.Peers = map[string]config.Peer{"10.1.1.2": p}
+
+	// Usage saved next to the config by earlier versions moves to the
+	// state directory.
+	month := time.Now().Format("2006-01")
+	old := filepath.Join(filepath.Dir(cfg.Path), "hs0.quota.json")
+	err := os.WriteFile(old, []byte(`{"month":"`+month+`","used":{"10.1.1.2":100}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, q, err := newLimits(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := quotaPath(cfg); filepath.Dir(path) != filepath.Join(state, "hyprspace") {
+		t.Errorf("quota kept in %s, want the state directory", path)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("old quota file left behind: %v", err)
+	}
+	if u := q.Usage()["10.1.1.2"]; u.Used != 100 {
+		t.Errorf("got %d bytes used after the move, want 100", u.Used)
+	}
+
+	// The periodic saver stops with its context.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		saveQuotas(ctx, q)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("quota saver did not stop")
+	}
+}
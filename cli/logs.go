@@ -0,0 +1,199 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/hyprspace/hyprspace/config"
+	"github.com/nxadm/tail"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logs follows the log of a running Hyprspace daemon.
+var Logs = cmd.Sub{
+	Name:  "logs",
+	Alias: "l",
+	Short: "Follow The Logs Of A Hyprspace Daemon.",
+	Args:  &LogsArgs{},
+	Flags: &LogsFlags{},
+	Run:   LogsRun,
+}
+
+// LogsArgs handles the specific arguments for the logs command.
+type LogsArgs struct {
+	InterfaceName string
+}
+
+// LogsFlags handles the specific flags for the logs command.
+type LogsFlags struct {
+	Level   string `short:"L" long:"level" desc:"Only Show Logs At Or Above This Level."`
+	Peer    string `short:"p" long:"peer" desc:"Only Show Logs About This Peer (Name, Address or ID)."`
+	Lines   int    `short:"n" long:"lines" desc:"Number Of Previous Lines To Show (Default 10)."`
+	LogFile string `short:"l" long:"log-file" desc:"Follow This Log File Instead."`
+}
+
+// LogsRun handles the execution of the logs command.
+func LogsRun(r *cmd.Root, c *cmd.Sub) {
+	// Parse Command Args
+	args := c.Args.(*LogsArgs)
+
+	// Parse Command Flags
+	flags := c.Flags.(*LogsFlags)
+
+	// Parse Global Config Flag for Custom Config Path
+	configPath := r.Flags.(*GlobalFlags).Config
+	if configPath == "" {
+		configPath = "/etc/hyprspace/" + args.InterfaceName + ".yaml"
+	}
+
+	// Read in configuration from file.
+	cfg, err := config.Read(configPath)
+	checkErr(err)
+
+	filter, err := newLogFilter(cfg, flags.Level, flags.Peer)
+	checkErr(err)
+
+	lines := flags.Lines
+	if lines == 0 {
+		lines = 10
+	}
+
+	logPath := daemonLogPath(cfg, flags.LogFile)
+	offset, err := lastLines(logPath, lines)
+	checkErr(err)
+
+	t, err := tail.TailFile(logPath, tail.Config{
+		Follow:   true,
+		ReOpen:   true,
+		Location: &tail.SeekInfo{Offset: offset, Whence: io.SeekStart},
+		Logger:   tail.DiscardingLogger,
+	})
+	checkErr(err)
+
+	for line := range t.Lines {
+		if filter.match(line.Text) {
+			fmt.Println(line.Text)
+		}
+	}
+}
+
+// logFilter selects log lines by level and peer.
+type logFilter struct {
+	level zapcore.Level
+	peers map[string]bool
+}
+
+// newLogFilter creates a filter for lines at or above a level which
+// mention a peer by its address or ID. Empty values don't filter.
+func newLogFilter(cfg *config.Config, level string, ref string) (*logFilter, error) {
+	result := logFilter{level: zapcore.DebugLevel}
+	if level != "" {
+		err := result.level.UnmarshalText([]byte(level))
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid log level", level)
+		}
+	}
+
+	if ref != "" {
+		// Match the peer by both its address and its ID.
+		result.peers = map[string]bool{ref: true}
+		if ip, err := peerAddress(cfg, ref); err == nil {
+			result.peers[ip] = true
+			result.peers[cfg.Peers[ip].ID] = true
+		}
+	}
+	return &result, nil
+}
+
+// match reports whether a log line passes the filter. Lines which aren't
+// structured logs, such as panics, pass unless filtering by peer.
+func (f *logFilter) match(line string) bool {
+	level, fields, ok := parseLogLine(line)
+	if !ok {
+		return f.peers == nil
+	}
+	if level < f.level {
+		return false
+	}
+	if f.peers == nil {
+		return true
+	}
+	for _, key := range []string{"peer", "ip"} {
+		if v, ok := fields[key].(string); ok && f.peers[v] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLogLine decodes the level and fields of a line written in
+// either the text or json log format.
+func parseLogLine(line string) (zapcore.Level, map[string]interface{}, bool) {
+	var level zapcore.Level
+	fields := make(map[string]interface{})
+
+	// JSON lines carry the level alongside the other fields.
+	if strings.HasPrefix(line, "{") {
+		if json.Unmarshal([]byte(line), &fields) != nil {
+			return level, nil, false
+		}
+		l, _ := fields["level"].(string)
+		return level, fields, level.UnmarshalText([]byte(l)) == nil
+	}
+
+	// Text lines are tab separated with any fields as JSON at the end.
+	parts := strings.Split(line, "\t")
+	if len(parts) < 2 || level.UnmarshalText([]byte(parts[1])) != nil {
+		return level, nil, false
+	}
+	if last := parts[len(parts)-1]; strings.HasPrefix(last, "{") {
+		json.Unmarshal([]byte(last), &fields)
+	}
+	return level, fields, true
+}
+
+// lastLines returns the offset in the file at path where its last n
+// lines begin. A missing file starts at the beginning.
+func lastLines(path string, n int) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// Look back through the end of the file for enough newlines.
+	const chunk = 64 * 1024
+	size := info.Size()
+	start := size - chunk
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, size-start)
+	_, err = f.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	buf = bytes.TrimSuffix(buf, []byte("\n"))
+	for i := 0; i < n; i++ {
+		j := bytes.LastIndexByte(buf, '\n')
+		if j < 0 {
+			return start, nil
+		}
+		buf = buf[:j]
+	}
+	return start + int64(len(buf)) + 1, nil
+}
@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLastLines(t *testing.T) {
+	long := strings.Repeat("x", 70*1024) + "\n"
+	tests := []struct {
+		name    string
+		content string
+		n       int
+		want    string
+	}{
+		{"last lines", "one\ntwo\nthree\n", 2, "two\nthree\n"},
+		{"without final newline", "one\ntwo\nthree", 2, "two\nthree"},
+		{"fewer lines than asked", "one\ntwo\n", 5, "one\ntwo\n"},
+		{"no lines", "one\ntwo\n", 0, ""},
+		{"empty", "", 3, ""},
+		{"past the chunk read", long + "one\ntwo\n", 2, "one\ntwo\n"},
+		{"line longer than the chunk", "one\n" + long, 1, long[len(long)-64*1024:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hs0.log")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			offset, err := lastLines(path, tt.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.content[offset:]; got != tt.want {
+				t.Errorf("got offset %d with %q, want %q", offset, trim(got), trim(tt.want))
+			}
+		})
+	}
+
+	offset, err := lastLines(filepath.Join(t.TempDir(), "missing.log"), 10)
+	if err != nil || offset != 0 {
+		t.Errorf("got offset %d and error %v for a missing log", offset, err)
+	}
+}
+
+// trim shortens long log contents in test failures.
+func trim(s string) string {
+	if len(s) > 40 {
+		return s[:20] + "..." + s[len(s)-20:]
+	}
+	return s
+}
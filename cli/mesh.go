@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/hyprspace/hyprspace/mesh"
+	"github.com/hyprspace/hyprspace/p2p"
+	"github.com/hyprspace/hyprspace/policy"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// announceInterval is how often relays announce the peers they reach.
+const announceInterval = 20 * time.Second
+
+// routeTTL is how long announced routes are used without being
+// announced again.
+const routeTTL = 3 * announceInterval
+
+// maxAnnouncement bounds the size of a route announcement.
+const maxAnnouncement = 1 << 20
+
+// announceRoutes announces the peers the node reaches, directly or
+// through other relays, to each connected peer it relays for until ctx
+// is cancelled.
+func announceRoutes(ctx context.Context, node host.Host, peerTable map[string]peer.ID) {
+	defer recoverPanic()
+
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		var direct []string
+		var neighbours []string
+		for ip, id := range peerTable {
+			if node.Network().Connectedness(id) == network.Connected {
+				direct = append(direct, id.Pretty())
+				neighbours = append(neighbours, ip)
+			}
+		}
+		for _, ip := range neighbours {
+			if pol != nil && !pol.Provides(policy.Relay, ip) {
+				continue
+			}
+			id := peerTable[ip]
+			err := announce(ctx, node, id, routes.Announce(id.Pretty(), direct))
+			if err != nil && ctx.Err() == nil {
+				logger.Debugw("unable to announce routes", "peer", id.Pretty(), "ip", ip, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// announce sends the routes a peer can relay through the node to it.
+func announce(ctx context.Context, node host.Host, id peer.ID, announced []mesh.Route) error {
+	ctx, cancel := context.WithTimeout(ctx, announceInterval/2)
+	defer cancel()
+
+	stream, err := node.NewStream(ctx, id, p2p.RoutesProtocol)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(stream).Encode(announced)
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	return stream.Close()
+}
+
+// routesHandler learns the peers a neighbour relays to from its
+// announcements. Announcements from peers the node may not relay
+// through are ignored.
+func routesHandler(stream network.Stream) {
+	defer recoverPanic()
+
+	// If the remote node ID isn't in the list of known nodes don't respond.
+	id := stream.Conn().RemotePeer().Pretty()
+	ip, ok := RevLookup[id]
+	if !ok {
+		logger.Debugw("rejected stream from unknown peer", "peer", id)
+		stream.Reset()
+		return
+	}
+	if pol != nil && !pol.Uses(policy.Relay, ip) {
+		stream.Reset()
+		return
+	}
+
+	var announced []mesh.Route
+	err := json.NewDecoder(io.LimitReader(stream, maxAnnouncement)).Decode(&announced)
+	if err != nil {
+		logger.Debugw("rejected invalid route announcement", "peer", id, "ip", ip, "error", err)
+		stream.Reset()
+		return
+	}
+	routes.Update(id, announced)
+	stream.Close()
+}
+
+// forgetRoutes forgets the routes learned from peers as soon as their
+// last connection closes.
+func forgetRoutes(node host.Host) {
+	node.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if n.Connectedness(c.RemotePeer()) != network.Connected {
+				routes.Forget(c.RemotePeer().Pretty())
+			}
+		},
+	})
+}
+
+// relayUsable reports whether packets may be relayed through the peer
+// with the given ID, which has to be connected and, with the policy
+// enabled, provide the relay service to the node.
+func (f *forwarder) relayUsable(via string) bool {
+	ip, ok := RevLookup[via]
+	if !ok || !f.connected(f.peers[ip]) {
+		return false
+	}
+	return pol == nil || pol.Uses(policy.Relay, ip)
+}
+
+// connected reports whether the node has a direct connection to a peer.
+func (f *forwarder) connected(id peer.ID) bool {
+	return f.host.Network().Connectedness(id) == network.Connected
+}
@@ -0,0 +1,284 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/hyprspace/hyprspace/config"
+	"github.com/hyprspace/hyprspace/control"
+	"github.com/hyprspace/hyprspace/p2p"
+	"github.com/hyprspace/hyprspace/portfwd"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Forward forwards a port of a peer to a local address through a
+// running Hyprspace daemon.
+var Forward = cmd.Sub{
+	Name:  "forward",
+	Alias: "f",
+	Short: "Forward A Port Of A Peer To A Local Address.",
+	Args:  &ForwardArgs{},
+	Flags: &ForwardFlags{},
+	Run:   ForwardRun,
+}
+
+// ForwardArgs handles the specific arguments for the forward command.
+type ForwardArgs struct {
+	InterfaceName string
+	Peer          string
+	Address       string
+}
+
+// ForwardFlags handles the specific flags for the forward command.
+type ForwardFlags struct {
+	Listen string `short:"l" long:"listen" desc:"Local Address To Listen On (Default 127.0.0.1 On The Same Port)."`
+	UDP    bool   `short:"u" long:"udp" desc:"Forward A UDP Port Instead Of A TCP Port."`
+}
+
+// ForwardRun handles the execution of the forward command.
+func ForwardRun(r *cmd.Root, c *cmd.Sub) {
+	// Parse Command Args
+	args := c.Args.(*ForwardArgs)
+
+	// Parse Command Flags
+	flags := c.Flags.(*ForwardFlags)
+
+	fwd := control.Forward{
+		Proto:   portfwd.TCP,
+		Listen:  flags.Listen,
+		Peer:    args.Peer,
+		Address: args.Address,
+	}
+	if flags.UDP {
+		fwd.Proto = portfwd.UDP
+	}
+
+	// Listen on the same port locally unless told otherwise.
+	if fwd.Listen == "" {
+		_, port, err := net.SplitHostPort(args.Address)
+		checkErr(err)
+		fwd.Listen = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	err := control.Post(socketPath(args.InterfaceName), "/forward", fwd, &fwd)
+	checkErr(err)
+
+	fmt.Printf("[+] forwarding %s %s to %s on %s\n", fwd.Proto, fwd.Listen, fwd.Address, fwd.Peer)
+}
+
+// ports holds the ports of peers forwarded to local addresses.
+var ports *portForwards
+
+// portForwards forwards ports of peers to local addresses while the
+// daemon runs.
+type portForwards struct {
+	ctx  context.Context
+	cfg  *config.Config
+	host host.Host
+
+	lock   sync.Mutex
+	active []activeForward
+}
+
+// activeForward is a forwarded port and the listener forwarding it.
+type activeForward struct {
+	control.Forward
+	ln io.Closer
+}
+
+// newPortForwards creates an empty set of forwarded ports.
+func newPortForwards(ctx context.Context, cfg *config.Config, node host.Host) *portForwards {
+	return &portForwards{ctx: ctx, cfg: cfg, host: node}
+}
+
+// add starts forwarding a port of a peer to a local address. Without a
+// peer the port is forwarded to an overlay address through the
+// userspace stack.
+func (p *portForwards) add(fwd control.Forward) error {
+	if fwd.Peer == "" {
+		if userStack == nil {
+			return fmt.Errorf("forwarding to %s needs a peer without a userspace interface", fwd.Address)
+		}
+		ln, err := portfwd.Listen(fwd.Proto, fwd.Listen, func() (io.ReadWriteCloser, error) {
+			return userStack.Dial(p.ctx, fwd.Proto, fwd.Address)
+		})
+		if err != nil {
+			return err
+		}
+		logger.Infow("forwarding port", "proto", fwd.Proto, "listen", fwd.Listen, "address", fwd.Address)
+		p.track(fwd, ln)
+		return nil
+	}
+
+	ip, err := peerAddress(p.cfg, fwd.Peer)
+	if err != nil {
+		return err
+	}
+	id, err := peer.Decode(p.cfg.Peers[ip].ID)
+	if err != nil {
+		return err
+	}
+
+	open := func() (io.ReadWriteCloser, error) {
+		return p.host.NewStream(p.ctx, id, p2p.ForwardProtocol)
+	}
+	ln, err := portfwd.Listen(fwd.Proto, fwd.Listen, portfwd.Through(open, fwd.Proto, fwd.Address))
+	if err != nil {
+		return err
+	}
+	logger.Infow("forwarding port", "proto", fwd.Proto, "listen", fwd.Listen, "peer", id.Pretty(), "ip", ip, "address", fwd.Address)
+	p.track(fwd, ln)
+	return nil
+}
+
+// track remembers a forwarded port and the listener forwarding it.
+func (p *portForwards) track(fwd control.Forward, ln io.Closer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.active = append(p.active, activeForward{Forward: fwd, ln: ln})
+}
+
+// list returns the forwarded ports.
+func (p *portForwards) list() []control.Forward {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	result := make([]control.Forward, 0, len(p.active))
+	for _, a := range p.active {
+		result = append(result, a.Forward)
+	}
+	return result
+}
+
+// Close stops forwarding every port.
+func (p *portForwards) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var err error
+	for _, a := range p.active {
+		if cerr := a.ln.Close(); err == nil {
+			err = cerr
+		}
+	}
+	p.active = nil
+	return err
+}
+
+// serveHTTP lists the forwarded ports, or forwards another port when
+// one is posted.
+func (p *portForwards) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		control.Reply(w, p.list())
+		return
+	}
+	var fwd control.Forward
+	err := json.NewDecoder(r.Body).Decode(&fwd)
+	if err == nil && fwd.Proto != portfwd.TCP && fwd.Proto != portfwd.UDP {
+		err = fmt.Errorf("unknown forwarding protocol %s", fwd.Proto)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = p.add(fwd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	control.Reply(w, fwd)
+}
+
+// newForwardRules creates the rules for the addresses peers may reach
+// through port forwarding from the config, resolving any peer names in
+// them to addresses.
+func newForwardRules(cfg *config.Config) ([]*portfwd.Rule, error) {
+	var rules []*portfwd.Rule
+	for _, a := range cfg.Forward.Allow {
+		var peers []string
+		if a.Peer != "" && a.Peer != "*" {
+			peer, err := peerAddress(cfg, a.Peer)
+			if err != nil {
+				return nil, err
+			}
+			peers = []string{peer}
+		}
+		rule, err := portfwd.NewRule(peers, a.Proto, a.Address)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// forwardHandler returns a stream handler which forwards ports for
+// peers to the addresses the rules allow them to reach.
+func forwardHandler(rules []*portfwd.Rule) network.StreamHandler {
+	return func(stream network.Stream) {
+		defer recoverPanic()
+
+		// If the remote node ID isn't in the list of known nodes don't respond.
+		src, ok := RevLookup[stream.Conn().RemotePeer().Pretty()]
+		if !ok {
+			logger.Debugw("rejected stream from unknown peer", "peer", stream.Conn().RemotePeer().Pretty())
+			stream.Reset()
+			return
+		}
+
+		err := portfwd.Serve(stream, func(proto string, address string) bool {
+			for _, r := range rules {
+				if r.Allows(src, proto, address) {
+					logger.Debugw("forwarding port for peer", "peer", stream.Conn().RemotePeer().Pretty(), "ip", src, "proto", proto, "address", address)
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			logger.Warnw("unable to forward port for peer", "peer", stream.Conn().RemotePeer().Pretty(), "ip", src, "error", err)
+		}
+	}
+}
+
+// proxyDialer returns a dialer for the proxies which connects to a port
+// of a peer, by name or address. In userspace mode it connects to the
+// peer's address through the userspace stack. Otherwise it connects
+// through port forwarding and the peer connects on to the port on its
+// loopback address.
+func proxyDialer(ctx context.Context, cfg *config.Config, node host.Host) portfwd.HostDialer {
+	return func(name string, port string) (io.ReadWriteCloser, error) {
+		// Accept names within the Magic DNS domain as well.
+		name = strings.TrimSuffix(strings.TrimSuffix(name, "."), "."+cfg.DNS.Domain)
+		ip, err := peerAddress(cfg, name)
+		if err != nil {
+			return nil, portfwd.ErrUnknownHost
+		}
+		if userStack != nil {
+			return userStack.Dial(ctx, portfwd.TCP, net.JoinHostPort(ip, port))
+		}
+		id, err := peer.Decode(cfg.Peers[ip].ID)
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err := node.NewStream(ctx, id, p2p.ForwardProtocol)
+		if err != nil {
+			return nil, err
+		}
+		err = portfwd.Request(stream, portfwd.TCP, net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			logger.Debugw("proxy connection refused by peer", "peer", id.Pretty(), "ip", ip, "port", port, "error", err)
+			stream.Close()
+			return nil, err
+		}
+		return stream, nil
+	}
+}
@@ -0,0 +1,317 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/hyprspace/hyprspace/firewall"
+	"github.com/hyprspace/hyprspace/l2"
+	"github.com/hyprspace/hyprspace/metrics"
+	"github.com/hyprspace/hyprspace/offload"
+	"github.com/hyprspace/hyprspace/policy"
+	"github.com/hyprspace/hyprspace/tun"
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// receiver writes the packets peers send over their streams to a
+// device. With mesh routing enabled, packets relayed for other peers
+// are handed on to the forwarder when relay is set.
+type receiver struct {
+	dev     tun.Device
+	offload bool
+	fwd     *forwarder
+	relay   bool
+
+	// exits are the subnets the node advertises, which only peers the
+	// policy provides the exit service to may send packets into.
+	exits []*net.IPNet
+}
+
+// handle receives packets from a peer.
+func (r *receiver) handle(stream network.Stream) {
+	defer recoverPanic()
+
+	// If the remote node ID isn't in the list of known nodes don't respond.
+	src, ok := RevLookup[stream.Conn().RemotePeer().Pretty()]
+	if !ok {
+		logger.Debugw("rejected stream from unknown peer", "peer", stream.Conn().RemotePeer().Pretty())
+		stream.Reset()
+		return
+	}
+
+	// With offloads enabled, merge TCP segments back into large ones
+	// until no more packets are buffered, so they're written to the
+	// device in one go.
+	in := bufio.NewReaderSize(stream, 64<<10)
+	var gro *offload.Coalescer
+	if r.offload {
+		gro = offload.NewCoalescer(maxSegment)
+		defer r.flush(src, gro)
+	}
+
+	// Leave room ahead of the packet for an empty virtio-net header in
+	// case the TUN device expects one.
+	var frame = make([]byte, offload.HeaderLen+maxPacket)
+	var packetSize = make([]byte, 2)
+	for {
+		if gro != nil && in.Buffered() == 0 {
+			r.flush(src, gro)
+		}
+
+		// Read the incoming packet's size as a binary value.
+		_, err := io.ReadFull(in, packetSize)
+		if err != nil {
+			stream.Close()
+			return
+		}
+
+		// Decode the incoming packet's size from binary.
+		size := int(binary.LittleEndian.Uint16(packetSize))
+		if size > len(frame)-offload.HeaderLen {
+			logger.Debugw("rejected oversized packet", "peer", stream.Conn().RemotePeer().Pretty(), "ip", src, "size", size)
+			stream.Reset()
+			return
+		}
+
+		// Read in the packet until completion.
+		_, err = io.ReadFull(in, frame[offload.HeaderLen:offload.HeaderLen+size])
+		if err != nil {
+			stream.Close()
+			return
+		}
+
+		// Packets which can't be merged are written after the segment
+		// before them.
+		if gro != nil {
+			packet := frame[offload.HeaderLen : offload.HeaderLen+size]
+			if gro.Add(packet) {
+				continue
+			}
+			r.flush(src, gro)
+			if gro.Add(packet) {
+				continue
+			}
+		}
+		r.deliver(src, frame[:offload.HeaderLen+size])
+	}
+}
+
+// flush delivers the segment a coalescer merged from a peer's packets.
+func (r *receiver) flush(src string, gro *offload.Coalescer) {
+	if frame := gro.Flush(); frame != nil {
+		r.deliver(src, frame)
+	}
+}
+
+// handleOffload receives packets from a peer which sends large TCP
+// segments in one piece along with their virtio-net header. It's only
+// used when the device has offloads enabled.
+func (r *receiver) handleOffload(stream network.Stream) {
+	defer recoverPanic()
+
+	// If the remote node ID isn't in the list of known nodes don't respond.
+	src, ok := RevLookup[stream.Conn().RemotePeer().Pretty()]
+	if !ok {
+		logger.Debugw("rejected stream from unknown peer", "peer", stream.Conn().RemotePeer().Pretty())
+		stream.Reset()
+		return
+	}
+	var frame = make([]byte, offload.HeaderLen+maxSegment)
+	var frameSize = make([]byte, 4)
+	for {
+		_, err := io.ReadFull(stream, frameSize)
+		if err != nil {
+			stream.Close()
+			return
+		}
+		size := int(binary.LittleEndian.Uint32(frameSize))
+		if size < offload.HeaderLen || size > len(frame) {
+			logger.Debugw("rejected oversized packet", "peer", stream.Conn().RemotePeer().Pretty(), "ip", src, "size", size)
+			stream.Reset()
+			return
+		}
+		_, err = io.ReadFull(stream, frame[:size])
+		if err != nil {
+			stream.Close()
+			return
+		}
+
+		// Don't hand the kernel segments it can't handle.
+		hdr := offload.Decode(frame)
+		err = hdr.Validate(frame[offload.HeaderLen:size])
+		if err != nil {
+			logger.Debugw("rejected invalid offload header", "peer", stream.Conn().RemotePeer().Pretty(), "ip", src, "error", err)
+			metrics.Drops.WithLabelValues(metrics.DropTUNError).Inc()
+			continue
+		}
+		r.deliver(src, frame[:size])
+	}
+}
+
+// handleRelay receives packets a peer relays. Packets for other peers
+// are relayed on while they have hops left, and the others are
+// delivered as if they came from the peer their source address belongs
+// to.
+func (r *receiver) handleRelay(stream network.Stream) {
+	defer recoverPanic()
+
+	// If the remote node ID isn't in the list of known nodes don't respond.
+	viaID := stream.Conn().RemotePeer().Pretty()
+	via, ok := RevLookup[viaID]
+	if !ok {
+		logger.Debugw("rejected stream from unknown peer", "peer", viaID)
+		stream.Reset()
+		return
+	}
+
+	// Read the hop limit into the last byte of the empty virtio-net
+	// header so the packet lands right behind it.
+	var frame = make([]byte, offload.HeaderLen+maxPacket)
+	var frameSize = make([]byte, 2)
+	for {
+		_, err := io.ReadFull(stream, frameSize)
+		if err != nil {
+			stream.Close()
+			return
+		}
+		size := int(binary.LittleEndian.Uint16(frameSize))
+		if size < 1 || size > 1+maxPacket {
+			logger.Debugw("rejected oversized packet", "peer", viaID, "ip", via, "size", size)
+			stream.Reset()
+			return
+		}
+		_, err = io.ReadFull(stream, frame[offload.HeaderLen-1:offload.HeaderLen-1+size])
+		if err != nil {
+			stream.Close()
+			return
+		}
+		hops := frame[offload.HeaderLen-1]
+		frame[offload.HeaderLen-1] = 0
+		packet := frame[offload.HeaderLen : offload.HeaderLen-1+size]
+		if len(packet) < 20 || packet[0]>>4 != 4 {
+			metrics.Drops.WithLabelValues(metrics.DropTUNError).Inc()
+			continue
+		}
+
+		// Relay packets for other peers if the node relays for the
+		// peer they came from.
+		dst := net.IP(packet[16:20]).String()
+		if _, ok := r.fwd.peers[dst]; ok {
+			if !r.relay || (pol != nil && !pol.Provides(policy.Relay, via)) {
+				metrics.Drops.WithLabelValues(metrics.DropNoPeer).Inc()
+				continue
+			}
+			if hops == 0 {
+				metrics.Drops.WithLabelValues(metrics.DropHopLimit).Inc()
+				continue
+			}
+			r.fwd.relay(packet, hops-1)
+			continue
+		}
+
+		// Only accept packets from peers the relay announced a route
+		// to, through relays the node may use. Peers with a direct
+		// connection send their packets straight to the node, so
+		// relayed packets claiming to come from them are forged.
+		src := net.IP(packet[12:16]).String()
+		srcID, ok := r.fwd.peers[src]
+		if !ok || !routes.Reaches(viaID, srcID.Pretty()) || r.fwd.connected(srcID) ||
+			(pol != nil && !pol.Uses(policy.Relay, via)) {
+			metrics.Drops.WithLabelValues(metrics.DropNoPeer).Inc()
+			continue
+		}
+		r.deliver(src, frame[:offload.HeaderLen+len(packet)])
+	}
+}
+
+// deliver writes a packet from a peer to the device if the firewall and
+// the peer's limits allow it. The packet in frame is preceded by its
+// virtio-net header, which is only written when offloads are enabled.
+func (r *receiver) deliver(src string, frame []byte) {
+	packet := frame[offload.HeaderLen:]
+
+	// Drop packets whose source is neither the peer's address nor within
+	// a subnet routed through it, so peers can't pass as one another.
+	if macs == nil && !fromPeer(src, packet) {
+		metrics.Drops.WithLabelValues(metrics.DropSpoofed).Inc()
+		return
+	}
+
+	// Drop packets for the node's subnets from peers the policy doesn't
+	// let use it as their exit.
+	if pol != nil && r.exit(packet) && !pol.Provides(policy.Exit, src) {
+		metrics.Drops.WithLabelValues(metrics.DropFirewall).Inc()
+		return
+	}
+
+	// Learn which peer the sender of a frame is behind in TAP mode. The
+	// table won't move an address another peer holds, so a peer can't
+	// take over the traffic for hosts behind another.
+	if macs != nil {
+		if len(packet) < l2.HeaderLen {
+			metrics.Drops.WithLabelValues(metrics.DropTUNError).Inc()
+			return
+		}
+		macs.Learn(l2.Src(packet), src)
+	}
+
+	// Drop broadcast and multicast packets which already arrived through
+	// another peer, and remember the others so they aren't sent back out.
+	if groups != nil && len(packet) >= 20 {
+		if _, ok := groups.Peers(net.IP(packet[16:20])); ok && groups.Duplicate(packet) {
+			metrics.Drops.WithLabelValues(metrics.DropDuplicate).Inc()
+			return
+		}
+	}
+
+	// Drop packets the firewall doesn't allow in from the peer.
+	if fw != nil && !fw.Allow(packet, src, firewall.Inbound) {
+		metrics.Drops.WithLabelValues(metrics.DropFirewall).Inc()
+		return
+	}
+
+	// Drop packets over the peer's rate limit or quota.
+	if !withinLimits(src, len(packet), false) {
+		return
+	}
+	if !r.offload {
+		frame = packet
+	}
+	_, err := r.dev.Write(frame)
+	if err != nil {
+		metrics.Drops.WithLabelValues(metrics.DropTUNError).Inc()
+		return
+	}
+	metrics.RxBytes.WithLabelValues(src).Add(float64(len(packet)))
+	metrics.RxPackets.WithLabelValues(src).Inc()
+}
+
+// exit reports whether an IPv4 packet is headed into one of the subnets
+// the node advertises.
+func (r *receiver) exit(packet []byte) bool {
+	if len(packet) < 20 {
+		return false
+	}
+	dst := net.IP(packet[16:20])
+	for _, n := range r.exits {
+		if n.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromPeer reports whether an IPv4 packet received from the peer at the
+// given address has a source the peer may send from.
+func fromPeer(peer string, packet []byte) bool {
+	if len(packet) < 20 {
+		return false
+	}
+	src := net.IP(packet[12:16])
+	if src.String() == peer {
+		return true
+	}
+	return subnets != nil && subnets.Through(peer, src)
+}
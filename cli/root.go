@@ -2,11 +2,12 @@ package cli
 
 import (
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
 	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/hyprspace/hyprspace/logging"
+	"go.uber.org/zap"
 )
 
 var appVersion string = "develop"
@@ -19,6 +20,12 @@ type GlobalFlags struct {
 // Root is the main command.
 var Root *cmd.Root
 
+// logger records the daemon's logs alongside those of libp2p.
+var logger = logging.Logger
+
+// fatalLogger reports the caller of checkErr rather than checkErr itself.
+var fatalLogger = logger.Desugar().WithOptions(zap.AddCallerSkip(1)).Sugar()
+
 func init() {
 	Root = &cmd.Root{
 		Name:    "hyprspace",
@@ -31,13 +38,24 @@ func init() {
 	cmd.Register(&Init)
 	cmd.Register(&Up)
 	cmd.Register(&Down)
+	cmd.Register(&Status)
+	cmd.Register(&Forward)
+	cmd.Register(&Logs)
 	cmd.Register(&Update)
 	cmd.Register(&cmd.Version)
+
+	// Log plain text until an interface's config says otherwise.
+	err := logging.Setup("info", "error", "text", nil)
+	if err != nil {
+		panic(err)
+	}
 }
 
+// checkErr cleans up after a running daemon and exits on errors.
 func checkErr(err error) {
 	if err != nil {
-		log.Fatal(err)
+		shutdown()
+		fatalLogger.Fatalw("fatal error", "error", err)
 	}
 }
 
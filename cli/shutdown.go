@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// drainTimeout bounds how long shutdown waits for the packets queued
+// for peers to be sent before moving on.
+const drainTimeout = 5 * time.Second
+
+var (
+	// cleanups undo each step of bringing up the daemon. They're run
+	// in reverse order when it shuts down.
+	cleanups     []cleanup
+	cleanupLock  sync.Mutex
+	shutdownOnce sync.Once
+)
+
+// cleanup is a named step of the shutdown sequence.
+type cleanup struct {
+	name string
+	fn   func() error
+}
+
+// onShutdown registers a step to run when the daemon shuts down. Steps
+// run in the reverse order they were registered in.
+func onShutdown(name string, fn func() error) {
+	cleanupLock.Lock()
+	defer cleanupLock.Unlock()
+	cleanups = append(cleanups, cleanup{name: name, fn: fn})
+}
+
+// shutdown runs the registered cleanup steps, logging rather than
+// stopping on errors so every step gets its chance. Only the first
+// call has any effect. Steps must not call checkErr.
+func shutdown() {
+	shutdownOnce.Do(func() {
+		cleanupLock.Lock()
+		steps := cleanups
+		cleanups = nil
+		cleanupLock.Unlock()
+
+		for i := len(steps) - 1; i >= 0; i-- {
+			logger.Debugw("shutting down", "step", steps[i].name)
+			if err := steps[i].fn(); err != nil {
+				logger.Warnw("unable to "+steps[i].name, "error", err)
+			}
+		}
+	})
+}
+
+// signalExit waits for a SIGINT or SIGTERM and then shuts the daemon
+// down and exits.
+func signalExit() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	<-ch
+
+	logger.Info("received signal, shutting down")
+	shutdown()
+	os.Exit(0)
+}
+
+// recoverPanic cleans up after the daemon when the calling goroutine
+// panics. It must be deferred at the top of the goroutine.
+func recoverPanic() {
+	if r := recover(); r != nil {
+		logger.Errorw("daemon panicked, shutting down", "panic", r, "stack", string(debug.Stack()))
+		shutdown()
+		os.Exit(2)
+	}
+}
+
+// waitTimeout waits for fn to return for at most timeout and reports
+// whether it did.
+func waitTimeout(timeout time.Duration, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,209 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/hyprspace/hyprspace/config"
+	"github.com/hyprspace/hyprspace/control"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Status shows the state of a running Hyprspace interface.
+var Status = cmd.Sub{
+	Name:  "status",
+	Alias: "s",
+	Short: "Show The Status Of A Hyprspace Interface.",
+	Args:  &StatusArgs{},
+	Run:   StatusRun,
+}
+
+// StatusArgs handles the specific arguments for the status command.
+type StatusArgs struct {
+	InterfaceName string
+}
+
+// StatusRun handles the execution of the status command.
+func StatusRun(r *cmd.Root, c *cmd.Sub) {
+	// Parse Command Args
+	args := c.Args.(*StatusArgs)
+
+	var status control.Status
+	err := control.Get(socketPath(args.InterfaceName), "/status", &status)
+	checkErr(err)
+
+	fmt.Printf("interface: %s\n", status.Interface)
+	fmt.Printf("  address: %s\n", status.Address)
+	fmt.Printf("  id: %s\n", status.ID)
+	if len(status.Tags) > 0 {
+		fmt.Printf("  tags: %s\n", strings.Join(status.Tags, ", "))
+	}
+
+	for _, p := range status.Peers {
+		fmt.Println()
+		if p.Name != "" {
+			fmt.Printf("peer: %s (%s)\n", p.Address, p.Name)
+		} else {
+			fmt.Printf("peer: %s\n", p.Address)
+		}
+		fmt.Printf("  id: %s\n", p.ID)
+		if len(p.Tags) > 0 {
+			fmt.Printf("  tags: %s\n", strings.Join(p.Tags, ", "))
+		}
+		fmt.Printf("  connected: %t\n", p.Connected)
+	}
+
+	if len(status.Policy) > 0 {
+		fmt.Println()
+		fmt.Println("policy:")
+		for _, rule := range status.Policy {
+			fmt.Printf("  %s\n", rule)
+		}
+	}
+
+	if len(status.Rules) > 0 {
+		fmt.Println()
+		fmt.Println("firewall:")
+		for _, rule := range status.Rules {
+			fmt.Printf("  %s: %d packets, %d bytes", rule.Rule, rule.Packets, rule.Bytes)
+			if rule.Comment != "" {
+				fmt.Printf(" (%s)", rule.Comment)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("  dropped: %d packets\n", status.Dropped)
+	}
+
+	if len(status.Quotas) > 0 {
+		fmt.Println()
+		fmt.Println("quotas:")
+		for _, q := range status.Quotas {
+			fmt.Printf("  %s: %d of %d bytes used in %s\n", q.Address, q.Used, q.Limit, q.Month)
+		}
+	}
+
+	if len(status.Forwards) > 0 {
+		fmt.Println()
+		fmt.Println("forwards:")
+		for _, f := range status.Forwards {
+			fmt.Printf("  %s %s -> %s on %s\n", f.Proto, f.Listen, f.Address, f.Peer)
+		}
+	}
+
+	if len(status.Subnets) > 0 {
+		fmt.Println()
+		fmt.Println("subnets:")
+		for _, s := range status.Subnets {
+			fmt.Printf("  %s via %s (gateways %s)\n", s.Subnet, s.Active, strings.Join(s.Gateways, ", "))
+		}
+	}
+}
+
+// socketPath returns the path of the control socket for an interface.
+func socketPath(name string) string {
+	return filepath.Join(runtimeDir(), name+".sock")
+}
+
+// controlHandler answers control requests for a running interface.
+func controlHandler(cfg *config.Config, node host.Host) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		control.Reply(w, currentStatus(cfg, node))
+	})
+	mux.HandleFunc("/quota", func(w http.ResponseWriter, r *http.Request) {
+		control.Reply(w, currentQuotas())
+	})
+	mux.HandleFunc("/forward", ports.serveHTTP)
+	return mux
+}
+
+// currentStatus collects the state of the running interface.
+func currentStatus(cfg *config.Config, node host.Host) control.Status {
+	result := control.Status{
+		Interface: cfg.Interface.Name,
+		Address:   cfg.Interface.Address,
+		ID:        node.ID().Pretty(),
+		Tags:      cfg.Interface.Tags,
+	}
+
+	for ip, p := range cfg.Peers {
+		ps := control.PeerStatus{
+			Address: ip,
+			Name:    p.Name,
+			ID:      p.ID,
+			Tags:    p.Tags,
+		}
+		if id, err := peer.Decode(p.ID); err == nil {
+			ps.Connected = node.Network().Connectedness(id) == network.Connected
+		}
+		result.Peers = append(result.Peers, ps)
+	}
+	sort.Slice(result.Peers, func(i, j int) bool {
+		a := net.ParseIP(result.Peers[i].Address).To16()
+		b := net.ParseIP(result.Peers[j].Address).To16()
+		return bytes.Compare(a, b) < 0
+	})
+
+	if pol != nil {
+		for _, rule := range pol.Rules() {
+			result.Policy = append(result.Policy, rule.String())
+		}
+	}
+
+	if fw != nil {
+		for _, rule := range fw.Rules() {
+			result.Rules = append(result.Rules, control.RuleStatus{
+				Rule:    rule.String(),
+				Comment: rule.Comment,
+				Packets: atomic.LoadUint64(&rule.Packets),
+				Bytes:   atomic.LoadUint64(&rule.Bytes),
+			})
+		}
+		result.Dropped = fw.Dropped()
+	}
+
+	result.Quotas = currentQuotas()
+	result.Forwards = ports.list()
+
+	if subnets != nil {
+		for _, r := range subnets.Routes() {
+			result.Subnets = append(result.Subnets, control.Subnet{
+				Subnet:   r.Subnet,
+				Gateways: r.Gateways,
+				Active:   r.Active,
+			})
+		}
+	}
+	return result
+}
+
+// currentQuotas collects the monthly traffic of peers with a quota.
+func currentQuotas() []control.QuotaStatus {
+	if quota == nil {
+		return nil
+	}
+	var result []control.QuotaStatus
+	for ip, u := range quota.Usage() {
+		result = append(result, control.QuotaStatus{
+			Address: ip,
+			Month:   u.Month,
+			Used:    u.Used,
+			Limit:   u.Limit,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a := net.ParseIP(result[i].Address).To16()
+		b := net.ParseIP(result[j].Address).To16()
+		return bytes.Compare(a, b) < 0
+	})
+	return result
+}
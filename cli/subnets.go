@@ -0,0 +1,323 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hyprspace/hyprspace/config"
+	"github.com/hyprspace/hyprspace/p2p"
+	"github.com/hyprspace/hyprspace/policy"
+	"github.com/hyprspace/hyprspace/subnet"
+	"github.com/hyprspace/hyprspace/tun"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+// advertiseInterval is how often gateways advertise their subnets.
+const advertiseInterval = 20 * time.Second
+
+// subnetTTL is how long advertised subnets are routed without being
+// advertised again.
+const subnetTTL = 3 * advertiseInterval
+
+// maxAdvertisement bounds the size of a subnet advertisement.
+const maxAdvertisement = 64 << 10
+
+// advertiseBoot tells the node's subnet advertisements apart from those
+// of its earlier runs, and advertiseSeq numbers them within this run.
+var (
+	advertiseBoot = newBoot()
+	advertiseSeq  uint64
+)
+
+// probeFailures is how many probes in a row a gateway has to miss
+// before its subnets fail over.
+const probeFailures = 3
+
+// advertiseSubnets advertises the subnets the node is a gateway to, to
+// every connected peer the policy provides the exit service to until
+// ctx is cancelled. Peers which connect get them right away so they can
+// fail back without waiting.
+func advertiseSubnets(ctx context.Context, node host.Host, peerTable map[string]peer.ID, cidrs []string, priority int) {
+	defer recoverPanic()
+
+	node.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, c network.Conn) {
+			ip, ok := RevLookup[c.RemotePeer().Pretty()]
+			if ok && ctx.Err() == nil && providesExit(ip) {
+				go advertise(ctx, node, c.RemotePeer(), cidrs, priority)
+			}
+		},
+	})
+
+	ticker := time.NewTicker(advertiseInterval)
+	defer ticker.Stop()
+	for {
+		for ip, id := range peerTable {
+			if node.Network().Connectedness(id) != network.Connected || !providesExit(ip) {
+				continue
+			}
+			err := advertise(ctx, node, id, cidrs, priority)
+			if err != nil && ctx.Err() == nil {
+				logger.Debugw("unable to advertise subnets", "peer", id.Pretty(), "ip", ip, "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// withdrawSubnets tells connected peers the node no longer routes to
+// any subnets so they stop routing them through it right away.
+func withdrawSubnets(node host.Host, peerTable map[string]peer.ID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for ip, id := range peerTable {
+		if node.Network().Connectedness(id) != network.Connected {
+			continue
+		}
+		err := advertise(ctx, node, id, nil, 0)
+		if err != nil {
+			logger.Debugw("unable to withdraw subnets", "peer", id.Pretty(), "ip", ip, "error", err)
+		}
+	}
+	return nil
+}
+
+// advertise sends a signed advertisement of subnets to a peer.
+// Advertisements are numbered in the order they're made so peers ignore
+// any older ones arriving late.
+func advertise(ctx context.Context, node host.Host, id peer.ID, cidrs []string, priority int) error {
+	signed, err := subnet.Sign(node.Peerstore().PrivKey(node.ID()), subnet.Advertisement{
+		Subnets:  cidrs,
+		Boot:     advertiseBoot,
+		Seq:      atomic.AddUint64(&advertiseSeq, 1),
+		Priority: priority,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, advertiseInterval/2)
+	defer cancel()
+	stream, err := node.NewStream(ctx, id, p2p.SubnetsProtocol)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(stream).Encode(signed)
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	return stream.Close()
+}
+
+// subnetsHandler routes the subnets gateways advertise through them, as
+// long as the policy lets the node use them as its exit and they're
+// within one of the accepted ranges without overlapping the
+// interface's own network.
+func subnetsHandler(accept []*net.IPNet, local *net.IPNet) network.StreamHandler {
+	return func(stream network.Stream) {
+		defer recoverPanic()
+
+		// If the remote node ID isn't in the list of known nodes don't respond.
+		id := stream.Conn().RemotePeer()
+		ip, ok := RevLookup[id.Pretty()]
+		if !ok {
+			logger.Debugw("rejected stream from unknown peer", "peer", id.Pretty())
+			stream.Reset()
+			return
+		}
+		if pol != nil && !pol.Uses(policy.Exit, ip) {
+			logger.Debugw("rejected subnet advertisement from peer the policy doesn't allow as exit", "peer", id.Pretty(), "ip", ip)
+			stream.Reset()
+			return
+		}
+
+		// Only trust advertisements signed by the gateway itself.
+		var signed subnet.Signed
+		err := json.NewDecoder(io.LimitReader(stream, maxAdvertisement)).Decode(&signed)
+		if err != nil {
+			logger.Debugw("rejected invalid subnet advertisement", "peer", id.Pretty(), "ip", ip, "error", err)
+			stream.Reset()
+			return
+		}
+		ad, err := signed.Verify(id)
+		if err != nil {
+			logger.Warnw("rejected subnet advertisement", "peer", id.Pretty(), "ip", ip, "error", err)
+			stream.Reset()
+			return
+		}
+		stream.Close()
+
+		var nets []*net.IPNet
+		for _, cidr := range ad.Subnets {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil || !acceptSubnet(accept, local, n) {
+				logger.Debugw("rejected advertised subnet", "peer", id.Pretty(), "ip", ip, "subnet", cidr)
+				continue
+			}
+			nets = append(nets, n)
+		}
+		added, removed, ok := subnets.Update(ip, ad.Boot, ad.Seq, ad.Priority, nets)
+		if ok {
+			updateRoutes(added, removed)
+		}
+	}
+}
+
+// providesExit reports whether the policy lets the peer at the given
+// address route packets into the node's subnets.
+func providesExit(ip string) bool {
+	return pol == nil || pol.Provides(policy.Exit, ip)
+}
+
+// subnetRanges parses the ranges the interface accepts subnets within
+// and its own network.
+func subnetRanges(cfg *config.Config) ([]*net.IPNet, *net.IPNet, error) {
+	var accept []*net.IPNet
+	for _, cidr := range cfg.Subnets.Accept {
+		_, r, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, nil, err
+		}
+		accept = append(accept, r)
+	}
+	_, local, err := net.ParseCIDR(cfg.Interface.Address)
+	return accept, local, err
+}
+
+// acceptSubnet reports whether a subnet is within one of the accepted
+// ranges without overlapping the local network.
+func acceptSubnet(accept []*net.IPNet, local *net.IPNet, n *net.IPNet) bool {
+	if local.Contains(n.IP) || n.Contains(local.IP) {
+		return false
+	}
+	ones, bits := n.Mask.Size()
+	for _, r := range accept {
+		rOnes, rBits := r.Mask.Size()
+		if rBits == bits && rOnes <= ones && r.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// expireSubnets withdraws the subnets of gateways which stopped
+// advertising them or went away, until ctx is cancelled.
+func expireSubnets(ctx context.Context, node host.Host) {
+	defer recoverPanic()
+
+	node.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			ip, ok := RevLookup[c.RemotePeer().Pretty()]
+			if ok && ctx.Err() == nil && n.Connectedness(c.RemotePeer()) != network.Connected {
+				updateRoutes(nil, subnets.Withdraw(ip))
+			}
+		},
+	})
+
+	ticker := time.NewTicker(advertiseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			updateRoutes(nil, subnets.Expire())
+		}
+	}
+}
+
+// probeGateways pings the gateways of subnets every interval until ctx
+// is cancelled. Subnets fail over to other gateways once theirs misses
+// probeFailures pings in a row, and can fail back once it answers.
+func probeGateways(ctx context.Context, node host.Host, peerTable map[string]peer.ID, interval time.Duration) {
+	defer recoverPanic()
+
+	failures := make(map[string]int)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Probe gateways in parallel so one which is down doesn't hold
+		// up the others.
+		gateways := subnets.Gateways()
+		answered := make([]bool, len(gateways))
+		var wg sync.WaitGroup
+		for i, gw := range gateways {
+			wg.Add(1)
+			go func(i int, id peer.ID) {
+				defer wg.Done()
+				answered[i] = probe(ctx, node, id, interval)
+			}(i, peerTable[gw])
+		}
+		wg.Wait()
+
+		for i, gw := range gateways {
+			if answered[i] {
+				failures[gw] = 0
+			} else {
+				failures[gw]++
+			}
+			if answered[i] || failures[gw] >= probeFailures {
+				for _, f := range subnets.SetUp(gw, answered[i]) {
+					logger.Warnw("switching subnet gateway", "subnet", f.Subnet, "from", f.From, "to", f.To)
+				}
+			}
+		}
+	}
+}
+
+// probe pings a gateway and reports whether it answered in time.
+func probe(ctx context.Context, node host.Host, id peer.ID, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res, ok := <-ping.Ping(ctx, node, id)
+	return ok && res.Error == nil
+}
+
+// updateRoutes adds routes through the interface to the subnets which
+// became reachable and removes those to subnets which no longer are.
+func updateRoutes(added, removed []*net.IPNet) {
+	dev := tunDev.(*tun.TUN)
+	for _, n := range added {
+		logger.Infow("adding route to subnet", "subnet", n.String())
+		if err := dev.AddRoute(n); err != nil {
+			logger.Errorw("unable to add route to subnet", "subnet", n.String(), "error", err)
+		}
+	}
+	for _, n := range removed {
+		logger.Infow("removing route to subnet", "subnet", n.String())
+		if err := dev.DelRoute(n); err != nil {
+			logger.Errorw("unable to remove route to subnet", "subnet", n.String(), "error", err)
+		}
+	}
+}
+
+// newBoot picks a random number for the node's subnet advertisements
+// of this run.
+func newBoot() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
@@ -2,10 +2,9 @@ package cli
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"os"
 	"os/signal"
@@ -18,25 +17,88 @@ import (
 
 	"github.com/DataDrake/cli-ng/v2/cmd"
 	"github.com/hyprspace/hyprspace/config"
+	"github.com/hyprspace/hyprspace/control"
+	"github.com/hyprspace/hyprspace/dns"
+	"github.com/hyprspace/hyprspace/firewall"
+	"github.com/hyprspace/hyprspace/hosts"
+	"github.com/hyprspace/hyprspace/l2"
+	"github.com/hyprspace/hyprspace/limit"
+	"github.com/hyprspace/hyprspace/logging"
+	"github.com/hyprspace/hyprspace/mcast"
+	"github.com/hyprspace/hyprspace/mesh"
+	"github.com/hyprspace/hyprspace/metrics"
 	"github.com/hyprspace/hyprspace/p2p"
+	"github.com/hyprspace/hyprspace/pidfile"
+	"github.com/hyprspace/hyprspace/policy"
+	"github.com/hyprspace/hyprspace/portfwd"
+	"github.com/hyprspace/hyprspace/subnet"
 	"github.com/hyprspace/hyprspace/tun"
 	"github.com/libp2p/go-libp2p-core/host"
-	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/nxadm/tail"
 )
 
 var (
-	// iface is the tun device used to pass packets between
+	// tunDev is the device used to pass packets between
 	// Hyprspace and the user's machine.
-	tunDev *tun.TUN
+	tunDev tun.Device
+	// userStack is the TCP/IP stack the interface runs on in
+	// userspace mode, which the proxies and forwarded ports connect
+	// to peers through.
+	userStack userspaceStack
 	// RevLookup allow quick lookups of an incoming stream
 	// for security before accepting or responding to any data.
 	RevLookup map[string]string
-	// activeStreams is a map of active streams to a peer
-	activeStreams map[string]network.Stream
+	// dnsServer answers queries for peer names when Magic DNS
+	// is enabled for the interface.
+	dnsServer *dns.Server
+	// fw filters packets exchanged with peers when the firewall
+	// is enabled for the interface.
+	fw *firewall.Firewall
+	// pol decides which groups of peers may talk to each other
+	// and use each other's services when the policy is enabled.
+	pol *policy.Policy
+	// limiters holds the rate limits of each peer by address.
+	limiters map[string]*limit.Limiter
+	// quota tracks the monthly traffic of peers with a quota.
+	quota *limit.Quota
+	// groups decides which peers broadcast and multicast packets
+	// are forwarded to when multicast forwarding is enabled.
+	groups *mcast.Table
+	// macs holds the peer each MAC address was learned behind when
+	// the interface is a TAP device.
+	macs *l2.Table
+	// routes holds the peers each neighbour relays packets to when
+	// mesh routing is enabled.
+	routes *mesh.Table
+	// subnets holds the gateways to the subnets peers advertise
+	// when the interface accepts any.
+	subnets *subnet.Table
 )
 
+// userspaceStack is a device running a TCP/IP stack inside the daemon,
+// which connections to peers' addresses are opened through.
+type userspaceStack interface {
+	tun.Device
+	Dial(ctx context.Context, proto string, address string) (net.Conn, error)
+}
+
+// macTTL is how long a MAC address is remembered behind a peer after
+// the last frame from it.
+const macTTL = 5 * time.Minute
+
+// duplicateWindow is how long a broadcast or multicast packet is
+// remembered to suppress duplicates and loops.
+const duplicateWindow = 500 * time.Millisecond
+
+// msgPeerConnected is logged by the daemon each time a peer is first
+// reached.
+const msgPeerConnected = "peer connected"
+
+// readyTimeout is how long the parent process waits for a new daemon
+// to connect to its peers.
+const readyTimeout = 30 * time.Second
+
 // Up creates and brings up a Hyprspace Interface.
 var Up = cmd.Sub{
 	Name:  "up",
@@ -54,7 +116,8 @@ type UpArgs struct {
 
 // UpFlags handles the specific flags for the up command.
 type UpFlags struct {
-	Foreground bool `short:"f" long:"foreground" desc:"Don't Create Background Daemon."`
+	Foreground bool   `short:"f" long:"foreground" desc:"Don't Create Background Daemon."`
+	LogFile    string `short:"l" long:"log-file" desc:"Write Daemon Logs To This File."`
 }
 
 // UpRun handles the execution of the up command.
@@ -76,7 +139,11 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 	checkErr(err)
 
 	if !flags.Foreground {
-		if err := createDaemon(cfg); err != nil {
+		// Refuse to start a second daemon for the same interface.
+		if pid, err := pidfile.Owner(pidPath(cfg.Interface.Name)); err == nil {
+			checkErr(&pidfile.RunningError{PID: pid})
+		}
+		if err := createDaemon(cfg, daemonLogPath(cfg, flags.LogFile)); err != nil {
 			fmt.Println("[+] Failed to Create Hyprspace Daemon")
 			fmt.Println(err)
 		} else {
@@ -85,61 +152,140 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 		return
 	}
 
+	// Setup the daemon's log level, format and output. Logs go to
+	// stderr unless a log file is given.
+	var logOut io.Writer
+	if path := foregroundLogPath(cfg, flags.LogFile); path != "" {
+		log, err := openLog(cfg, path)
+		checkErr(err)
+
+		// Write panics to the current log rather than to whichever
+		// file stderr was opened as before the log was rotated.
+		checkErr(log.CaptureStderr())
+		logOut = log
+	}
+	err = logging.Setup(cfg.Log.Level, cfg.Log.Libp2pLevel, cfg.Log.Format, logOut)
+	checkErr(err)
+
+	// Lock the pidfile to make sure this is the only daemon running
+	// for the interface.
+	pid, err := pidfile.Acquire(pidPath(cfg.Interface.Name))
+	checkErr(err)
+
+	// Release the pidfile last so no new daemon starts while this
+	// one is still cleaning up.
+	onShutdown("release pidfile", pid.Release)
+
+	// Clean up after the daemon if it's stopped or crashes.
+	defer recoverPanic()
+	go signalExit()
+
 	// Setup reverse lookup hash map for authentication.
 	RevLookup = make(map[string]string, len(cfg.Peers))
 	for ip, id := range cfg.Peers {
 		RevLookup[id.ID] = ip
 	}
 
-	fmt.Println("[+] Creating TUN Device")
+	// Setup the group policy and firewall before any packets
+	// can be exchanged.
+	if cfg.Policy.Enable {
+		pol, err = newPolicy(cfg)
+		checkErr(err)
+	}
+	if cfg.Firewall.Enable || cfg.Policy.Enable {
+		fw, err = newFirewall(cfg)
+		checkErr(err)
+	}
 
-	if runtime.GOOS == "darwin" {
-		if len(cfg.Peers) > 1 {
-			checkErr(errors.New("cannot create interface macos does not support more than one peer"))
-		}
+	// Setup forwarding of broadcast and multicast packets.
+	groups, err = newGroups(cfg)
+	checkErr(err)
 
-		// Grab ip address of only peer in config
-		var destPeer string
-		for ip := range cfg.Peers {
-			destPeer = ip
-		}
+	// Setup per peer rate limits and monthly quotas.
+	limiters, quota, err = newLimits(cfg)
+	checkErr(err)
+	if quota != nil {
+		quotaCtx, stopSaving := context.WithCancel(context.Background())
+		go saveQuotas(quotaCtx, quota)
+		onShutdown("save quotas", func() error {
+			stopSaving()
+			return quota.Save()
+		})
+	}
 
-		// Create new TUN device
-		tunDev, err = tun.New(
-			cfg.Interface.Name,
-			tun.Address(cfg.Interface.Address),
-			tun.DestAddress(destPeer),
-			tun.MTU(1420),
-		)
-	} else {
-		// Create new TUN device
-		tunDev, err = tun.New(
-			cfg.Interface.Name,
-			tun.Address(cfg.Interface.Address),
-			tun.MTU(1420),
-		)
+	// Run the pre up hooks before touching the system, and the post
+	// down hooks once everything else has been torn down.
+	err = runHooks(cfg, "pre_up", cfg.Interface.PreUp)
+	checkErr(err)
+	onShutdown("run post down hooks", func() error {
+		return runHooks(cfg, "post_down", cfg.Interface.PostDown)
+	})
+
+	// Learn which peer each host is behind from the frames peers send
+	// when bridging Ethernet.
+	if cfg.Interface.TAP {
+		macs = l2.NewTable(macTTL)
 	}
-	if err != nil {
+
+	// Track the gateways to subnets before packets from peers are
+	// checked against them.
+	if len(cfg.Subnets.Accept) > 0 {
+		subnets = subnet.NewTable(subnetTTL, cfg.Subnets.Failback)
+	}
+
+	// Create the device packets are exchanged with the system through.
+	// In userspace mode a TCP/IP stack inside the daemon stands in for
+	// the system interface.
+	var queues []io.ReadWriteCloser
+	var offloads bool
+	if cfg.Interface.Userspace {
+		logger.Info("creating userspace network stack")
+		userStack, err = newUserspaceStack(cfg)
+		checkErr(err)
+		tunDev, queues = userStack, []io.ReadWriteCloser{userStack}
+	} else {
+		logger.Info("creating tun device")
+		t, err := createTUN(cfg)
 		checkErr(err)
+		tunDev, queues, offloads = t, t.Queues, t.Offload
 	}
+	onShutdown("delete tun device", tunDev.Close)
 
 	// Setup System Context
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
 
-	fmt.Println("[+] Creating LibP2P Node")
+	logger.Info("creating libp2p node")
 
 	// Check that the listener port is available.
 	port, err := verifyPort(cfg.Interface.ListenPort)
 	checkErr(err)
 
+	// Write packets from peers to the TUN device.
+	rx := &receiver{dev: tunDev, offload: offloads}
+	for _, cidr := range cfg.Subnets.Advertise {
+		_, n, err := net.ParseCIDR(cidr)
+		checkErr(err)
+		rx.exits = append(rx.exits, n)
+	}
+
 	// Create P2P Node
 	host, dht, err := p2p.CreateNode(
 		ctx,
 		cfg.Interface.PrivateKey,
 		port,
-		streamHandler,
+		rx.handle,
 	)
 	checkErr(err)
+	onShutdown("close libp2p node", func() error {
+		dht.Close()
+		return host.Close()
+	})
+
+	// Accept large segments from peers when the TUN device can take
+	// them in one piece.
+	if offloads {
+		host.SetStreamHandler(p2p.OffloadProtocol, rx.handleOffload)
+	}
 
 	// Setup Peer Table for Quick Packet --> Dest ID lookup
 	peerTable := make(map[string]peer.ID)
@@ -148,21 +294,66 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 		checkErr(err)
 	}
 
-	fmt.Println("[+] Setting Up Node Discovery via DHT")
+	logger.Info("setting up node discovery via dht")
 
 	// Setup P2P Discovery
 	go p2p.Discover(ctx, host, dht, peerTable)
 	go prettyDiscovery(ctx, host, peerTable)
 
-	// Configure path for lock
-	lockPath := filepath.Join(filepath.Dir(cfg.Path), cfg.Interface.Name+".lock")
+	// Run peer hooks as peers connect and disconnect.
+	watchPeers(cfg, host)
 
-	// Register the application to listen for SIGINT/SIGTERM
-	go signalExit(host, lockPath)
+	// Answer peers' requests to forward ports, and forward the ports
+	// of peers in the config.
+	rules, err := newForwardRules(cfg)
+	checkErr(err)
+	if len(rules) > 0 {
+		host.SetStreamHandler(p2p.ForwardProtocol, forwardHandler(rules))
+	}
+	ports = newPortForwards(ctx, cfg, host)
+	onShutdown("close port forwards", ports.Close)
+	for _, fp := range cfg.Forward.Ports {
+		err = ports.add(control.Forward{
+			Proto:   fp.Proto,
+			Listen:  fp.Listen,
+			Peer:    fp.Peer,
+			Address: fp.Address,
+		})
+		checkErr(err)
+	}
+
+	// Connect local SOCKS and HTTP proxy clients to the services of
+	// peers.
+	if cfg.Proxy.Enable {
+		dial := proxyDialer(ctx, cfg, host)
+		logger.Infow("serving socks proxy", "address", cfg.Proxy.Address)
+		proxy, err := portfwd.ListenSOCKS(cfg.Proxy.Address, dial)
+		checkErr(err)
+		onShutdown("close socks proxy", proxy.Close)
+		if cfg.Proxy.HTTPAddress != "" {
+			logger.Infow("serving http proxy", "address", cfg.Proxy.HTTPAddress)
+			proxy, err := portfwd.ListenHTTP(cfg.Proxy.HTTPAddress, dial)
+			checkErr(err)
+			onShutdown("close http proxy", proxy.Close)
+		}
+	}
 
-	// Write lock to filesystem to indicate an existing running daemon.
-	err = os.WriteFile(lockPath, []byte(fmt.Sprint(os.Getpid())), os.ModePerm)
+	// Export metrics for Prometheus.
+	if cfg.Metrics.Enable {
+		logger.Infow("serving metrics", "address", cfg.Metrics.Address)
+		err = metrics.RegisterPeers(host, peerTable)
+		checkErr(err)
+		err = metrics.Serve(cfg.Metrics.Address)
+		checkErr(err)
+	}
+
+	// Register the application to reload its config on SIGHUP
+	go signalReload(cfg)
+
+	// Start answering control requests such as status.
+	ctl, err := control.Serve(socketPath(cfg.Interface.Name), controlHandler(cfg, host))
 	checkErr(err)
+	onShutdown("close control socket", ctl.Close)
 
 	// Bring Up TUN Device
 	err = tunDev.Up()
@@ -170,113 +361,145 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 		checkErr(errors.New("unable to bring up tun device"))
 	}
 
-	fmt.Println("[+] Network Setup Complete...Waiting on Node Discovery")
+	// Route the subnets peers advertise within the accepted ranges
+	// through them once the interface is up, and advertise the
+	// node's own subnets.
+	if len(cfg.Subnets.Accept) > 0 {
+		accept, local, err := subnetRanges(cfg)
+		checkErr(err)
+		interval, err := time.ParseDuration(cfg.Subnets.ProbeInterval)
+		checkErr(err)
+		go expireSubnets(ctx, host)
+		go probeGateways(ctx, host, peerTable, interval)
+		host.SetStreamHandler(p2p.SubnetsProtocol, subnetsHandler(accept, local))
+	}
+	if len(cfg.Subnets.Advertise) > 0 {
+		logger.Infow("advertising subnets", "subnets", cfg.Subnets.Advertise, "priority", cfg.Subnets.Priority)
+		go advertiseSubnets(ctx, host, peerTable, cfg.Subnets.Advertise, cfg.Subnets.Priority)
+		onShutdown("withdraw subnets", func() error {
+			return withdrawSubnets(host, peerTable)
+		})
+	}
+
+	// Start Magic DNS responder on the interface address.
+	if cfg.DNS.Enable {
+		logger.Infow("starting magic dns", "domain", cfg.DNS.Domain)
+		err = startDNS(cfg)
+		checkErr(err)
+		onShutdown("stop magic dns", dnsServer.Close)
+	}
+
+	// Write peer names into the hosts file.
+	if cfg.Hosts.Enable {
+		logger.Infow("writing peer names to hosts file", "path", hostsPath(cfg))
+		err = hosts.Write(hostsPath(cfg), cfg.Interface.Name, peerNames(cfg))
+		checkErr(err)
+		onShutdown("remove peer names from hosts file", func() error {
+			return hosts.Remove(hostsPath(cfg), cfg.Interface.Name)
+		})
+	}
+
+	err = runHooks(cfg, "post_up", cfg.Interface.PostUp)
+	checkErr(err)
+
+	logger.Info("network setup complete, waiting on node discovery")
 
 	// + ----------------------------------------+
 	// | Listen For New Packets on TUN Interface |
 	// + ----------------------------------------+
 
-	// Initialize active streams map and packet byte array.
-	activeStreams = make(map[string]network.Stream)
-	var packet = make([]byte, 1420)
-	for {
-		// Read in a packet from the tun device.
-		plen, err := tunDev.Iface.Read(packet)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
+	// Forward packets from each queue of the TUN device, sharded
+	// between senders for each peer by flow.
+	fwd := newForwarder(ctx, host, peerTable, len(queues), offloads, cfg.Mesh.MaxHops)
 
-		// Decode the packet's destination address
-		dst := net.IPv4(packet[16], packet[17], packet[18], packet[19]).String()
+	// Reach peers without a direct connection through other peers,
+	// and relay packets for them if the node is a relay.
+	if cfg.Mesh.Enable {
+		routes = mesh.NewTable(cfg.Mesh.MaxHops, routeTTL)
+		host.SetStreamHandler(p2p.RoutesProtocol, routesHandler)
+		forgetRoutes(host)
+		rx.fwd, rx.relay = fwd, cfg.Mesh.Relay
+		host.SetStreamHandler(p2p.RelayProtocol, rx.handleRelay)
+		if cfg.Mesh.Relay {
+			go announceRoutes(ctx, host, peerTable)
+		}
+	}
 
-		// Check if we already have an open connection to the destination peer.
-		stream, ok := activeStreams[dst]
-		if ok {
-			// Write out the packet's length to the libp2p stream to ensure
-			// we know the full size of the packet at the other end.
-			err = binary.Write(stream, binary.LittleEndian, uint16(plen))
-			if err == nil {
-				// Write the packet out to the libp2p stream.
-				// If everyting succeeds continue on to the next packet.
-				_, err = stream.Write(packet[:plen])
-				if err == nil {
-					continue
-				}
-			}
-			// If we encounter an error when writing to a stream we should
-			// close that stream and delete it from the active stream map.
-			stream.Close()
-			delete(activeStreams, dst)
+	// Stop reading from the TUN device before anything else is torn
+	// down and give the packets queued for each peer a chance to be
+	// sent before their streams are closed.
+	onShutdown("stop forwarding", func() error {
+		err := tunDev.Down()
+		cancel()
+		if !waitTimeout(drainTimeout, fwd.wait) {
+			return errors.New("timed out flushing packets to peers")
 		}
+		return err
+	})
 
-		// Check if the destination of the packet is a known peer to
-		// the interface.
-		if peer, ok := peerTable[dst]; ok {
-			stream, err = host.NewStream(ctx, peer, p2p.Protocol)
-			if err != nil {
-				continue
-			}
-			// Write packet length
-			err = binary.Write(stream, binary.LittleEndian, uint16(plen))
-			if err != nil {
-				stream.Close()
-				continue
-			}
-			// Write the packet
-			_, err = stream.Write(packet[:plen])
-			if err != nil {
-				stream.Close()
-				continue
-			}
+	// Run the pre down hooks while the interface is still up.
+	onShutdown("run pre down hooks", func() error {
+		return runHooks(cfg, "pre_down", cfg.Interface.PreDown)
+	})
 
-			// If all succeeds when writing the packet to the stream
-			// we should reuse this stream by adding it active streams map.
-			activeStreams[dst] = stream
-		}
-	}
-}
+	fwd.start(queues)
 
-// singalExit registers two syscall handlers on the system  so that if
-// an SIGINT or SIGTERM occur on the system hyprspace can gracefully
-// shutdown and remove the filesystem lock file.
-func signalExit(host host.Host, lockPath string) {
-	// Wait for a SIGINT or SIGTERM signal
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	<-ch
+	// Block while the daemon runs. It exits once it has shut down.
+	select {}
+}
 
-	// Shut the node down
-	err := host.Close()
-	checkErr(err)
+// signalReload re-reads the interface's config whenever a SIGHUP occurs
+// and publishes any changes to peer names.
+func signalReload(cfg *config.Config) {
+	defer recoverPanic()
 
-	// Remove daemon lock from file system.
-	err = os.Remove(lockPath)
-	checkErr(err)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		newCfg, err := config.Read(cfg.Path)
+		if err != nil {
+			logger.Errorw("unable to reload config", "path", cfg.Path, "error", err)
+			continue
+		}
 
-	fmt.Println("Received signal, shutting down...")
+		logger.Infow("reloading config", "path", cfg.Path)
 
-	// Exit the application.
-	os.Exit(0)
+		names := peerNames(newCfg)
+		if dnsServer != nil {
+			dnsServer.SetRecords(names)
+		}
+		if cfg.Hosts.Enable {
+			err = hosts.Write(hostsPath(cfg), cfg.Interface.Name, names)
+			if err != nil {
+				logger.Errorw("unable to update hosts file", "path", hostsPath(cfg), "error", err)
+			}
+		}
+	}
 }
 
 // createDaemon handles creating an independent background process for a
 // Hyprspace daemon from the original parent process.
-func createDaemon(cfg *config.Config) error {
+func createDaemon(cfg *config.Config, logPath string) error {
 	path, err := os.Executable()
 	checkErr(err)
 
-	// Generate log path
-	logPath := filepath.Join(filepath.Dir(cfg.Path), cfg.Interface.Name+".log")
+	err = os.MkdirAll(filepath.Dir(logPath), 0755)
+	checkErr(err)
+
+	// Open the log to catch anything the daemon writes before it opens
+	// the log itself. Previous logs are kept.
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	checkErr(err)
 
-	// Create Pipe to monitor for daemon output.
-	f, err := os.Create(logPath)
+	// Only watch log lines written by the new daemon.
+	info, err := f.Stat()
 	checkErr(err)
+	offset := info.Size()
 
 	// Create Sub Process
 	process, err := os.StartProcess(
 		path,
-		append(os.Args, "--foreground"),
+		append(os.Args, "--foreground", "--log-file", logPath),
 		&os.ProcAttr{
 			Dir:   ".",
 			Env:   os.Environ(),
@@ -285,78 +508,133 @@ func createDaemon(cfg *config.Config) error {
 	)
 	checkErr(err)
 
-	// Listen to the child process's log output to determine
-	// when the daemon is setup and connected to a set of peers.
-	count := 0
-	deadlineHit := false
-	countChan := make(chan int)
-	go func(out chan<- int) {
-		numConnected := 0
-		t, err := tail.TailFile(logPath, tail.Config{Follow: true})
-		if err != nil {
-			out <- numConnected
-			return
-		}
-		for line := range t.Lines {
-			fmt.Println(line.Text)
-			if strings.HasPrefix(line.Text, "[+] Connection to") {
-				numConnected++
-				if numConnected >= len(cfg.Peers) {
-					break
-				}
+	// Show the daemon's log output while it starts up.
+	t, err := tail.TailFile(logPath, tail.Config{
+		Follow:   true,
+		ReOpen:   true,
+		Location: &tail.SeekInfo{Offset: offset, Whence: io.SeekStart},
+		Logger:   tail.DiscardingLogger,
+	})
+	if err == nil {
+		defer t.Stop()
+		go func() {
+			for line := range t.Lines {
+				fmt.Println(line.Text)
 			}
+		}()
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		_, err := process.Wait()
+		exited <- err
+	}()
+
+	// Ask the daemon over its control socket until all peers are
+	// connected, or for a maximum of 30s.
+	deadline := time.After(readyTimeout)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return errors.New("failed to create daemon")
+		case <-deadline:
+			return nil
+		case <-ticker.C:
 		}
-		out <- numConnected
-	}(countChan)
 
-	// Block until all clients are connected or for a maximum of 30s.
-	select {
-	case _, deadlineHit = <-time.After(30 * time.Second):
-	case count = <-countChan:
+		var status control.Status
+		err := control.Get(socketPath(cfg.Interface.Name), "/status", &status)
+		if err == nil && connectedPeers(status) >= len(cfg.Peers) {
+			return nil
+		}
 	}
+}
 
-	// Release the created daemon
-	err = process.Release()
-	checkErr(err)
-
-	// Check if the daemon exited prematurely
-	if !deadlineHit && count < len(cfg.Peers) {
-		return errors.New("failed to create daemon")
+// connectedPeers returns the number of peers a daemon reports as
+// connected.
+func connectedPeers(status control.Status) int {
+	count := 0
+	for _, p := range status.Peers {
+		if p.Connected {
+			count++
+		}
 	}
-	return nil
+	return count
 }
 
-func streamHandler(stream network.Stream) {
-	// If the remote node ID isn't in the list of known nodes don't respond.
-	if _, ok := RevLookup[stream.Conn().RemotePeer().Pretty()]; !ok {
-		stream.Reset()
-		return
+// createTUN creates the TUN device of the interface with the options
+// of its config.
+func createTUN(cfg *config.Config) (*tun.TUN, error) {
+	opts := []tun.Option{
+		tun.MTU(1420),
 	}
-	var packet = make([]byte, 1420)
-	var packetSize = make([]byte, 2)
-	for {
-		// Read the incoming packet's size as a binary value.
-		_, err := stream.Read(packetSize)
-		if err != nil {
-			stream.Close()
-			return
+
+	// Bridged interfaces leave addresses to the bridge.
+	if cfg.Interface.Bridge == "" {
+		opts = append(opts, tun.Address(cfg.Interface.Address))
+	}
+
+	// Carry Ethernet frames instead of IP packets.
+	if cfg.Interface.TAP {
+		opts = append(opts, tun.TAP())
+	}
+	if cfg.Interface.Bridge != "" {
+		opts = append(opts, tun.Bridge(cfg.Interface.Bridge))
+	}
+
+	if runtime.GOOS == "darwin" {
+		if len(cfg.Peers) > 1 {
+			return nil, errors.New("cannot create interface macos does not support more than one peer")
 		}
 
-		// Decode the incoming packet's size from binary.
-		size := binary.LittleEndian.Uint16(packetSize)
+		// Grab ip address of only peer in config
+		var destPeer string
+		for ip := range cfg.Peers {
+			destPeer = ip
+		}
+		opts = append(opts, tun.DestAddress(destPeer))
+	}
 
-		// Read in the packet until completion.
-		var plen uint16 = 0
-		for plen < size {
-			tmp, err := stream.Read(packet[plen:size])
-			plen += uint16(tmp)
-			if err != nil {
-				stream.Close()
-				return
-			}
+	// Route queries for the network domain to the Magic DNS responder.
+	if cfg.DNS.Enable && runtime.GOOS == "linux" {
+		ip, _, err := net.ParseCIDR(cfg.Interface.Address)
+		if err != nil {
+			return nil, err
 		}
-		tunDev.Iface.Write(packet[:size])
+		opts = append(opts, tun.DNS(ip.String()), tun.Domains("~"+cfg.DNS.Domain))
+	}
+
+	// Read and write packets through several queues in parallel.
+	if cfg.Interface.Queues > 1 {
+		opts = append(opts, tun.Queues(cfg.Interface.Queues))
+	}
+
+	// Let the kernel hand over large TCP segments and leave checksums
+	// to be completed.
+	if cfg.Interface.Offload {
+		opts = append(opts, tun.Offload())
+	}
+
+	// Move the interface into its network namespace.
+	if cfg.Interface.Netns != "" {
+		opts = append(opts, tun.Namespace(cfg.Interface.Netns))
+	}
+
+	// Add the extra routes and nameservers of the interface.
+	for _, route := range cfg.Interface.Routes {
+		opts = append(opts, tun.Route(route))
+	}
+	if len(cfg.Interface.Nameservers) > 0 {
+		opts = append(opts, tun.DNS(cfg.Interface.Nameservers...))
+	}
+	if len(cfg.Interface.SearchDomains) > 0 {
+		opts = append(opts, tun.Domains(cfg.Interface.SearchDomains...))
 	}
+
+	// Create new TUN device
+	return tun.New(cfg.Interface.Name, opts...)
 }
 
 func prettyDiscovery(ctx context.Context, node host.Host, peerTable map[string]peer.ID) {
@@ -376,7 +654,7 @@ func prettyDiscovery(ctx context.Context, node host.Host, peerTable map[string]p
 				continue
 			}
 			if err == nil {
-				fmt.Printf("[+] Connection to %s Successful. Network Ready.\n", ip)
+				logger.Infow(msgPeerConnected, "peer", id.Pretty(), "ip", ip)
 				stream.Close()
 			}
 			delete(tempTable, ip)
@@ -384,6 +662,364 @@ func prettyDiscovery(ctx context.Context, node host.Host, peerTable map[string]p
 	}
 }
 
+// daemonLogPath returns the file a background daemon logs to. It's
+// the path given on the command line or in the config, falling back to
+// a file named after the interface in /var/log/hyprspace, or in the
+// user's state directory for daemons not run by root.
+func daemonLogPath(cfg *config.Config, flag string) string {
+	if path := foregroundLogPath(cfg, flag); path != "" {
+		return path
+	}
+	switch {
+	case runtime.GOOS == "windows":
+		return filepath.Join(filepath.Dir(cfg.Path), cfg.Interface.Name+".log")
+	case !isRoot():
+		return filepath.Join(userStateDir(), cfg.Interface.Name+".log")
+	default:
+		return filepath.Join("/var/log/hyprspace", cfg.Interface.Name+".log")
+	}
+}
+
+// runtimeDir returns the directory holding the pidfiles and control
+// sockets of running daemons. Daemons not run by root keep them in the
+// user's runtime directory, or their state directory without one.
+func runtimeDir() string {
+	switch {
+	case runtime.GOOS == "windows":
+		return filepath.Join(os.TempDir(), "hyprspace")
+	case !isRoot():
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+			return filepath.Join(dir, "hyprspace")
+		}
+		return filepath.Join(userStateDir(), "run")
+	case runtime.GOOS == "linux":
+		return "/run/hyprspace"
+	default:
+		return "/var/run/hyprspace"
+	}
+}
+
+// userStateDir returns the directory daemons not run by root keep their
+// logs and state in.
+func userStateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "hyprspace")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "hyprspace-"+strconv.Itoa(os.Getuid()))
+	}
+	return filepath.Join(home, ".local", "state", "hyprspace")
+}
+
+// stateDir returns the directory the daemon keeps state such as quota
+// usage in.
+func stateDir(cfg *config.Config) string {
+	switch {
+	case runtime.GOOS == "windows":
+		return filepath.Dir(cfg.Path)
+	case !isRoot():
+		return userStateDir()
+	default:
+		return "/var/lib/hyprspace"
+	}
+}
+
+// geteuid returns the user the daemon runs as. Tests replace it to run
+// as another user.
+var geteuid = os.Geteuid
+
+// isRoot reports whether the daemon runs as root.
+func isRoot() bool {
+	return geteuid() == 0
+}
+
+// pidPath returns the path of the pidfile for an interface.
+func pidPath(name string) string {
+	return filepath.Join(runtimeDir(), name+".pid")
+}
+
+// foregroundLogPath returns the file a foreground daemon logs to or an
+// empty string when it should log to stderr.
+func foregroundLogPath(cfg *config.Config, flag string) string {
+	if flag != "" {
+		return flag
+	}
+	return cfg.Log.Path
+}
+
+// openLog opens a log file rotated according to the config.
+func openLog(cfg *config.Config, path string) (*logging.RotatingFile, error) {
+	maxSize, err := limit.ParseSize(cfg.Log.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	return logging.OpenRotating(path, int64(maxSize), cfg.Log.MaxFiles)
+}
+
+// startDNS starts a DNS responder listening on the interface address
+// which resolves the names of peers to their addresses.
+func startDNS(cfg *config.Config) error {
+	ip, _, err := net.ParseCIDR(cfg.Interface.Address)
+	if err != nil {
+		return err
+	}
+	dnsServer = dns.NewServer(cfg.DNS.Domain, cfg.DNS.Upstream)
+	dnsServer.SetRecords(peerNames(cfg))
+	return dnsServer.Start(net.JoinHostPort(ip.String(), "53"))
+}
+
+// peerNames returns a map of peer addresses to peer names for all
+// named peers in the config.
+func peerNames(cfg *config.Config) map[string]string {
+	result := make(map[string]string, len(cfg.Peers))
+	for ip, p := range cfg.Peers {
+		if p.Name != "" {
+			result[ip] = p.Name
+		}
+	}
+	return result
+}
+
+// newFirewall creates the interface's firewall from its config
+// resolving any peer names in rules to addresses. Connections allowed
+// by the group policy are added after the firewall's own rules.
+func newFirewall(cfg *config.Config) (*firewall.Firewall, error) {
+	// Without the firewall only connections the policy allows pass.
+	var allowIn, allowOut bool
+	var rules []*firewall.Rule
+	if cfg.Firewall.Enable {
+		allowIn = cfg.Firewall.Inbound == "allow"
+		allowOut = cfg.Firewall.Outbound == "allow"
+		for _, r := range cfg.Firewall.Rules {
+			var peers []string
+			if r.Peer != "" && r.Peer != "*" {
+				peer, err := peerAddress(cfg, r.Peer)
+				if err != nil {
+					return nil, err
+				}
+				peers = []string{peer}
+			}
+			rule, err := firewall.NewRule(peers, r.Direction, r.Proto, r.Ports)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	if pol != nil {
+		polRules, err := pol.FirewallRules()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, polRules...)
+	}
+	return firewall.New(rules, allowIn, allowOut), nil
+}
+
+// newGroups creates the table deciding which peers broadcast and
+// multicast packets are forwarded to from the config, resolving any
+// peer names in groups to addresses. It returns nil when none are.
+func newGroups(cfg *config.Config) (*mcast.Table, error) {
+	if !cfg.Multicast.Broadcast && len(cfg.Multicast.Groups) == 0 {
+		return nil, nil
+	}
+
+	var broadcast []net.IP
+	if cfg.Multicast.Broadcast {
+		var err error
+		broadcast, err = mcast.Broadcast(cfg.Interface.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var result []mcast.Group
+	for _, g := range cfg.Multicast.Groups {
+		var peers []string
+		for _, ref := range g.Peers {
+			peer, err := peerAddress(cfg, ref)
+			if err != nil {
+				return nil, err
+			}
+			peers = append(peers, peer)
+		}
+		group, err := mcast.ParseGroup(g.Address, peers)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, group)
+	}
+	return mcast.NewTable(broadcast, result, duplicateWindow), nil
+}
+
+// newLimits creates the rate limiters and monthly quota for all peers
+// with limits in the config.
+func newLimits(cfg *config.Config) (map[string]*limit.Limiter, *limit.Quota, error) {
+	limiters := make(map[string]*limit.Limiter)
+	quotas := make(map[string]uint64)
+	for ip, p := range cfg.Peers {
+		var l limit.Limiter
+		if p.Limits.Inbound != "" {
+			rate, err := limit.ParseRate(p.Limits.Inbound)
+			if err != nil {
+				return nil, nil, err
+			}
+			l.In = limit.NewBucket(rate)
+		}
+		if p.Limits.Outbound != "" {
+			rate, err := limit.ParseRate(p.Limits.Outbound)
+			if err != nil {
+				return nil, nil, err
+			}
+			l.Out = limit.NewBucket(rate)
+		}
+		if l.In != nil || l.Out != nil {
+			limiters[ip] = &l
+		}
+		if p.Limits.Quota != "" {
+			size, err := limit.ParseSize(p.Limits.Quota)
+			if err != nil {
+				return nil, nil, err
+			}
+			quotas[ip] = size
+		}
+	}
+	if len(quotas) == 0 {
+		return limiters, nil, nil
+	}
+
+	err := os.MkdirAll(stateDir(cfg), 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = moveQuota(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := limit.LoadQuota(quotaPath(cfg), quotas)
+	if err != nil {
+		return nil, nil, err
+	}
+	return limiters, q, nil
+}
+
+// quotaSaveInterval is how often quota usage is persisted.
+const quotaSaveInterval = time.Minute
+
+// saveQuotas periodically persists quota usage so a crash loses at most
+// a minute of it, until ctx is done.
+func saveQuotas(ctx context.Context, q *limit.Quota) {
+	defer recoverPanic()
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Leave the final save to shutdown if both are ready.
+			if ctx.Err() != nil {
+				return
+			}
+			if err := q.Save(); err != nil {
+				logger.Errorw("unable to save quotas", "error", err)
+			}
+		}
+	}
+}
+
+// withinLimits reports whether a packet of size bytes exchanged with
+// the peer at the given address is within the peer's rate limit and
+// monthly quota.
+func withinLimits(peer string, size int, outbound bool) bool {
+	if l, ok := limiters[peer]; ok && !l.Allow(size, outbound) {
+		metrics.Drops.WithLabelValues(metrics.DropRateLimit).Inc()
+		return false
+	}
+	if quota != nil && !quota.Add(peer, size) {
+		metrics.Drops.WithLabelValues(metrics.DropQuota).Inc()
+		return false
+	}
+	return true
+}
+
+// countTx counts a packet of size bytes sent to a peer.
+func countTx(peer string, size int) {
+	metrics.TxBytes.WithLabelValues(peer).Add(float64(size))
+	metrics.TxPackets.WithLabelValues(peer).Inc()
+}
+
+// quotaPath returns the file the interface's quota usage is kept in.
+func quotaPath(cfg *config.Config) string {
+	return filepath.Join(stateDir(cfg), cfg.Interface.Name+".quota.json")
+}
+
+// moveQuota moves quota usage saved next to the config by earlier
+// versions to the state directory.
+func moveQuota(cfg *config.Config) error {
+	old := filepath.Join(filepath.Dir(cfg.Path), cfg.Interface.Name+".quota.json")
+	if old == quotaPath(cfg) {
+		return nil
+	}
+	if _, err := os.Stat(quotaPath(cfg)); !os.IsNotExist(err) {
+		return nil
+	}
+	data, err := os.ReadFile(old)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(quotaPath(cfg), data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Remove(old)
+}
+
+// newPolicy creates the interface's group policy from its config.
+func newPolicy(cfg *config.Config) (*policy.Policy, error) {
+	tags := make(map[string][]string, len(cfg.Peers))
+	for ip, p := range cfg.Peers {
+		tags[ip] = p.Tags
+	}
+	rules := make([]policy.Rule, 0, len(cfg.Policy.Rules))
+	for _, r := range cfg.Policy.Rules {
+		rules = append(rules, policy.Rule{
+			From:     r.From,
+			To:       r.To,
+			Proto:    r.Proto,
+			Ports:    r.Ports,
+			Services: r.Services,
+		})
+	}
+	return policy.New(cfg.Interface.Tags, tags, rules)
+}
+
+// peerAddress resolves a peer name or address to the peer's address.
+func peerAddress(cfg *config.Config, ref string) (string, error) {
+	if _, ok := cfg.Peers[ref]; ok {
+		return ref, nil
+	}
+	for ip, p := range cfg.Peers {
+		if p.Name == ref {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("unknown peer %s", ref)
+}
+
+// hostsPath returns the hosts file the interface's peer names are
+// written to.
+func hostsPath(cfg *config.Config) string {
+	if cfg.Hosts.Path != "" {
+		return cfg.Hosts.Path
+	}
+	return hosts.DefaultPath()
+}
+
 func verifyPort(port int) (int, error) {
 	var ln net.Listener
 	var err error
@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package cli
+
+import (
+	"github.com/hyprspace/hyprspace/config"
+	"github.com/hyprspace/hyprspace/netstack"
+)
+
+// newUserspaceStack creates the TCP/IP stack an interface runs on in
+// userspace mode.
+func newUserspaceStack(cfg *config.Config) (userspaceStack, error) {
+	s, err := netstack.New(cfg.Interface.Name, 1420, cfg.Interface.Address)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,152 @@
+//go:build linux
+// +build linux
+
+package cli
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyprspace/hyprspace/config"
+	"github.com/hyprspace/hyprspace/control"
+	"github.com/hyprspace/hyprspace/logging"
+	"github.com/hyprspace/hyprspace/netstack"
+	"github.com/hyprspace/hyprspace/pidfile"
+	"github.com/hyprspace/hyprspace/tun"
+)
+
+func TestForwardUserspace(t *testing.T) {
+	stack, err := netstack.New("hs0", 1420, "10.1.1.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, app := tun.NewPipe("hs0", 0)
+	linkPeers(t, [2]tun.Device{stack, dev}, [2]bool{false, false})
+	received := receive(app)
+
+	// Connections opened through the stack reach the peer's device.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go stack.Dial(ctx, "tcp", "10.1.1.2:22")
+
+	p := next(t, received)
+	if len(p) < 40 || p[9] != 6 {
+		t.Fatalf("got packet %x, want a tcp segment", p)
+	}
+	if src, dst := net.IP(p[12:16]).String(), net.IP(p[16:20]).String(); src != "10.1.1.1" || dst != "10.1.1.2" {
+		t.Errorf("got segment from %s to %s, want 10.1.1.1 to 10.1.1.2", src, dst)
+	}
+	if port := binary.BigEndian.Uint16(p[22:24]); port != 22 {
+		t.Errorf("got segment to port %d, want 22", port)
+	}
+	if flags := p[33]; flags&0x02 == 0 {
+		t.Errorf("got segment with flags %#x, want a syn", flags)
+	}
+}
+
+func TestUserspaceWithoutRoot(t *testing.T) {
+	geteuid = func() int { return 1000 }
+	defer func() { geteuid = os.Geteuid }()
+
+	tests := []struct {
+		name    string
+		runtime bool
+	}{
+		{"runtime dir", true},
+		{"no runtime dir", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// None of the user's directories exist yet.
+			dir := t.TempDir()
+			setenv(t, "XDG_STATE_HOME", filepath.Join(dir, "state"))
+			setenv(t, "XDG_RUNTIME_DIR", "")
+			if tt.runtime {
+				setenv(t, "XDG_RUNTIME_DIR", filepath.Join(dir, "run"))
+			}
+			cfg := &config.Config{Path: "/etc/hyprspace/hs0.yaml"}
+			cfg.Interface.Name = "hs0"
+			cfg.Interface.Address = "10.1.1.1/24"
+			cfg.Interface.Userspace = true
+
+			// Everything the daemon writes stays in the user's
+			// directories.
+			for _, path := range []string{pidPath("hs0"), socketPath("hs0"), daemonLogPath(cfg, "")} {
+				if !strings.HasPrefix(path, dir) {
+					t.Errorf("daemon writes %s outside of %s", path, dir)
+				}
+			}
+
+			log, err := logging.OpenRotating(daemonLogPath(cfg, ""), 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer log.Close()
+			pid, err := pidfile.Acquire(pidPath("hs0"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pid.Release()
+			ctl, err := control.Serve(socketPath("hs0"), http.NotFoundHandler())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ctl.Close()
+			stack, err := newUserspaceStack(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stack.Close()
+		})
+	}
+}
+
+func TestForwardWithoutRoot(t *testing.T) {
+	geteuid = func() int { return 1000 }
+	defer func() { geteuid = os.Geteuid }()
+	dir := t.TempDir()
+	setenv(t, "XDG_RUNTIME_DIR", filepath.Join(dir, "run"))
+
+	cfg := &config.Config{}
+	cfg.Interface.Name = "hs0"
+	cfg.Interface.Address = "10.1.1.1/24"
+	stack, err := newUserspaceStack(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStack = stack
+	ctx, cancel := context.WithCancel(context.Background())
+	ports = newPortForwards(ctx, cfg, nil)
+	defer func() {
+		ports.Close()
+		cancel()
+		stack.Close()
+		userStack, ports = nil, nil
+	}()
+
+	// The daemon's control socket is in the user's runtime directory,
+	// where hyprspace forward reaches it.
+	if err := os.MkdirAll(runtimeDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctl, err := control.Serve(socketPath("hs0"), controlHandler(cfg, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.Close()
+
+	fwd := control.Forward{Proto: "tcp", Listen: "127.0.0.1:0", Address: "10.1.1.2:80"}
+	if err := control.Post(socketPath("hs0"), "/forward", fwd, &fwd); err != nil {
+		t.Fatal(err)
+	}
+	if got := ports.list(); len(got) != 1 || got[0].Address != "10.1.1.2:80" {
+		t.Errorf("got forwarded ports %v, want one to 10.1.1.2:80", got)
+	}
+}
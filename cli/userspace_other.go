@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package cli
+
+import (
+	"errors"
+
+	"github.com/hyprspace/hyprspace/config"
+)
+
+// newUserspaceStack creates the TCP/IP stack an interface runs on in
+// userspace mode, which is only available on Linux.
+func newUserspaceStack(cfg *config.Config) (userspaceStack, error) {
+	return nil, errors.New("userspace mode is only supported on linux")
+}
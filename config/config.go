@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"regexp"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -13,22 +15,252 @@ type Config struct {
 	Path      string          `yaml:"path,omitempty"`
 	Interface Interface       `yaml:"interface"`
 	Peers     map[string]Peer `yaml:"peers"`
+	DNS       DNS             `yaml:"dns,omitempty"`
+	Hosts     Hosts           `yaml:"hosts,omitempty"`
+	Firewall  Firewall        `yaml:"firewall,omitempty"`
+	Policy    Policy          `yaml:"policy,omitempty"`
+	Metrics   Metrics         `yaml:"metrics,omitempty"`
+	Forward   Forward         `yaml:"forward,omitempty"`
+	Proxy     Proxy           `yaml:"proxy,omitempty"`
+	Multicast Multicast       `yaml:"multicast,omitempty"`
+	Mesh      Mesh            `yaml:"mesh,omitempty"`
+	Subnets   Subnets         `yaml:"subnets,omitempty"`
+	Log       Log             `yaml:"log,omitempty"`
 }
 
 // Interface defines all of the fields that a local node needs to know about itself!
 type Interface struct {
-	Name       string `yaml:"name"`
-	ID         string `yaml:"id"`
-	ListenPort int    `yaml:"listen_port"`
-	Address    string `yaml:"address"`
-	PrivateKey string `yaml:"private_key"`
+	Name       string   `yaml:"name"`
+	ID         string   `yaml:"id"`
+	ListenPort int      `yaml:"listen_port"`
+	Address    string   `yaml:"address"`
+	PrivateKey string   `yaml:"private_key"`
+	Tags       []string `yaml:"tags,omitempty"`
+
+	// Routes are extra networks reached through the interface.
+	// Nameservers and SearchDomains configure the system resolver
+	// for the interface.
+	Routes        []string `yaml:"routes,omitempty"`
+	Nameservers   []string `yaml:"nameservers,omitempty"`
+	SearchDomains []string `yaml:"search_domains,omitempty"`
+
+	// Queues is the number of queues to read packets from the
+	// interface with in parallel on Linux.
+	Queues int `yaml:"queues,omitempty"`
+
+	// Offload lets the interface pass large TCP segments and
+	// partial checksums on Linux.
+	Offload bool `yaml:"offload,omitempty"`
+
+	// TAP makes the interface an Ethernet TAP device on Linux which
+	// bridges frames between peers, optionally attached to an existing
+	// Bridge.
+	TAP    bool   `yaml:"tap,omitempty"`
+	Bridge string `yaml:"bridge,omitempty"`
+
+	// Userspace runs the interface on a TCP/IP stack inside the
+	// daemon instead of a TUN device, so it needs no special
+	// privileges. Applications reach the overlay through forwarded
+	// ports and the proxies in this mode.
+	Userspace bool `yaml:"userspace,omitempty"`
+
+	// Netns is the name of a Linux network namespace to move the
+	// interface into.
+	Netns string `yaml:"netns,omitempty"`
+
+	// Hooks are shell commands run as the interface is brought up
+	// and down. Each is killed after HookTimeout.
+	PreUp       []string `yaml:"pre_up,omitempty"`
+	PostUp      []string `yaml:"post_up,omitempty"`
+	PreDown     []string `yaml:"pre_down,omitempty"`
+	PostDown    []string `yaml:"post_down,omitempty"`
+	HookTimeout string   `yaml:"hook_timeout,omitempty"`
 }
 
 // Peer defines a peer in the configuration. We might add more to this later.
 type Peer struct {
-	ID string `yaml:"id"`
+	ID     string   `yaml:"id"`
+	Name   string   `yaml:"name,omitempty"`
+	Tags   []string `yaml:"tags,omitempty"`
+	Limits Limits   `yaml:"limits,omitempty"`
+
+	// OnConnect and OnDisconnect are shell commands run when the
+	// peer connects and disconnects.
+	OnConnect    []string `yaml:"on_connect,omitempty"`
+	OnDisconnect []string `yaml:"on_disconnect,omitempty"`
+}
+
+// Limits restricts the traffic exchanged with a peer. Inbound and
+// Outbound are rates per second such as "10mbit" or "2MB" and Quota
+// caps the traffic in both directions per calendar month such as
+// "100GB".
+type Limits struct {
+	Inbound  string `yaml:"inbound,omitempty"`
+	Outbound string `yaml:"outbound,omitempty"`
+	Quota    string `yaml:"quota,omitempty"`
+}
+
+// DNS configures the Magic DNS responder which resolves peer names
+// to their addresses within the network.
+type DNS struct {
+	Enable   bool     `yaml:"enable"`
+	Domain   string   `yaml:"domain"`
+	Upstream []string `yaml:"upstream,omitempty"`
+}
+
+// Hosts configures writing the names of peers into a hosts file as a
+// lighter alternative to Magic DNS. An empty path uses the system's
+// hosts file.
+type Hosts struct {
+	Enable bool   `yaml:"enable"`
+	Path   string `yaml:"path,omitempty"`
+}
+
+// Firewall configures which connections are allowed between the local
+// node and its peers. Inbound and Outbound set the policy ("allow" or
+// "deny") for connections which don't match any rule.
+type Firewall struct {
+	Enable   bool           `yaml:"enable"`
+	Inbound  string         `yaml:"inbound"`
+	Outbound string         `yaml:"outbound"`
+	Rules    []FirewallRule `yaml:"rules,omitempty"`
+}
+
+// FirewallRule allows connections with a peer (by name or address, or
+// all peers when empty) in a direction ("in" or "out") using a
+// protocol ("tcp", "udp", "icmp" or "any") to a set of ports or port
+// ranges such as "8000-8100".
+type FirewallRule struct {
+	Peer      string   `yaml:"peer,omitempty"`
+	Direction string   `yaml:"direction,omitempty"`
+	Proto     string   `yaml:"proto,omitempty"`
+	Ports     []string `yaml:"ports,omitempty"`
+}
+
+// Policy configures which groups of nodes, identified by their tags,
+// may talk to each other and use each other's services. Enabling the
+// policy denies all connections it doesn't allow.
+type Policy struct {
+	Enable bool         `yaml:"enable"`
+	Rules  []PolicyRule `yaml:"rules,omitempty"`
+}
+
+// PolicyRule allows nodes tagged with any of the From tags to open
+// connections to nodes tagged with any of the To tags, optionally
+// limited to a protocol and ports, and to use their services ("exit" or
+// "relay").
+// Rules listing only services don't allow connections. The tag "*"
+// matches every node.
+type PolicyRule struct {
+	From     []string `yaml:"from"`
+	To       []string `yaml:"to"`
+	Proto    string   `yaml:"proto,omitempty"`
+	Ports    []string `yaml:"ports,omitempty"`
+	Services []string `yaml:"services,omitempty"`
+}
+
+// Metrics configures the http listener exporting metrics for Prometheus.
+type Metrics struct {
+	Enable  bool   `yaml:"enable"`
+	Address string `yaml:"address"`
 }
 
+// Forward configures forwarding ports between the node and its peers,
+// which works without a TUN device. Ports are ports of peers made
+// available on local addresses, and Allow lists the addresses peers
+// may reach through the node.
+type Forward struct {
+	Ports []ForwardPort  `yaml:"ports,omitempty"`
+	Allow []ForwardAllow `yaml:"allow,omitempty"`
+}
+
+// ForwardPort forwards connections to the local Listen address to
+// Address on a peer (by name or address) using a protocol ("tcp" or
+// "udp"). Without a peer, Address is an overlay address connected to
+// through the userspace stack of a userspace interface.
+type ForwardPort struct {
+	Proto   string `yaml:"proto,omitempty"`
+	Listen  string `yaml:"listen"`
+	Peer    string `yaml:"peer"`
+	Address string `yaml:"address"`
+}
+
+// ForwardAllow lets a peer (by name or address, or all peers when
+// empty) reach Address using a protocol ("tcp", "udp" or "any").
+type ForwardAllow struct {
+	Peer    string `yaml:"peer,omitempty"`
+	Proto   string `yaml:"proto,omitempty"`
+	Address string `yaml:"address"`
+}
+
+// Proxy configures a local SOCKS5 proxy, and optionally an HTTP proxy
+// on HTTPAddress, which connect clients to the services of peers by
+// name or address. They go through port forwarding, or through the
+// userspace stack of a userspace interface.
+type Proxy struct {
+	Enable      bool   `yaml:"enable"`
+	Address     string `yaml:"address"`
+	HTTPAddress string `yaml:"http_address,omitempty"`
+}
+
+// Multicast configures forwarding broadcast and multicast packets to
+// peers, which are dropped otherwise. Broadcast forwards packets to the
+// interface's broadcast addresses to every connected peer.
+type Multicast struct {
+	Broadcast bool             `yaml:"broadcast"`
+	Groups    []MulticastGroup `yaml:"groups,omitempty"`
+}
+
+// MulticastGroup forwards packets to a multicast address, or range of
+// addresses in CIDR notation, to the peers subscribed to it by name or
+// address, or to every connected peer when there are none.
+type MulticastGroup struct {
+	Address string   `yaml:"address"`
+	Peers   []string `yaml:"peers,omitempty"`
+}
+
+// Mesh configures reaching peers through other peers when there's no
+// direct connection to them. Relay forwards packets between the node's
+// peers and announces which peers it reaches, and MaxHops bounds how
+// many peers a packet is relayed through.
+type Mesh struct {
+	Enable  bool `yaml:"enable"`
+	Relay   bool `yaml:"relay"`
+	MaxHops int  `yaml:"max_hops"`
+}
+
+// Subnets configures routing between sites. Advertise lists the
+// subnets the node is a gateway to, which it advertises to its peers
+// with a Priority; gateways with lower priorities are preferred for
+// the same subnet. Accept lists the ranges subnets advertised by peers
+// have to be within to be routed through them. Gateways are pinged
+// every ProbeInterval and subnets fail over to another gateway when
+// theirs stops answering, and back with Failback once it answers again.
+type Subnets struct {
+	Advertise     []string `yaml:"advertise,omitempty"`
+	Priority      int      `yaml:"priority,omitempty"`
+	Accept        []string `yaml:"accept,omitempty"`
+	Failback      bool     `yaml:"failback,omitempty"`
+	ProbeInterval string   `yaml:"probe_interval,omitempty"`
+}
+
+// Log configures the daemon's logs. Level and Libp2pLevel set the
+// minimum level ("debug", "info", "warn" or "error") of Hyprspace's and
+// libp2p's logs and Format is either "text" or "json". Logs written to
+// Path are rotated once they grow past MaxSize (such as "10MB")
+// keeping MaxFiles previous logs.
+type Log struct {
+	Level       string `yaml:"level"`
+	Libp2pLevel string `yaml:"libp2p_level"`
+	Format      string `yaml:"format"`
+	Path        string `yaml:"path,omitempty"`
+	MaxSize     string `yaml:"max_size"`
+	MaxFiles    int    `yaml:"max_files"`
+}
+
+// validName matches a single lowercase DNS label.
+var validName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
 // Read initializes a config from a file.
 func Read(path string) (*Config, error) {
 	in, err := os.ReadFile(path)
@@ -37,11 +269,38 @@ func Read(path string) (*Config, error) {
 	}
 	result := Config{
 		Interface: Interface{
-			Name:       "hs0",
-			ListenPort: 8001,
-			Address:    "10.1.1.1/24",
-			ID:         "",
-			PrivateKey: "",
+			Name:        "hs0",
+			ListenPort:  8001,
+			Address:     "10.1.1.1/24",
+			ID:          "",
+			PrivateKey:  "",
+			HookTimeout: "30s",
+		},
+		DNS: DNS{
+			Domain: "hyprspace",
+		},
+		Firewall: Firewall{
+			Inbound:  "deny",
+			Outbound: "allow",
+		},
+		Metrics: Metrics{
+			Address: "127.0.0.1:9191",
+		},
+		Proxy: Proxy{
+			Address: "127.0.0.1:1080",
+		},
+		Mesh: Mesh{
+			MaxHops: 3,
+		},
+		Subnets: Subnets{
+			ProbeInterval: "5s",
+		},
+		Log: Log{
+			Level:       "info",
+			Libp2pLevel: "error",
+			Format:      "text",
+			MaxSize:     "10MB",
+			MaxFiles:    5,
 		},
 	}
 
@@ -58,6 +317,132 @@ func Read(path string) (*Config, error) {
 		}
 	}
 
+	// Check peer names are valid and unique
+	names := make(map[string]string, len(result.Peers))
+	for ip, p := range result.Peers {
+		if p.Name == "" {
+			continue
+		}
+		if !validName.MatchString(p.Name) {
+			return nil, fmt.Errorf("%s is not a valid peer name", p.Name)
+		}
+		if other, ok := names[p.Name]; ok {
+			return nil, fmt.Errorf("peer name %s is used by both %s and %s", p.Name, other, ip)
+		}
+		names[p.Name] = ip
+	}
+
+	// Check firewall policies are valid
+	for _, policy := range []string{result.Firewall.Inbound, result.Firewall.Outbound} {
+		if policy != "allow" && policy != "deny" {
+			return nil, fmt.Errorf("%s is not a valid firewall policy", policy)
+		}
+	}
+
+	// Check routes and nameservers are valid
+	for _, route := range result.Interface.Routes {
+		if _, _, err := net.ParseCIDR(route); err != nil {
+			return nil, fmt.Errorf("%s is not a valid route", route)
+		}
+	}
+	for _, ns := range result.Interface.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return nil, fmt.Errorf("%s is not a valid nameserver", ns)
+		}
+	}
+
+	// The system resolver and Magic DNS only work in the daemon's
+	// own network namespace.
+	if result.Interface.Netns != "" && (result.DNS.Enable || len(result.Interface.Nameservers) > 0 || len(result.Interface.SearchDomains) > 0) {
+		return nil, fmt.Errorf("dns can't be used with network namespace %s", result.Interface.Netns)
+	}
+
+	if d, err := time.ParseDuration(result.Interface.HookTimeout); err != nil || d <= 0 {
+		return nil, fmt.Errorf("%s is not a valid hook timeout", result.Interface.HookTimeout)
+	}
+
+	// Without a TUN device there's no interface to configure.
+	if result.Interface.Userspace && (result.Interface.Queues > 1 || result.Interface.Offload || result.Interface.Netns != "" ||
+		len(result.Interface.Routes) > 0 || len(result.Interface.Nameservers) > 0 || len(result.Interface.SearchDomains) > 0 || result.DNS.Enable) {
+		return nil, fmt.Errorf("userspace interface %s can't use queues, offloads, network namespaces, routes or dns", result.Interface.Name)
+	}
+	if result.Interface.Userspace && len(result.Forward.Ports) == 0 && len(result.Forward.Allow) == 0 && !result.Proxy.Enable {
+		return nil, fmt.Errorf("userspace interface %s needs forwarded ports, forward rules or the proxy to be used", result.Interface.Name)
+	}
+
+	// Only TAP devices carry the frames bridges expect, and frames
+	// aren't IP packets the firewall and policy can filter.
+	if result.Interface.Bridge != "" && !result.Interface.TAP {
+		return nil, fmt.Errorf("interface %s has to be a tap device to join bridge %s", result.Interface.Name, result.Interface.Bridge)
+	}
+	if result.Interface.TAP && (result.Interface.Offload || result.Interface.Userspace || result.Firewall.Enable || result.Policy.Enable) {
+		return nil, fmt.Errorf("tap interface %s can't use offloads, userspace mode, the firewall or the policy", result.Interface.Name)
+	}
+	if result.Interface.TAP && (result.Multicast.Broadcast || len(result.Multicast.Groups) > 0) {
+		return nil, fmt.Errorf("tap interface %s already forwards broadcast and multicast frames", result.Interface.Name)
+	}
+	if result.Interface.Bridge != "" && result.DNS.Enable {
+		return nil, fmt.Errorf("magic dns can't be used with bridge %s", result.Interface.Bridge)
+	}
+
+	if result.Interface.Queues < 0 {
+		return nil, fmt.Errorf("%d is not a valid number of queues", result.Interface.Queues)
+	}
+
+	// Check forwarded ports have valid addresses.
+	for i, fp := range result.Forward.Ports {
+		if fp.Proto == "" {
+			result.Forward.Ports[i].Proto = "tcp"
+		} else if fp.Proto != "tcp" && fp.Proto != "udp" {
+			return nil, fmt.Errorf("%s is not a valid forwarding protocol", fp.Proto)
+		}
+		for _, addr := range []string{fp.Listen, fp.Address} {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("%s is not a valid forwarding address", addr)
+			}
+		}
+		if fp.Peer == "" && !result.Interface.Userspace {
+			return nil, fmt.Errorf("forwarding to %s needs a peer without a userspace interface", fp.Address)
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(result.Proxy.Address); result.Proxy.Enable && err != nil {
+		return nil, fmt.Errorf("%s is not a valid proxy address", result.Proxy.Address)
+	}
+	if _, _, err := net.SplitHostPort(result.Proxy.HTTPAddress); result.Proxy.Enable && result.Proxy.HTTPAddress != "" && err != nil {
+		return nil, fmt.Errorf("%s is not a valid proxy address", result.Proxy.HTTPAddress)
+	}
+
+	// Check mesh routing settings. Relayed packets are routed by their
+	// IP destination, which frames don't have.
+	if result.Mesh.MaxHops < 1 || result.Mesh.MaxHops > 16 {
+		return nil, fmt.Errorf("%d is not a valid number of mesh hops", result.Mesh.MaxHops)
+	}
+	if result.Mesh.Relay && !result.Mesh.Enable {
+		return nil, fmt.Errorf("interface %s has to enable mesh routing to relay", result.Interface.Name)
+	}
+	if result.Interface.TAP && result.Mesh.Enable {
+		return nil, fmt.Errorf("tap interface %s can't use mesh routing", result.Interface.Name)
+	}
+
+	// Check advertised and accepted subnets are valid. Routing them
+	// needs a system interface carrying IP packets.
+	for _, cidr := range append(result.Subnets.Advertise, result.Subnets.Accept...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("%s is not a valid subnet", cidr)
+		}
+	}
+	if (result.Interface.Userspace || result.Interface.TAP) && (len(result.Subnets.Advertise) > 0 || len(result.Subnets.Accept) > 0) {
+		return nil, fmt.Errorf("interface %s can't route subnets in userspace or tap mode", result.Interface.Name)
+	}
+	if d, err := time.ParseDuration(result.Subnets.ProbeInterval); err != nil || d <= 0 {
+		return nil, fmt.Errorf("%s is not a valid probe interval", result.Subnets.ProbeInterval)
+	}
+
+	if result.Log.MaxFiles < 0 {
+		return nil, fmt.Errorf("%d is not a valid number of log files", result.Log.MaxFiles)
+	}
+
 	// Overwrite path of config to input.
 	result.Path = path
 	return &result, nil
@@ -0,0 +1,154 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Status describes a running Hyprspace interface.
+type Status struct {
+	Interface string        `json:"interface"`
+	Address   string        `json:"address"`
+	ID        string        `json:"id"`
+	Tags      []string      `json:"tags,omitempty"`
+	Peers     []PeerStatus  `json:"peers"`
+	Policy    []string      `json:"policy,omitempty"`
+	Rules     []RuleStatus  `json:"rules,omitempty"`
+	Dropped   uint64        `json:"dropped"`
+	Quotas    []QuotaStatus `json:"quotas,omitempty"`
+	Forwards  []Forward     `json:"forwards,omitempty"`
+	Subnets   []Subnet      `json:"subnets,omitempty"`
+}
+
+// PeerStatus describes a peer of a running interface.
+type PeerStatus struct {
+	Address   string   `json:"address"`
+	Name      string   `json:"name,omitempty"`
+	ID        string   `json:"id"`
+	Tags      []string `json:"tags,omitempty"`
+	Connected bool     `json:"connected"`
+}
+
+// RuleStatus describes a firewall rule and the traffic it has allowed.
+type RuleStatus struct {
+	Rule    string `json:"rule"`
+	Comment string `json:"comment,omitempty"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// QuotaStatus describes a peer's traffic against its monthly quota.
+type QuotaStatus struct {
+	Address string `json:"address"`
+	Month   string `json:"month"`
+	Used    uint64 `json:"used"`
+	Limit   uint64 `json:"limit"`
+}
+
+// Forward describes a port forwarded from a local address to an
+// address on a peer.
+type Forward struct {
+	Proto   string `json:"proto"`
+	Listen  string `json:"listen"`
+	Peer    string `json:"peer"`
+	Address string `json:"address"`
+}
+
+// Subnet describes a subnet routed through the gateways advertising
+// it in order of preference, and the active one packets are sent to.
+type Subnet struct {
+	Subnet   string   `json:"subnet"`
+	Gateways []string `json:"gateways"`
+	Active   string   `json:"active"`
+}
+
+// Serve answers control requests on a unix socket at path until the
+// returned listener is closed.
+func Serve(path string, handler http.Handler) (io.Closer, error) {
+	// Remove a socket left behind by a previous daemon.
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only allow the owner of the daemon to control it.
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	go http.Serve(ln, handler)
+	return ln, nil
+}
+
+// Get requests an endpoint from the daemon listening on the unix socket
+// at path and decodes the JSON response into out.
+func Get(path string, endpoint string, out interface{}) error {
+	return do(path, http.MethodGet, endpoint, nil, out)
+}
+
+// Post sends in as JSON to an endpoint of the daemon listening on the
+// unix socket at path and decodes the JSON response into out.
+func Post(path string, endpoint string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return do(path, http.MethodPost, endpoint, bytes.NewReader(body), out)
+}
+
+// do makes a request to the daemon listening on the unix socket at path
+// and decodes the JSON response into out.
+func do(path string, method string, endpoint string, body io.Reader, out interface{}) error {
+	client := http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	req, err := http.NewRequest(method, "http://hyprspace"+endpoint, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.New("interface is not running")
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Reply writes v to w as JSON.
+func Reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,199 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TTL is the time to live in seconds of answers for peer names.
+const TTL = 60
+
+// Server is a small DNS responder that answers queries for peer names
+// within the network domain and forwards all other queries upstream.
+type Server struct {
+	domain   string
+	upstream []string
+
+	lock    sync.RWMutex
+	names   map[string]net.IP
+	reverse map[string]string
+
+	servers []*dns.Server
+}
+
+// NewServer creates a DNS responder for the given network domain. If
+// no upstream resolvers are given the system resolvers are used.
+func NewServer(domain string, upstream []string) *Server {
+	if len(upstream) == 0 {
+		upstream = systemResolvers()
+	}
+
+	// Add the default port to a copy so the caller's config keeps the
+	// addresses as written.
+	servers := make([]string, len(upstream))
+	for i, addr := range upstream {
+		servers[i] = addr
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			servers[i] = net.JoinHostPort(addr, "53")
+		}
+	}
+	return &Server{
+		domain:   dns.Fqdn(strings.ToLower(domain)),
+		upstream: servers,
+		names:    make(map[string]net.IP),
+		reverse:  make(map[string]string),
+	}
+}
+
+// SetRecords replaces the names served by the responder. Records maps
+// the address of a peer to its name.
+func (s *Server) SetRecords(records map[string]string) {
+	names := make(map[string]net.IP, len(records))
+	reverse := make(map[string]string, len(records))
+	for ip, name := range records {
+		fqdn := dns.Fqdn(strings.ToLower(name) + "." + s.domain)
+		names[fqdn] = net.ParseIP(ip)
+		if arpa, err := dns.ReverseAddr(ip); err == nil {
+			reverse[arpa] = fqdn
+		}
+	}
+
+	s.lock.Lock()
+	s.names = names
+	s.reverse = reverse
+	s.lock.Unlock()
+}
+
+// Start begins answering queries on the given address over both udp and
+// tcp. Listening errors are returned before any query is served.
+func (s *Server) Start(address string) error {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	s.servers = []*dns.Server{
+		{PacketConn: pc, Handler: s},
+		{Listener: ln, Handler: s},
+	}
+	for _, srv := range s.servers {
+		go srv.ActivateAndServe()
+	}
+	return nil
+}
+
+// Close stops the responder.
+func (s *Server) Close() error {
+	var err error
+	for _, srv := range s.servers {
+		if e := srv.Shutdown(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ServeDNS answers a single query.
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	resp, ok := s.answer(r)
+	if !ok {
+		resp = s.forward(r, w.RemoteAddr().Network())
+	}
+	w.WriteMsg(resp)
+}
+
+// answer builds a response to queries the server is authoritative for.
+// It reports false if the query should instead be forwarded upstream.
+func (s *Server) answer(r *dns.Msg) (*dns.Msg, bool) {
+	if len(r.Question) != 1 {
+		return nil, false
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Authoritative = true
+
+	// Answer reverse lookups only for known peers.
+	if target, ok := s.reverse[name]; ok {
+		if q.Qtype == dns.TypePTR {
+			resp.Answer = append(resp.Answer, &dns.PTR{
+				Hdr: header(q.Name, dns.TypePTR),
+				Ptr: target,
+			})
+		}
+		return resp, true
+	}
+
+	if !dns.IsSubDomain(s.domain, name) {
+		return nil, false
+	}
+
+	ip, ok := s.names[name]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+		return resp, true
+	}
+	switch {
+	case q.Qtype == dns.TypeA && ip.To4() != nil:
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: header(q.Name, dns.TypeA),
+			A:   ip.To4(),
+		})
+	case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+		resp.Answer = append(resp.Answer, &dns.AAAA{
+			Hdr:  header(q.Name, dns.TypeAAAA),
+			AAAA: ip,
+		})
+	}
+	return resp, true
+}
+
+// forward relays a query to the first upstream resolver that responds.
+func (s *Server) forward(r *dns.Msg, network string) *dns.Msg {
+	c := dns.Client{Net: network, Timeout: 2 * time.Second}
+	for _, addr := range s.upstream {
+		resp, _, err := c.Exchange(r, addr)
+		if err == nil {
+			return resp
+		}
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(r, dns.RcodeServerFailure)
+	return resp
+}
+
+func header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    TTL,
+	}
+}
+
+// systemResolvers returns the nameservers configured for the host.
+func systemResolvers() []string {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	result := make([]string, 0, len(conf.Servers))
+	for _, server := range conf.Servers {
+		result = append(result, net.JoinHostPort(server, conf.Port))
+	}
+	return result
+}
@@ -0,0 +1,165 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// query builds a query for a name and type.
+func query(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return m
+}
+
+func TestAnswer(t *testing.T) {
+	s := NewServer("hyprspace", []string{"127.0.0.1:53"})
+	s.SetRecords(map[string]string{
+		"10.1.1.2":  "Laptop",
+		"fd00::1:2": "nas",
+	})
+
+	tests := []struct {
+		name    string
+		query   *dns.Msg
+		forward bool
+		rcode   int
+		answer  string
+	}{
+		{"a", query("laptop.hyprspace.", dns.TypeA), false, dns.RcodeSuccess, "10.1.1.2"},
+		{"a in other case", query("LAPTOP.Hyprspace.", dns.TypeA), false, dns.RcodeSuccess, "10.1.1.2"},
+		{"aaaa", query("nas.hyprspace.", dns.TypeAAAA), false, dns.RcodeSuccess, "fd00::1:2"},
+		{"aaaa for ipv4 peer", query("laptop.hyprspace.", dns.TypeAAAA), false, dns.RcodeSuccess, ""},
+		{"a for ipv6 peer", query("nas.hyprspace.", dns.TypeA), false, dns.RcodeSuccess, ""},
+		{"ptr", query("2.1.1.10.in-addr.arpa.", dns.TypePTR), false, dns.RcodeSuccess, "laptop.hyprspace."},
+		{"ipv6 ptr", query("2.0.0.0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR), false, dns.RcodeSuccess, "nas.hyprspace."},
+		{"unknown name", query("phone.hyprspace.", dns.TypeA), false, dns.RcodeNameError, ""},
+		{"domain itself", query("hyprspace.", dns.TypeA), false, dns.RcodeNameError, ""},
+		{"outside domain", query("example.com.", dns.TypeA), true, 0, ""},
+		{"unknown ptr", query("3.1.1.10.in-addr.arpa.", dns.TypePTR), true, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, ok := s.answer(tt.query)
+			if ok == tt.forward {
+				t.Fatalf("answered %v, want %v", ok, !tt.forward)
+			}
+			if tt.forward {
+				return
+			}
+			if resp.Rcode != tt.rcode || !resp.Authoritative {
+				t.Errorf("got rcode %d, authoritative %v, want rcode %d", resp.Rcode, resp.Authoritative, tt.rcode)
+			}
+			got := ""
+			if len(resp.Answer) > 1 {
+				t.Fatalf("got %d answers", len(resp.Answer))
+			}
+			if len(resp.Answer) == 1 {
+				switch rr := resp.Answer[0].(type) {
+				case *dns.A:
+					got = rr.A.String()
+				case *dns.AAAA:
+					got = rr.AAAA.String()
+				case *dns.PTR:
+					got = rr.Ptr
+				}
+				if hdr := resp.Answer[0].Header(); hdr.Name != tt.query.Question[0].Name || hdr.Ttl != TTL {
+					t.Errorf("answer for %s with ttl %d, want %s with ttl %d", hdr.Name, hdr.Ttl, tt.query.Question[0].Name, TTL)
+				}
+			}
+			if got != tt.answer {
+				t.Errorf("got answer %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
+
+func TestSetRecords(t *testing.T) {
+	s := NewServer("hyprspace", []string{"127.0.0.1:53"})
+	s.SetRecords(map[string]string{"10.1.1.2": "laptop"})
+	s.SetRecords(map[string]string{"10.1.1.3": "desktop"})
+
+	// Records are replaced as a whole.
+	if resp, ok := s.answer(query("laptop.hyprspace.", dns.TypeA)); !ok || resp.Rcode != dns.RcodeNameError {
+		t.Error("removed name still answered")
+	}
+	if _, ok := s.answer(query("2.1.1.10.in-addr.arpa.", dns.TypePTR)); ok {
+		t.Error("removed address still answered")
+	}
+	if resp, ok := s.answer(query("desktop.hyprspace.", dns.TypeA)); !ok || len(resp.Answer) != 1 {
+		t.Error("added name not answered")
+	}
+}
+
+func TestNewServerPorts(t *testing.T) {
+	upstream := []string{"192.0.2.53", "192.0.2.54:5353", "2001:db8::53"}
+	s := NewServer("hyprspace", upstream)
+
+	want := []string{"192.0.2.53:53", "192.0.2.54:5353", "[2001:db8::53]:53"}
+	for i := range want {
+		if s.upstream[i] != want[i] {
+			t.Errorf("upstream %d is %q, want %q", i, s.upstream[i], want[i])
+		}
+	}
+	if upstream[0] != "192.0.2.53" || upstream[2] != "2001:db8::53" {
+		t.Errorf("caller's upstream changed to %v", upstream)
+	}
+}
+
+// upstream starts a resolver on the loopback address answering every
+// query for an A record with addr and returns its address.
+func upstream(t *testing.T, addr string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: header(r.Question[0].Name, dns.TypeA), A: net.ParseIP(addr)})
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestForward(t *testing.T) {
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		upstream []string
+		rcode    int
+		answers  int
+	}{
+		{"answered", []string{upstream(t, "192.0.2.1")}, dns.RcodeSuccess, 1},
+		{"first upstream down", []string{closed.LocalAddr().String(), upstream(t, "192.0.2.1")}, dns.RcodeSuccess, 1},
+		{"all upstreams down", []string{closed.LocalAddr().String()}, dns.RcodeServerFailure, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("hyprspace", tt.upstream)
+			if err := s.Start("127.0.0.1:0"); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			c := dns.Client{}
+			resp, _, err := c.Exchange(query("example.com.", dns.TypeA), s.servers[0].PacketConn.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Rcode != tt.rcode || len(resp.Answer) != tt.answers {
+				t.Errorf("got rcode %d with %d answers, want rcode %d with %d", resp.Rcode, len(resp.Answer), tt.rcode, tt.answers)
+			}
+		})
+	}
+}
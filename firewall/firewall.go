@@ -0,0 +1,387 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Direction is the direction a packet travels relative to the local node.
+type Direction int
+
+const (
+	// Inbound packets are received from a peer.
+	Inbound Direction = iota
+	// Outbound packets are sent to a peer.
+	Outbound
+)
+
+// Protocol numbers of the transport protocols rules can match on.
+const (
+	ICMP = 1
+	TCP  = 6
+	UDP  = 17
+)
+
+// Idle timeouts after which a tracked connection is forgotten.
+var timeouts = map[uint8]time.Duration{
+	ICMP: 30 * time.Second,
+	TCP:  5 * time.Minute,
+	UDP:  time.Minute,
+}
+
+// maxFlows bounds the number of connections a firewall tracks.
+const maxFlows = 65536
+
+// evictSample is how many tracked connections are compared to pick the
+// one to forget when the table is full.
+const evictSample = 8
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Rule allows new connections with a set of peers that match a
+// direction, protocol and set of destination ports. Packets and Bytes
+// count the traffic allowed by the rule and must be read atomically.
+type Rule struct {
+	Packets uint64
+	Bytes   uint64
+
+	Peers     []string
+	Direction Direction
+	Proto     uint8
+	Ports     []PortRange
+
+	// Comment describes where the rule came from.
+	Comment string
+}
+
+// NewRule parses a rule. No peers matches all peers, a proto of "any"
+// matches all protocols and no ports matches all ports.
+func NewRule(peers []string, direction string, proto string, ports []string) (*Rule, error) {
+	result := Rule{Peers: peers}
+
+	switch direction {
+	case "", "in":
+		result.Direction = Inbound
+	case "out":
+		result.Direction = Outbound
+	default:
+		return nil, fmt.Errorf("unknown firewall direction %s", direction)
+	}
+
+	switch strings.ToLower(proto) {
+	case "", "any":
+	case "icmp":
+		result.Proto = ICMP
+	case "tcp":
+		result.Proto = TCP
+	case "udp":
+		result.Proto = UDP
+	default:
+		return nil, fmt.Errorf("unknown firewall protocol %s", proto)
+	}
+
+	if len(ports) > 0 && result.Proto != TCP && result.Proto != UDP {
+		return nil, errors.New("firewall ports can only be used with tcp or udp")
+	}
+	for _, p := range ports {
+		r, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		result.Ports = append(result.Ports, r)
+	}
+	return &result, nil
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	from, to := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	f, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("%s is not a valid port range", s)
+	}
+	t, err := strconv.ParseUint(to, 10, 16)
+	if err != nil || t < f {
+		return PortRange{}, fmt.Errorf("%s is not a valid port range", s)
+	}
+	return PortRange{From: uint16(f), To: uint16(t)}, nil
+}
+
+// String describes the rule.
+func (r *Rule) String() string {
+	peer := strings.Join(r.Peers, ",")
+	if peer == "" {
+		peer = "*"
+	}
+	dir := "in"
+	if r.Direction == Outbound {
+		dir = "out"
+	}
+	proto := "any"
+	switch r.Proto {
+	case ICMP:
+		proto = "icmp"
+	case TCP:
+		proto = "tcp"
+	case UDP:
+		proto = "udp"
+	}
+	ports := make([]string, 0, len(r.Ports))
+	for _, p := range r.Ports {
+		if p.From == p.To {
+			ports = append(ports, strconv.Itoa(int(p.From)))
+		} else {
+			ports = append(ports, fmt.Sprintf("%d-%d", p.From, p.To))
+		}
+	}
+	if len(ports) == 0 {
+		return fmt.Sprintf("%s %s %s", dir, peer, proto)
+	}
+	return fmt.Sprintf("%s %s %s/%s", dir, peer, proto, strings.Join(ports, ","))
+}
+
+func (r *Rule) matches(peer string, dir Direction, p *packet) bool {
+	if r.Direction != dir || !r.hasPeer(peer) {
+		return false
+	}
+	if r.Proto != 0 && r.Proto != p.proto {
+		return false
+	}
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, pr := range r.Ports {
+		if p.dport >= pr.From && p.dport <= pr.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) hasPeer(peer string) bool {
+	if len(r.Peers) == 0 {
+		return true
+	}
+	for _, p := range r.Peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// flow identifies a connection with a peer as seen by the side that
+// opened it. Connections are tracked per peer so packets from one peer
+// can't pass as replies to a connection with another.
+type flow struct {
+	peer  string
+	proto uint8
+	src   [4]byte
+	dst   [4]byte
+	sport uint16
+	dport uint16
+}
+
+func (f flow) reverse() flow {
+	return flow{peer: f.peer, proto: f.proto, src: f.dst, dst: f.src, sport: f.dport, dport: f.sport}
+}
+
+type entry struct {
+	rule    *Rule
+	expires time.Time
+}
+
+// Firewall filters packets exchanged with peers. New connections are
+// checked against the rules and fall back to a default policy per
+// direction. Packets belonging to an allowed connection are allowed in
+// both directions. Once it tracks too many connections, it forgets old
+// ones to make room for new ones.
+type Firewall struct {
+	dropped uint64
+	rules   []*Rule
+	allow   [2]bool
+
+	lock     sync.Mutex
+	flows    map[flow]*entry
+	maxFlows int
+	nextGC   time.Time
+}
+
+// New creates a firewall from a set of rules and the default policies
+// for inbound and outbound connections which match no rule.
+func New(rules []*Rule, allowInbound bool, allowOutbound bool) *Firewall {
+	return &Firewall{
+		rules:    rules,
+		allow:    [2]bool{Inbound: allowInbound, Outbound: allowOutbound},
+		flows:    make(map[flow]*entry),
+		maxFlows: maxFlows,
+	}
+}
+
+// Rules returns the firewall's rules.
+func (f *Firewall) Rules() []*Rule {
+	return f.rules
+}
+
+// Dropped returns the number of packets the firewall has denied.
+func (f *Firewall) Dropped() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+// Allow reports whether an IPv4 packet exchanged with the peer at the
+// given overlay address may pass in the given direction.
+func (f *Firewall) Allow(data []byte, peer string, dir Direction) bool {
+	p, ok := parse(data)
+	if !ok {
+		atomic.AddUint64(&f.dropped, 1)
+		return false
+	}
+	p.peer = peer
+
+	// Non-first fragments carry no ports and can't be reassembled
+	// without their first fragment, which has already been checked.
+	if p.fragment {
+		return true
+	}
+
+	now := time.Now()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.collect(now)
+
+	// Packets of an already tracked connection in either direction.
+	e, ok := f.flows[p.flow]
+	if !ok {
+		e, ok = f.flows[p.flow.reverse()]
+	}
+	if ok {
+		e.expires = now.Add(timeout(p.proto))
+		count(e.rule, len(data))
+		return true
+	}
+
+	// Packets opening a new connection.
+	var rule *Rule
+	for _, r := range f.rules {
+		if r.matches(peer, dir, &p) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil && !f.allow[dir] {
+		atomic.AddUint64(&f.dropped, 1)
+		return false
+	}
+	if len(f.flows) >= f.maxFlows {
+		f.evict()
+	}
+	f.flows[p.flow] = &entry{rule: rule, expires: now.Add(timeout(p.proto))}
+	count(rule, len(data))
+	return true
+}
+
+// collect forgets expired connections at most once every few seconds.
+func (f *Firewall) collect(now time.Time) {
+	if now.Before(f.nextGC) {
+		return
+	}
+	for k, e := range f.flows {
+		if now.After(e.expires) {
+			delete(f.flows, k)
+		}
+	}
+	f.nextGC = now.Add(10 * time.Second)
+}
+
+// evict forgets the connection closest to expiring among a few picked
+// at random, which is cheap enough to do for every new connection once
+// the table is full.
+func (f *Firewall) evict() {
+	var oldest flow
+	var expires time.Time
+	n := 0
+	for k, e := range f.flows {
+		if n == 0 || e.expires.Before(expires) {
+			oldest, expires = k, e.expires
+		}
+		n++
+		if n == evictSample {
+			break
+		}
+	}
+	delete(f.flows, oldest)
+}
+
+func count(r *Rule, size int) {
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&r.Packets, 1)
+	atomic.AddUint64(&r.Bytes, uint64(size))
+}
+
+func timeout(proto uint8) time.Duration {
+	if t, ok := timeouts[proto]; ok {
+		return t
+	}
+	return time.Minute
+}
+
+type packet struct {
+	flow
+	fragment bool
+}
+
+// parse decodes the fields of an IPv4 packet used to match rules and
+// track connections.
+func parse(data []byte) (packet, bool) {
+	var p packet
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return p, false
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if ihl < 20 || len(data) < ihl {
+		return p, false
+	}
+	p.proto = data[9]
+	copy(p.src[:], data[12:16])
+	copy(p.dst[:], data[16:20])
+	p.fragment = binary.BigEndian.Uint16(data[6:8])&0x1fff != 0
+	if p.fragment {
+		return p, true
+	}
+
+	l4 := data[ihl:]
+	switch p.proto {
+	case TCP, UDP:
+		if len(l4) < 4 {
+			return p, false
+		}
+		p.sport = binary.BigEndian.Uint16(l4[0:2])
+		p.dport = binary.BigEndian.Uint16(l4[2:4])
+	case ICMP:
+		if len(l4) < 8 {
+			return p, false
+		}
+		// Track echo requests and replies by their identifier so
+		// replies match the request that caused them.
+		if l4[0] == 8 || l4[0] == 0 {
+			p.sport = binary.BigEndian.Uint16(l4[4:6])
+			p.dport = p.sport
+		}
+	}
+	return p, true
+}
@@ -0,0 +1,154 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// ipv4 builds an IPv4 packet from src to dst carrying a transport
+// header with the given ports.
+func ipv4(proto uint8, src string, dst string, sport uint16, dport uint16) []byte {
+	packet := make([]byte, 28)
+	packet[0] = 0x45
+	packet[9] = proto
+	copy(packet[12:16], net.ParseIP(src).To4())
+	copy(packet[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(packet[20:22], sport)
+	binary.BigEndian.PutUint16(packet[22:24], dport)
+	return packet
+}
+
+// echo builds an ICMP echo request or reply with the given identifier.
+func echo(src string, dst string, reply bool, id uint16) []byte {
+	packet := ipv4(ICMP, src, dst, 0, 0)
+	packet[20] = 8
+	if reply {
+		packet[20] = 0
+	}
+	binary.BigEndian.PutUint16(packet[24:26], id)
+	return packet
+}
+
+func TestNewRule(t *testing.T) {
+	tests := []struct {
+		peers     []string
+		direction string
+		proto     string
+		ports     []string
+		want      string
+		ok        bool
+	}{
+		{nil, "", "", nil, "in * any", true},
+		{[]string{"10.1.1.2", "10.1.1.3"}, "out", "TCP", []string{"22", "8000-8080"}, "out 10.1.1.2,10.1.1.3 tcp/22,8000-8080", true},
+		{nil, "in", "icmp", nil, "in * icmp", true},
+		{nil, "in", "udp", []string{"53"}, "in * udp/53", true},
+		{nil, "sideways", "", nil, "", false},
+		{nil, "in", "sctp", nil, "", false},
+		{nil, "in", "icmp", []string{"22"}, "", false},
+		{nil, "in", "tcp", []string{"80-22"}, "", false},
+		{nil, "in", "tcp", []string{"65536"}, "", false},
+		{nil, "in", "tcp", []string{"http"}, "", false},
+	}
+	for _, tt := range tests {
+		r, err := NewRule(tt.peers, tt.direction, tt.proto, tt.ports)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewRule(%v, %q, %q, %v) got error %v, want ok %v", tt.peers, tt.direction, tt.proto, tt.ports, err, tt.ok)
+			continue
+		}
+		if tt.ok && r.String() != tt.want {
+			t.Errorf("got rule %q, want %q", r.String(), tt.want)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	ssh, _ := NewRule([]string{"10.1.1.2"}, "in", "tcp", []string{"22"})
+	ping, _ := NewRule(nil, "in", "icmp", nil)
+	web, _ := NewRule(nil, "out", "tcp", []string{"443"})
+	fw := New([]*Rule{ssh, ping, web}, false, false)
+
+	// Each step is a packet exchanged with a peer and whether it may
+	// pass. Steps run in order against the same connection table.
+	tests := []struct {
+		name   string
+		packet []byte
+		peer   string
+		dir    Direction
+		ok     bool
+	}{
+		{"ssh from allowed peer", ipv4(TCP, "10.1.1.2", "10.1.1.1", 50000, 22), "10.1.1.2", Inbound, true},
+		{"ssh reply", ipv4(TCP, "10.1.1.1", "10.1.1.2", 22, 50000), "10.1.1.2", Outbound, true},
+		{"ssh from other peer", ipv4(TCP, "10.1.1.3", "10.1.1.1", 50000, 22), "10.1.1.3", Inbound, false},
+		{"other port", ipv4(TCP, "10.1.1.2", "10.1.1.1", 50000, 80), "10.1.1.2", Inbound, false},
+		{"udp to ssh port", ipv4(UDP, "10.1.1.2", "10.1.1.1", 50000, 22), "10.1.1.2", Inbound, false},
+		{"outbound https", ipv4(TCP, "10.1.1.1", "10.1.1.3", 40000, 443), "10.1.1.3", Outbound, true},
+		{"https reply", ipv4(TCP, "10.1.1.3", "10.1.1.1", 443, 40000), "10.1.1.3", Inbound, true},
+
+		// Another peer can't pass its packets off as replies to a
+		// connection with someone else.
+		{"https reply from other peer", ipv4(TCP, "10.1.1.3", "10.1.1.1", 443, 40000), "10.1.1.2", Inbound, false},
+		{"outbound ssh", ipv4(TCP, "10.1.1.1", "10.1.1.2", 40000, 22), "10.1.1.2", Outbound, false},
+		{"ping", echo("10.1.1.3", "10.1.1.1", false, 7), "10.1.1.3", Inbound, true},
+		{"ping reply", echo("10.1.1.1", "10.1.1.3", true, 7), "10.1.1.3", Outbound, true},
+		{"unsolicited ping reply", echo("10.1.1.3", "10.1.1.1", true, 9), "10.1.1.3", Outbound, false},
+		{"truncated", ipv4(TCP, "10.1.1.2", "10.1.1.1", 50000, 22)[:22], "10.1.1.2", Inbound, false},
+		{"ipv6", append([]byte{0x60}, make([]byte, 39)...), "10.1.1.2", Inbound, false},
+	}
+	dropped := uint64(0)
+	for _, tt := range tests {
+		if got := fw.Allow(tt.packet, tt.peer, tt.dir); got != tt.ok {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.ok)
+		}
+		if !tt.ok {
+			dropped++
+		}
+	}
+	if fw.Dropped() != dropped {
+		t.Errorf("dropped %d packets, want %d", fw.Dropped(), dropped)
+	}
+	if ssh.Packets != 2 || web.Packets != 2 || ping.Packets != 2 {
+		t.Errorf("rules counted %d, %d and %d packets, want 2 each", ssh.Packets, web.Packets, ping.Packets)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	fw := New(nil, false, true)
+	out := ipv4(UDP, "10.1.1.1", "10.1.1.2", 5000, 53)
+	if !fw.Allow(out, "10.1.1.2", Outbound) {
+		t.Error("outbound packet denied")
+	}
+	if !fw.Allow(ipv4(UDP, "10.1.1.2", "10.1.1.1", 53, 5000), "10.1.1.2", Inbound) {
+		t.Error("reply denied")
+	}
+	if fw.Allow(ipv4(UDP, "10.1.1.2", "10.1.1.1", 5000, 53), "10.1.1.2", Inbound) {
+		t.Error("inbound packet allowed")
+	}
+
+	// Fragments after the first carry no ports and pass.
+	frag := ipv4(UDP, "10.1.1.2", "10.1.1.1", 0, 0)
+	binary.BigEndian.PutUint16(frag[6:8], 100)
+	if !fw.Allow(frag, "10.1.1.2", Inbound) {
+		t.Error("fragment denied")
+	}
+}
+
+func TestMaxFlows(t *testing.T) {
+	fw := New(nil, false, true)
+	fw.maxFlows = 4
+
+	// Connections beyond the limit push older ones out of the table.
+	for port := uint16(1); port <= 10; port++ {
+		if !fw.Allow(ipv4(UDP, "10.1.1.1", "10.1.1.2", port, 53), "10.1.1.2", Outbound) {
+			t.Fatalf("outbound packet from port %d denied", port)
+		}
+		if len(fw.flows) > fw.maxFlows {
+			t.Fatalf("tracking %d connections, want at most %d", len(fw.flows), fw.maxFlows)
+		}
+	}
+
+	// The newest connection is still tracked.
+	if !fw.Allow(ipv4(UDP, "10.1.1.2", "10.1.1.1", 53, 10), "10.1.1.2", Inbound) {
+		t.Error("reply to the newest connection denied")
+	}
+}
@@ -7,16 +7,23 @@ require (
 	github.com/hashicorp/go-version v1.4.0 // indirect
 	github.com/inconshreveable/go-update v0.0.0-20160112193335-8152e7eb6ccf
 	github.com/ipfs/go-datastore v0.5.1
+	github.com/ipfs/go-log/v2 v2.4.0
 	github.com/kr/text v0.2.0 // indirect
 	github.com/libp2p/go-libp2p v0.17.0
 	github.com/libp2p/go-libp2p-core v0.13.0
 	github.com/libp2p/go-libp2p-kad-dht v0.15.0
 	github.com/libp2p/go-libp2p-quic-transport v0.15.2
 	github.com/libp2p/go-tcp-transport v0.4.0
+	github.com/miekg/dns v1.1.43
 	github.com/multiformats/go-multiaddr v0.4.1
 	github.com/nxadm/tail v1.4.8
+	github.com/prometheus/client_golang v1.11.0
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
 	github.com/tcnksm/go-latest v0.0.0-20170313132115-e3007ae9052e
 	github.com/vishvananda/netlink v1.1.0
+	github.com/vishvananda/netns v0.0.0-20210104183010-2eb08e3e575f
+	go.uber.org/zap v1.19.0
+	golang.org/x/sys v0.0.0-20210816183151-1e6c022a8912
 	gopkg.in/yaml.v2 v2.4.0
+	gvisor.dev/gvisor v0.0.0-20211020211948-f76a604701b6
 )
@@ -0,0 +1,76 @@
+package hooks
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Run runs commands one after another through the system shell with
+// env added to the daemon's environment. Each command is killed if it
+// runs for longer than timeout. Every line a command writes to stdout
+// or stderr is passed to output. Run stops at the first command which
+// fails.
+func Run(commands []string, env []string, timeout time.Duration, output func(command string, line string)) error {
+	for _, command := range commands {
+		err := run(command, env, timeout, output)
+		if err != nil {
+			return fmt.Errorf("hook %q: %w", command, err)
+		}
+	}
+	return nil
+}
+
+func run(command string, env []string, timeout time.Duration, output func(string, string)) error {
+	cmd := shell(command)
+	cmd.Env = append(os.Environ(), env...)
+
+	// Pass both stdout and stderr through a single pipe so lines keep
+	// their order.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd.Stdout = w
+	cmd.Stderr = w
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			output(command, scanner.Text())
+		}
+		close(done)
+	}()
+
+	// Kill the command along with anything it started once it runs
+	// out of time.
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		kill(cmd)
+	})
+	err = cmd.Wait()
+	timer.Stop()
+
+	// Processes left running in the background may hold on to the
+	// pipe, so only wait a moment for the rest of the output.
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
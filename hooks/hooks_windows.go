@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package hooks
+
+import "os/exec"
+
+// shell creates a command run by cmd.
+func shell(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
+
+// kill kills a command.
+func kill(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,162 @@
+package hosts
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// DefaultPath returns the location of the system hosts file.
+func DefaultPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// Write replaces the block of entries belonging to an interface in the
+// hosts file at path. Entries maps a peer's address to its name. The
+// file is replaced atomically so readers never see a partial block.
+func Write(path string, iface string, entries map[string]string) error {
+	in, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := strip(in, iface)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		out = append(out, block(iface, entries)...)
+	}
+	return replace(path, out)
+}
+
+// Remove deletes the block of entries belonging to an interface from
+// the hosts file at path.
+func Remove(path string, iface string) error {
+	in, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	out, err := strip(in, iface)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(in, out) {
+		return nil
+	}
+	return replace(path, out)
+}
+
+func begin(iface string) string {
+	return "# BEGIN hyprspace " + iface
+}
+
+func end(iface string) string {
+	return "# END hyprspace " + iface
+}
+
+// block renders the delimited entries for an interface sorted by address.
+func block(iface string, entries map[string]string) []byte {
+	ips := make([]string, 0, len(entries))
+	for ip := range entries {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(ips[i]).To16(), net.ParseIP(ips[j]).To16()) < 0
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, begin(iface))
+	for _, ip := range ips {
+		fmt.Fprintf(&buf, "%s\t%s\n", ip, entries[ip])
+	}
+	fmt.Fprintln(&buf, end(iface))
+	return buf.Bytes()
+}
+
+// strip returns the contents of a hosts file without the block of
+// entries belonging to an interface. Lines may be as long as the whole
+// file, so none are cut short. A block without its end line is an
+// error.
+func strip(in []byte, iface string) ([]byte, error) {
+	var out bytes.Buffer
+	inBlock := false
+	scanner := bufio.NewScanner(bytes.NewReader(in))
+	scanner.Buffer(nil, len(in)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == begin(iface):
+			inBlock = true
+		case strings.TrimSpace(line) == end(iface):
+			inBlock = false
+		case !inBlock:
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Without its end every line after the block would be taken for
+	// part of it and lost.
+	if inBlock {
+		return nil, fmt.Errorf("block for %s has no end line", iface)
+	}
+	return out.Bytes(), nil
+}
+
+// replace writes data to a temporary file next to path and renames it
+// over the original, keeping the original file's permissions.
+func replace(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".hosts-hyprspace-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if bindMounted(err) {
+		// Hosts files bind mounted into containers can't be renamed
+		// over so fall back to rewriting the file in place.
+		return os.WriteFile(path, data, mode)
+	}
+	return err
+}
+
+// bindMounted reports whether a rename failed because the file renamed
+// over is a mount point, which is only the case for bind mounts.
+func bindMounted(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EXDEV)
+}
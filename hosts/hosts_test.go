@@ -0,0 +1,156 @@
+package hosts
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	const system = "127.0.0.1\tlocalhost\n::1\tlocalhost\n"
+	long := "# " + strings.Repeat("x", 100<<10) + "\n"
+	tests := []struct {
+		name    string
+		in      string
+		iface   string
+		entries map[string]string
+		want    string
+	}{
+		{
+			name:    "new block",
+			in:      system,
+			iface:   "hs0",
+			entries: map[string]string{"10.1.1.10": "db.hyprspace", "10.1.1.2": "laptop.hyprspace"},
+			want: system +
+				"# BEGIN hyprspace hs0\n10.1.1.2\tlaptop.hyprspace\n10.1.1.10\tdb.hyprspace\n# END hyprspace hs0\n",
+		},
+		{
+			name:    "replaced block",
+			in:      system + "# BEGIN hyprspace hs0\n10.1.1.3\told.hyprspace\n# END hyprspace hs0\n",
+			iface:   "hs0",
+			entries: map[string]string{"10.1.1.2": "laptop.hyprspace"},
+			want:    system + "# BEGIN hyprspace hs0\n10.1.1.2\tlaptop.hyprspace\n# END hyprspace hs0\n",
+		},
+		{
+			name:    "other interface kept",
+			in:      system + "# BEGIN hyprspace hs1\n10.2.1.2\tnas.hyprspace\n# END hyprspace hs1\n",
+			iface:   "hs0",
+			entries: map[string]string{"10.1.1.2": "laptop.hyprspace"},
+			want: system + "# BEGIN hyprspace hs1\n10.2.1.2\tnas.hyprspace\n# END hyprspace hs1\n" +
+				"# BEGIN hyprspace hs0\n10.1.1.2\tlaptop.hyprspace\n# END hyprspace hs0\n",
+		},
+		{
+			name:  "no entries",
+			in:    system + "# BEGIN hyprspace hs0\n10.1.1.3\told.hyprspace\n# END hyprspace hs0\n",
+			iface: "hs0",
+			want:  system,
+		},
+		{
+			name:    "long line kept",
+			in:      system + long,
+			iface:   "hs0",
+			entries: map[string]string{"10.1.1.2": "laptop.hyprspace"},
+			want:    system + long + "# BEGIN hyprspace hs0\n10.1.1.2\tlaptop.hyprspace\n# END hyprspace hs0\n",
+		},
+		{
+			name:    "missing file",
+			iface:   "hs0",
+			entries: map[string]string{"10.1.1.2": "laptop.hyprspace"},
+			want:    "# BEGIN hyprspace hs0\n10.1.1.2\tlaptop.hyprspace\n# END hyprspace hs0\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hosts")
+			if tt.in != "" {
+				if err := os.WriteFile(path, []byte(tt.in), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := Write(path, tt.iface, tt.entries); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+
+			// The block is removed again and the rest left alone.
+			if err := Remove(path, tt.iface); err != nil {
+				t.Fatal(err)
+			}
+			got, _ = os.ReadFile(path)
+			if want, _ := strip([]byte(tt.want), tt.iface); string(got) != string(want) {
+				t.Errorf("got\n%s\nafter removing, want\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestUnterminatedBlock(t *testing.T) {
+	const in = "127.0.0.1\tlocalhost\n# BEGIN hyprspace hs0\n10.1.1.3\told.hyprspace\n192.168.1.5\tprinter\n"
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(in), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither writing nor removing entries touches the file.
+	if err := Write(path, "hs0", map[string]string{"10.1.1.2": "laptop.hyprspace"}); err == nil {
+		t.Error("wrote entries after a block without an end")
+	}
+	if err := Remove(path, "hs0"); err == nil {
+		t.Error("removed a block without an end")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != in {
+		t.Errorf("got\n%s\nwant\n%s", got, in)
+	}
+
+	// Blocks of other interfaces don't matter.
+	if err := Write(path, "hs1", map[string]string{"10.2.1.2": "nas.hyprspace"}); err != nil {
+		t.Errorf("unable to write entries of another interface: %v", err)
+	}
+}
+
+func TestWriteKeepsMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(path, "hs0", map[string]string{"10.1.1.2": "laptop.hyprspace"}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+}
+
+func TestBindMounted(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&os.LinkError{Op: "rename", Err: syscall.EBUSY}, true},
+		{&os.LinkError{Op: "rename", Err: syscall.EXDEV}, true},
+		{&os.LinkError{Op: "rename", Err: syscall.EACCES}, false},
+		{&os.LinkError{Op: "rename", Err: syscall.ENOSPC}, false},
+	}
+	for _, tt := range tests {
+		if got := bindMounted(tt.err); got != tt.want {
+			t.Errorf("bindMounted(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
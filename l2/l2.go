@@ -0,0 +1,120 @@
+package l2
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// HeaderLen is the size of an Ethernet header.
+const HeaderLen = 14
+
+// maxEntries bounds how many MAC addresses a table learns so a peer
+// can't exhaust memory by sending frames from random addresses.
+const maxEntries = 4096
+
+// MAC is an Ethernet address.
+type MAC [6]byte
+
+// Dst returns the destination address of a frame.
+func Dst(frame []byte) MAC {
+	var m MAC
+	copy(m[:], frame[0:6])
+	return m
+}
+
+// Src returns the source address of a frame.
+func Src(frame []byte) MAC {
+	var m MAC
+	copy(m[:], frame[6:12])
+	return m
+}
+
+// Multicast reports whether the address is a group address, which
+// includes the broadcast address.
+func (m MAC) Multicast() bool {
+	return m[0]&1 == 1
+}
+
+// FlowHash hashes the addresses of a frame so frames between the same
+// pair of hosts hash the same.
+func FlowHash(frame []byte) int {
+	h := fnv.New32a()
+	h.Write(frame[0:12])
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+// Table learns which peer each MAC address is behind from the frames
+// peers send. Entries expire once a host hasn't sent any frames for
+// the table's TTL.
+//
+// Peers are trusted to send frames from the hosts behind them only, as
+// nothing ties a MAC address to a peer the way addresses are in TUN
+// mode. To keep one peer from taking over the addresses of hosts behind
+// another, an address is only learned behind a new peer once its entry
+// for the old one has expired.
+type Table struct {
+	ttl time.Duration
+
+	lock    sync.RWMutex
+	entries map[MAC]entry
+}
+
+type entry struct {
+	peer string
+	seen time.Time
+}
+
+// NewTable creates an empty table with a TTL for its entries.
+func NewTable(ttl time.Duration) *Table {
+	return &Table{ttl: ttl, entries: make(map[MAC]entry)}
+}
+
+// Learn records that a frame from address mac was received from peer.
+// It reports whether the address is now known behind the peer, which it
+// isn't for group addresses, addresses another peer still holds, or new
+// addresses once the table is full.
+func (t *Table) Learn(mac MAC, peer string) bool {
+	if mac.Multicast() {
+		return false
+	}
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	e, ok := t.entries[mac]
+	if ok && now.Sub(e.seen) <= t.ttl {
+		if e.peer != peer {
+			return false
+		}
+		if now.Sub(e.seen) < time.Second {
+			return true
+		}
+	}
+
+	// Make room by forgetting expired entries once the table is full.
+	if !ok && len(t.entries) >= maxEntries {
+		for m, e := range t.entries {
+			if now.Sub(e.seen) > t.ttl {
+				delete(t.entries, m)
+			}
+		}
+		if len(t.entries) >= maxEntries {
+			return false
+		}
+	}
+	t.entries[mac] = entry{peer: peer, seen: now}
+	return true
+}
+
+// Lookup returns the peer address mac was last seen behind. Group and
+// unknown addresses have none, and their frames are flooded instead.
+func (t *Table) Lookup(mac MAC) (string, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	e, ok := t.entries[mac]
+	if !ok || time.Since(e.seen) > t.ttl {
+		return "", false
+	}
+	return e.peer, true
+}
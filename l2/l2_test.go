@@ -0,0 +1,112 @@
+package l2
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	hostA     = MAC{0x02, 0, 0, 0, 0, 0x0a}
+	hostB     = MAC{0x02, 0, 0, 0, 0, 0x0b}
+	broadcast = MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	multicast = MAC{0x01, 0x00, 0x5e, 0, 0, 0xfb}
+)
+
+// age makes the entry for mac look last seen d ago.
+func age(t *Table, mac MAC, d time.Duration) {
+	e := t.entries[mac]
+	e.seen = time.Now().Add(-d)
+	t.entries[mac] = e
+}
+
+func TestLearn(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *Table)
+		mac   MAC
+		peer  string
+		ok    bool
+		want  string
+	}{
+		{"new address", func(*Table) {}, hostA, "10.1.1.2", true, "10.1.1.2"},
+		{"known address", func(t *Table) { t.Learn(hostA, "10.1.1.2") }, hostA, "10.1.1.2", true, "10.1.1.2"},
+		{"address held by another peer", func(t *Table) { t.Learn(hostA, "10.1.1.3") }, hostA, "10.1.1.2", false, "10.1.1.3"},
+		{"address expired behind another peer", func(t *Table) {
+			t.Learn(hostA, "10.1.1.3")
+			age(t, hostA, 2*time.Minute)
+		}, hostA, "10.1.1.2", true, "10.1.1.2"},
+		{"broadcast", func(*Table) {}, broadcast, "10.1.1.2", false, ""},
+		{"multicast", func(*Table) {}, multicast, "10.1.1.2", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := NewTable(time.Minute)
+			tt.setup(table)
+			if ok := table.Learn(tt.mac, tt.peer); ok != tt.ok {
+				t.Errorf("Learn returned %v, want %v", ok, tt.ok)
+			}
+			got, _ := table.Lookup(tt.mac)
+			if got != tt.want {
+				t.Errorf("got %s behind %q, want %q", tt.mac, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	table := NewTable(time.Minute)
+	table.Learn(hostA, "10.1.1.2")
+	table.Learn(hostB, "10.1.1.3")
+	age(table, hostB, 2*time.Minute)
+
+	// Frames with no peer to go to are flooded.
+	tests := []struct {
+		name string
+		dst  MAC
+		want string
+		ok   bool
+	}{
+		{"learned", hostA, "10.1.1.2", true},
+		{"expired", hostB, "", false},
+		{"unknown", MAC{0x02, 0, 0, 0, 0, 0x0c}, "", false},
+		{"broadcast", broadcast, "", false},
+		{"multicast", multicast, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := table.Lookup(tt.dst)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTableFull(t *testing.T) {
+	table := NewTable(time.Minute)
+	for i := 0; i < maxEntries; i++ {
+		table.Learn(MAC{0x02, 0, 0, 0, byte(i >> 8), byte(i)}, "10.1.1.2")
+	}
+
+	// A full table learns no new addresses but keeps refreshing the
+	// known ones.
+	extra := MAC{0x02, 0, 0, 1, 0, 0}
+	if table.Learn(extra, "10.1.1.2") {
+		t.Error("learned an address with the table full")
+	}
+	if !table.Learn(MAC{0x02, 0, 0, 0, 0, 1}, "10.1.1.2") {
+		t.Error("known address not refreshed with the table full")
+	}
+	if n := len(table.entries); n != maxEntries {
+		t.Errorf("got %d entries, want %d", n, maxEntries)
+	}
+
+	// Expired entries make room for new ones.
+	age(table, MAC{0x02, 0, 0, 0, 0, 2}, 2*time.Minute)
+	if !table.Learn(extra, "10.1.1.2") {
+		t.Error("address not learned after an entry expired")
+	}
+	if _, ok := table.Lookup(extra); !ok {
+		t.Error("address learned after an entry expired not found")
+	}
+}
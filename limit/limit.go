@@ -0,0 +1,134 @@
+package limit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBurst is the smallest burst a bucket allows so that a full sized
+// packet always fits.
+const minBurst = 64 * 1024
+
+// Bucket is a token bucket limiting the rate of bytes passing through it.
+type Bucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a bucket allowing rate bytes per second with bursts
+// of up to a tenth of a second's worth of traffic.
+func NewBucket(rate float64) *Bucket {
+	burst := rate / 10
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Allow reports whether n bytes may pass now and takes them from the
+// bucket if so.
+func (b *Bucket) Allow(n int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Limiter enforces the rate limits of a single peer in each direction.
+// A nil bucket doesn't limit its direction.
+type Limiter struct {
+	In  *Bucket
+	Out *Bucket
+}
+
+// Allow reports whether a packet of n bytes may be exchanged with the
+// peer in the given direction.
+func (l *Limiter) Allow(n int, outbound bool) bool {
+	b := l.In
+	if outbound {
+		b = l.Out
+	}
+	return b == nil || b.Allow(n)
+}
+
+var rateUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"gbit", 1e9 / 8},
+	{"mbit", 1e6 / 8},
+	{"kbit", 1e3 / 8},
+	{"bit", 1.0 / 8},
+	{"gb", 1e9},
+	{"mb", 1e6},
+	{"kb", 1e3},
+	{"b", 1},
+}
+
+// ParseRate parses a rate such as "10mbit" or "2MB" per second into
+// bytes per second.
+func ParseRate(s string) (float64, error) {
+	v := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+	for _, u := range rateUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), 64)
+			if err != nil || n <= 0 {
+				break
+			}
+			return n * u.scale, nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not a valid rate", s)
+}
+
+var sizeUnits = []struct {
+	suffix string
+	scale  uint64
+}{
+	{"tib", 1 << 40},
+	{"gib", 1 << 30},
+	{"mib", 1 << 20},
+	{"kib", 1 << 10},
+	{"tb", 1e12},
+	{"gb", 1e9},
+	{"mb", 1e6},
+	{"kb", 1e3},
+	{"b", 1},
+}
+
+// ParseSize parses a size such as "100GB" or "1TiB" into bytes.
+func ParseSize(s string) (uint64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), 64)
+			if err != nil || n <= 0 {
+				break
+			}
+			return uint64(n * float64(u.scale)), nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not a valid size", s)
+}
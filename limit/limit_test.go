@@ -0,0 +1,75 @@
+package limit
+
+import (
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"10mbit", 1.25e6, true},
+		{"10Mbit/s", 1.25e6, true},
+		{"1 gbit", 1.25e8, true},
+		{"8bit", 1, true},
+		{"2MB", 2e6, true},
+		{"1.5kb", 1500, true},
+		{"100b", 100, true},
+		{"0mbit", 0, false},
+		{"-1mb", 0, false},
+		{"mbit", 0, false},
+		{"10", 0, false},
+		{"10 parsecs", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseRate(%q) = %v, %v, want %v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		ok   bool
+	}{
+		{"100GB", 100e9, true},
+		{"1TiB", 1 << 40, true},
+		{"10 MiB", 10 << 20, true},
+		{"0.5kib", 512, true},
+		{"2tb", 2e12, true},
+		{"10MB", 10e6, true},
+		{"42b", 42, true},
+		{"0gb", 0, false},
+		{"gb", 0, false},
+		{"100", 0, false},
+		{"1 yottabyte", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseSize(%q) = %v, %v, want %v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := Limiter{Out: NewBucket(1)}
+
+	// Buckets start full with at least a full sized packet's worth.
+	if !l.Allow(minBurst, true) {
+		t.Error("burst not allowed")
+	}
+	if l.Allow(minBurst, true) {
+		t.Error("packet over the rate allowed")
+	}
+
+	// Directions without a bucket aren't limited.
+	if !l.Allow(1<<20, false) {
+		t.Error("unlimited direction limited")
+	}
+}
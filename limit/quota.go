@@ -0,0 +1,138 @@
+package limit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Quota tracks the bytes exchanged with each peer during the current
+// calendar month and stops traffic to peers over their limit until the
+// next month starts.
+type Quota struct {
+	path   string
+	limits map[string]uint64
+
+	lock  sync.Mutex
+	month string
+	used  map[string]uint64
+
+	// saving serializes saves so an older snapshot never replaces a
+	// newer one on disk.
+	saving sync.Mutex
+}
+
+// quotaFile is the on disk format of a quota's usage.
+type quotaFile struct {
+	Month string            `json:"month"`
+	Used  map[string]uint64 `json:"used"`
+}
+
+// Usage describes a peer's traffic for the current month.
+type Usage struct {
+	Month string
+	Used  uint64
+	Limit uint64
+}
+
+// LoadQuota creates a quota enforcing the monthly limits in bytes for
+// each peer and restores the usage persisted at path.
+func LoadQuota(path string, limits map[string]uint64) (*Quota, error) {
+	result := Quota{
+		path:   path,
+		limits: limits,
+		month:  month(time.Now()),
+		used:   make(map[string]uint64),
+	}
+
+	in, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &result, nil
+		}
+		return nil, err
+	}
+
+	var f quotaFile
+	err = json.Unmarshal(in, &f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Usage from a previous month no longer counts.
+	if f.Month == result.month && f.Used != nil {
+		result.used = f.Used
+	}
+	return &result, nil
+}
+
+// Add counts n bytes exchanged with a peer and reports whether the
+// peer is still within its quota.
+func (q *Quota) Add(peer string, n int) bool {
+	limit, ok := q.limits[peer]
+	if !ok {
+		return true
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.rollover()
+	if q.used[peer] >= limit {
+		return false
+	}
+	q.used[peer] += uint64(n)
+	return true
+}
+
+// Usage returns the current month's usage of every peer with a quota.
+func (q *Quota) Usage() map[string]Usage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.rollover()
+	result := make(map[string]Usage, len(q.limits))
+	for peer, limit := range q.limits {
+		result[peer] = Usage{
+			Month: q.month,
+			Used:  q.used[peer],
+			Limit: limit,
+		}
+	}
+	return result
+}
+
+// Save persists the current usage to disk.
+func (q *Quota) Save() error {
+	q.saving.Lock()
+	defer q.saving.Unlock()
+
+	q.lock.Lock()
+	out, err := json.Marshal(quotaFile{Month: q.month, Used: q.used})
+	q.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves
+	// behind a truncated usage file.
+	tmp := q.path + ".tmp"
+	err = os.WriteFile(tmp, out, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// rollover resets usage when a new month starts.
+func (q *Quota) rollover() {
+	if m := month(time.Now()); m != q.month {
+		q.month = m
+		q.used = make(map[string]uint64)
+	}
+}
+
+func month(t time.Time) string {
+	return t.Format("2006-01")
+}
@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	golog "github.com/ipfs/go-log/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Subsystem is the name Hyprspace's own logs are recorded under.
+const Subsystem = "hyprspace"
+
+// Logger records Hyprspace's logs. Libp2p logs through the same backend
+// so both end up in the same output and format.
+var Logger = golog.Logger(Subsystem)
+
+// Setup configures the output and format ("text" or "json") of all
+// logs and the minimum levels ("debug", "info", "warn" or "error") of
+// Hyprspace's own logs and of libp2p's logs. Logs are written to stderr
+// when out is nil. Anything written with the standard library's log
+// package is recorded through Logger.
+func Setup(level string, libp2pLevel string, format string, out io.Writer) error {
+	lvl, err := golog.LevelFromString(level)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid log level", level)
+	}
+	libp2pLvl, err := golog.LevelFromString(libp2pLevel)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid log level", libp2pLevel)
+	}
+
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	var encoder zapcore.Encoder
+	switch format {
+	case "text":
+		encCfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encCfg)
+	case "json":
+		encoder = zapcore.NewJSONEncoder(encCfg)
+	default:
+		return fmt.Errorf("%s is not a valid log format", format)
+	}
+
+	if out == nil {
+		out = os.Stderr
+	}
+
+	golog.SetupLogging(golog.Config{
+		Level:           libp2pLvl,
+		SubsystemLevels: map[string]golog.LogLevel{Subsystem: lvl},
+		Stderr:          true,
+	})
+
+	// Replace go-log's output with our own so logs can be written to
+	// any writer such as a rotating file.
+	golog.SetPrimaryCore(zapcore.NewCore(encoder, zapcore.AddSync(out), zapcore.DebugLevel))
+	zap.RedirectStdLog(Logger.Desugar())
+	return nil
+}
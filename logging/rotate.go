@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RotatingFile is a log file which is rotated once it grows past a
+// maximum size. Rotated files are kept next to the log as path.1
+// (newest) up to path.N (oldest) and the oldest is removed once more
+// than N files exist. Existing logs are appended to so they survive
+// restarts.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	stderr bool
+}
+
+// OpenRotating opens the log file at path for appending, creating it
+// and its directory if necessary.
+func OpenRotating(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	result := RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	err = result.open()
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Write appends p to the log, rotating it first if p would push it past
+// its maximum size.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Logs which can't be rotated keep growing and rotating them is
+	// tried again on the next write.
+	if r.file != nil && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		r.rotate()
+	}
+	if r.file == nil {
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Sync flushes the log to disk.
+func (r *RotatingFile) Sync() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+// Close closes the log.
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// CaptureStderr sends everything the process writes to stderr, such as
+// panics, to the log from now on, following it as it's rotated.
+func (r *RotatingFile) CaptureStderr() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stderr = true
+	if r.file == nil {
+		return nil
+	}
+	return redirectStderr(r.file)
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+
+	// The log is still written to if stderr can't follow it.
+	if r.stderr {
+		redirectStderr(f)
+	}
+	return nil
+}
+
+// rotate shifts the log and every rotated file along by one and starts
+// a new empty log. The log is left closed if it can't be rotated.
+func (r *RotatingFile) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return err
+	}
+
+	os.Remove(rotated(r.path, r.maxFiles))
+	for i := r.maxFiles - 1; i > 0; i-- {
+		os.Rename(rotated(r.path, i), rotated(r.path, i+1))
+	}
+	if r.maxFiles > 0 {
+		err = os.Rename(r.path, rotated(r.path, 1))
+	} else {
+		err = os.Remove(r.path)
+	}
+	if err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func rotated(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
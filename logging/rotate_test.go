@@ -0,0 +1,137 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readLogs returns the contents of a log and its rotated files, with
+// empty strings for those which don't exist.
+func readLogs(path string, n int) []string {
+	result := make([]string, n+1)
+	for i := range result {
+		p := path
+		if i > 0 {
+			p = rotated(path, i)
+		}
+		in, _ := os.ReadFile(p)
+		result[i] = string(in)
+	}
+	return result
+}
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxFiles int
+		writes   []string
+		want     []string
+	}{
+		{
+			name:     "under the maximum size",
+			maxFiles: 2,
+			writes:   []string{"aaaa\n", "bbbb\n"},
+			want:     []string{"aaaa\nbbbb\n", "", ""},
+		},
+		{
+			name:     "rotated",
+			maxFiles: 2,
+			writes:   []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			want:     []string{"cccc\n", "aaaa\nbbbb\n", ""},
+		},
+		{
+			name:     "oldest removed",
+			maxFiles: 2,
+			writes:   []string{"aaaaaaaaa\n", "bbbbbbbbb\n", "ccccccccc\n", "ddddddddd\n"},
+			want:     []string{"ddddddddd\n", "ccccccccc\n", "bbbbbbbbb\n"},
+		},
+		{
+			name:     "no rotated files",
+			maxFiles: 0,
+			writes:   []string{"aaaaaaaaa\n", "bbbbbbbbb\n"},
+			want:     []string{"bbbbbbbbb\n"},
+		},
+		{
+			name:     "larger than the maximum size",
+			maxFiles: 1,
+			writes:   []string{"aaaaaaaaaaaaaaa\n", "b\n"},
+			want:     []string{"b\n", "aaaaaaaaaaaaaaa\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log", "hs0.log")
+			r, err := OpenRotating(path, 10, tt.maxFiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.writes {
+				if _, err := r.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got := readLogs(path, tt.maxFiles+1)
+			want := append(tt.want, "")
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("file %d holds %q, want %q", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hs0.log")
+	if err := os.WriteFile(path, []byte("aaaaaaaa\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing logs are appended to and count towards the size.
+	r, err := OpenRotating(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.Write([]byte("bbbb\n"))
+	got := readLogs(path, 1)
+	if got[0] != "bbbb\n" || got[1] != "aaaaaaaa\n" {
+		t.Errorf("got logs %q", got)
+	}
+}
+
+func TestRotatingFileReopens(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hs0.log")
+	r, err := OpenRotating(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.Write([]byte("aaaaaaaa\n"))
+
+	// A directory in the way of the rotated log stops rotation, but
+	// the log is still written to.
+	if err := os.MkdirAll(filepath.Join(rotated(path, 1), "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("bbbb\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readLogs(path, 0); got[0] != "aaaaaaaa\nbbbb\n" {
+		t.Errorf("got log %q", got[0])
+	}
+
+	// Rotation resumes once it's possible again.
+	os.RemoveAll(rotated(path, 1))
+	r.Write([]byte("cccc\n"))
+	got := readLogs(path, 1)
+	if got[0] != "cccc\n" || got[1] != "aaaaaaaa\nbbbb\n" {
+		t.Errorf("got logs %q", got)
+	}
+}
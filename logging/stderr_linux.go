@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package logging
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// redirectStderr points the process's stderr at f.
+func redirectStderr(f *os.File) error {
+	return unix.Dup3(int(f.Fd()), int(os.Stderr.Fd()), 0)
+}
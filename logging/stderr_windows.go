@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package logging
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// redirectStderr points the process's stderr at f. The runtime looks up
+// the standard error handle each time it writes a panic.
+func redirectStderr(f *os.File) error {
+	return windows.SetStdHandle(windows.STD_ERROR_HANDLE, windows.Handle(f.Fd()))
+}
@@ -0,0 +1,123 @@
+package mcast
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Group forwards packets to a multicast address or range to a set of
+// peers. No peers forwards to every connected peer.
+type Group struct {
+	Network *net.IPNet
+	Peers   []string
+}
+
+// ParseGroup parses a multicast address or range in CIDR notation.
+func ParseGroup(address string, peers []string) (Group, error) {
+	if !strings.Contains(address, "/") {
+		address += "/32"
+	}
+	ip, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return Group{}, err
+	}
+	if ip.To4() == nil || !ip.IsMulticast() {
+		return Group{}, fmt.Errorf("%s is not an ipv4 multicast address", address)
+	}
+	return Group{Network: network, Peers: peers}, nil
+}
+
+// Table decides which peers broadcast and multicast packets are
+// forwarded to, and suppresses packets it has already seen within a
+// window so they don't loop or arrive twice.
+type Table struct {
+	broadcast []net.IP
+	groups    []Group
+	window    time.Duration
+
+	lock  sync.Mutex
+	seen  map[uint64]time.Time
+	clean time.Time
+}
+
+// NewTable creates a table forwarding packets to the broadcast
+// addresses to every connected peer and packets to the groups to their
+// peers.
+func NewTable(broadcast []net.IP, groups []Group, window time.Duration) *Table {
+	return &Table{
+		broadcast: broadcast,
+		groups:    groups,
+		window:    window,
+		seen:      make(map[uint64]time.Time),
+	}
+}
+
+// Broadcast returns the limited broadcast address and the directed
+// broadcast address of a subnet in CIDR notation.
+func Broadcast(cidr string) ([]net.IP, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip := network.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%s is not an ipv4 subnet", cidr)
+	}
+	directed := make(net.IP, net.IPv4len)
+	for i := range ip {
+		directed[i] = ip[i] | ^network.Mask[i]
+	}
+	return []net.IP{net.IPv4bcast, directed}, nil
+}
+
+// Peers returns the peers a packet to dst is forwarded to. Nil peers
+// means every connected peer. It reports false if packets to dst
+// aren't forwarded at all.
+func (t *Table) Peers(dst net.IP) ([]string, bool) {
+	for _, b := range t.broadcast {
+		if b.Equal(dst) {
+			return nil, true
+		}
+	}
+	for _, g := range t.groups {
+		if g.Network.Contains(dst) {
+			return g.Peers, true
+		}
+	}
+	return nil, false
+}
+
+// Duplicate reports whether the same IPv4 packet has passed through the
+// table within its window, and remembers it otherwise. The TTL and
+// header checksum are ignored as they change along the way.
+func (t *Table) Duplicate(packet []byte) bool {
+	h := fnv.New64a()
+	h.Write(packet[:8])
+	h.Write(packet[9:10])
+	h.Write(packet[12:])
+	key := h.Sum64()
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Forget old packets every so often.
+	if now.Sub(t.clean) > t.window {
+		for k, seen := range t.seen {
+			if now.Sub(seen) > t.window {
+				delete(t.seen, k)
+			}
+		}
+		t.clean = now
+	}
+
+	if seen, ok := t.seen[key]; ok && now.Sub(seen) <= t.window {
+		return true
+	}
+	t.seen[key] = now
+	return false
+}
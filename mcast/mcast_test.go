@@ -0,0 +1,86 @@
+package mcast
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseGroup(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"224.0.0.251", "224.0.0.251/32", true},
+		{"239.0.0.0/8", "239.0.0.0/8", true},
+		{"10.1.1.1", "", false},
+		{"ff02::fb", "", false},
+		{"239.0.0.0/40", "", false},
+	}
+	for _, tt := range tests {
+		g, err := ParseGroup(tt.in, nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseGroup(%q) got error %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && g.Network.String() != tt.want {
+			t.Errorf("ParseGroup(%q) = %s, want %s", tt.in, g.Network, tt.want)
+		}
+	}
+}
+
+func TestPeers(t *testing.T) {
+	broadcast, err := Broadcast("10.1.1.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdns, _ := ParseGroup("224.0.0.251", []string{"10.1.1.2"})
+	site, _ := ParseGroup("239.0.0.0/8", nil)
+	table := NewTable(broadcast, []Group{mdns, site}, time.Second)
+
+	tests := []struct {
+		dst   string
+		peers []string
+		ok    bool
+	}{
+		{"255.255.255.255", nil, true},
+		{"10.1.1.255", nil, true},
+		{"224.0.0.251", []string{"10.1.1.2"}, true},
+		{"239.1.2.3", nil, true},
+		{"224.0.0.1", nil, false},
+		{"10.1.1.2", nil, false},
+	}
+	for _, tt := range tests {
+		peers, ok := table.Peers(net.ParseIP(tt.dst))
+		if ok != tt.ok || len(peers) != len(tt.peers) || (len(peers) > 0 && peers[0] != tt.peers[0]) {
+			t.Errorf("Peers(%s) = %v, %v, want %v, %v", tt.dst, peers, ok, tt.peers, tt.ok)
+		}
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	table := NewTable(nil, nil, time.Hour)
+	packet := []byte{
+		0x45, 0, 0, 28, 0, 1, 0, 0, 64, 17, 0, 0,
+		10, 1, 1, 1, 224, 0, 0, 251,
+		0x14, 0xe9, 0x14, 0xe9, 0, 8, 0, 0,
+	}
+	if table.Duplicate(packet) {
+		t.Fatal("first packet is a duplicate")
+	}
+
+	// The same packet with a lower TTL and another checksum is still a
+	// duplicate.
+	relayed := append([]byte(nil), packet...)
+	relayed[8], relayed[10] = 63, 0xff
+	if !table.Duplicate(relayed) {
+		t.Error("relayed packet isn't a duplicate")
+	}
+
+	other := append([]byte(nil), packet...)
+	other[5] = 2
+	if table.Duplicate(other) {
+		t.Error("packet with another id is a duplicate")
+	}
+}
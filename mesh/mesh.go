@@ -0,0 +1,136 @@
+package mesh
+
+import (
+	"sync"
+	"time"
+)
+
+// Route announces that a peer can be reached through the announcing
+// peer with Hops other peers relaying in between.
+type Route struct {
+	Peer string `json:"peer"`
+	Hops int    `json:"hops"`
+}
+
+// Table tracks which peers can be reached through each neighbour from
+// the routes they announce. Routes expire unless they're announced
+// again within the table's TTL.
+type Table struct {
+	maxHops int
+	ttl     time.Duration
+
+	lock    sync.RWMutex
+	learned map[string]learned
+}
+
+// learned holds the number of relays to each peer through a neighbour.
+type learned struct {
+	hops map[string]int
+	at   time.Time
+}
+
+// NewTable creates an empty table which ignores routes needing more
+// than maxHops relays.
+func NewTable(maxHops int, ttl time.Duration) *Table {
+	return &Table{
+		maxHops: maxHops,
+		ttl:     ttl,
+		learned: make(map[string]learned),
+	}
+}
+
+// Update replaces the routes learned from neighbour via.
+func (t *Table) Update(via string, routes []Route) {
+	hops := make(map[string]int, len(routes))
+	for _, r := range routes {
+		// Reaching a peer through via takes one more relay than via
+		// needs itself.
+		n := r.Hops + 1
+		if r.Peer == via || r.Hops < 0 || n > t.maxHops {
+			continue
+		}
+		if old, ok := hops[r.Peer]; !ok || n < old {
+			hops[r.Peer] = n
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.learned[via] = learned{hops: hops, at: time.Now()}
+}
+
+// Forget removes the routes learned from neighbour via.
+func (t *Table) Forget(via string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.learned, via)
+}
+
+// Next returns the neighbour to send packets for dst through, which is
+// the usable neighbour reaching it with the fewest relays.
+func (t *Table) Next(dst string, usable func(via string) bool) (string, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var best string
+	bestHops := 0
+	for via, l := range t.learned {
+		n, ok := l.hops[dst]
+		if !ok || time.Since(l.at) > t.ttl {
+			continue
+		}
+		// Break ties the same way every time so flows stay on a path.
+		if best != "" && (n > bestHops || (n == bestHops && via > best)) {
+			continue
+		}
+		if usable(via) {
+			best, bestHops = via, n
+		}
+	}
+	return best, best != ""
+}
+
+// Reaches reports whether neighbour via announced a route to dst which
+// is still current.
+func (t *Table) Reaches(via string, dst string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	l, ok := t.learned[via]
+	if !ok || time.Since(l.at) > t.ttl {
+		return false
+	}
+	_, ok = l.hops[dst]
+	return ok
+}
+
+// Announce returns the routes to announce to neighbour to: the direct
+// peers, and the routes learned from other neighbours. Routes learned
+// from to itself aren't announced back to it so routes can't loop
+// between two neighbours.
+func (t *Table) Announce(to string, direct []string) []Route {
+	hops := make(map[string]int)
+	for _, p := range direct {
+		hops[p] = 0
+	}
+
+	t.lock.RLock()
+	for via, l := range t.learned {
+		if via == to || time.Since(l.at) > t.ttl {
+			continue
+		}
+		for p, n := range l.hops {
+			if old, ok := hops[p]; !ok || n < old {
+				hops[p] = n
+			}
+		}
+	}
+	t.lock.RUnlock()
+
+	result := make([]Route, 0, len(hops))
+	for p, n := range hops {
+		if p != to {
+			result = append(result, Route{Peer: p, Hops: n})
+		}
+	}
+	return result
+}
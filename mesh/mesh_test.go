@@ -0,0 +1,112 @@
+package mesh
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	table := NewTable(3, time.Minute)
+	table.Update("b", []Route{{Peer: "d", Hops: 1}, {Peer: "e", Hops: 0}, {Peer: "b", Hops: 0}})
+	table.Update("c", []Route{{Peer: "d", Hops: 0}, {Peer: "e", Hops: 0}, {Peer: "f", Hops: 2}, {Peer: "g", Hops: 3}})
+
+	all := func(string) bool { return true }
+	tests := []struct {
+		name   string
+		dst    string
+		usable func(string) bool
+		via    string
+		ok     bool
+	}{
+		{"fewest relays", "d", all, "c", true},
+		{"ties broken by neighbour", "e", all, "b", true},
+		{"unusable neighbour skipped", "d", func(via string) bool { return via != "c" }, "b", true},
+		{"at the hop limit", "f", all, "c", true},
+		{"past the hop limit", "g", all, "", false},
+		{"neighbour itself", "b", all, "", false},
+		{"unknown peer", "h", all, "", false},
+		{"nothing usable", "d", func(string) bool { return false }, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			via, ok := table.Next(tt.dst, tt.usable)
+			if via != tt.via || ok != tt.ok {
+				t.Errorf("got %q, %v, want %q, %v", via, ok, tt.via, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReaches(t *testing.T) {
+	table := NewTable(3, time.Minute)
+	table.Update("b", []Route{{Peer: "d", Hops: 0}})
+	if !table.Reaches("b", "d") {
+		t.Error("announced route not found")
+	}
+	if table.Reaches("c", "d") || table.Reaches("b", "e") {
+		t.Error("route found which wasn't announced")
+	}
+	table.Forget("b")
+	if table.Reaches("b", "d") {
+		t.Error("forgotten route found")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	table := NewTable(3, -time.Second)
+	table.Update("b", []Route{{Peer: "d", Hops: 0}})
+	if _, ok := table.Next("d", func(string) bool { return true }); ok {
+		t.Error("expired route used")
+	}
+	if table.Reaches("b", "d") || len(table.Announce("c", nil)) != 0 {
+		t.Error("expired route announced")
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	table := NewTable(3, time.Minute)
+	table.Update("b", []Route{{Peer: "d", Hops: 0}, {Peer: "e", Hops: 1}})
+	table.Update("c", []Route{{Peer: "e", Hops: 0}})
+
+	tests := []struct {
+		name   string
+		to     string
+		direct []string
+		want   []Route
+	}{
+		{
+			name:   "learned routes",
+			to:     "x",
+			direct: []string{"b", "c"},
+			want:   []Route{{"b", 0}, {"c", 0}, {"d", 1}, {"e", 1}},
+		},
+		{
+			// Routes learned from a neighbour aren't announced back to it.
+			name:   "split horizon",
+			to:     "c",
+			direct: []string{"b", "c"},
+			want:   []Route{{"b", 0}, {"d", 1}, {"e", 2}},
+		},
+		{
+			name:   "direct peers preferred",
+			to:     "x",
+			direct: []string{"d"},
+			want:   []Route{{"d", 0}, {"e", 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := table.Announce(tt.to, tt.direct)
+			sort.Slice(got, func(i, j int) bool { return got[i].Peer < got[j].Peer })
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
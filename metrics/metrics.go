@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes the names of all Hyprspace metrics.
+const Namespace = "hyprspace"
+
+// Reasons a packet is dropped.
+const (
+	DropFirewall    = "firewall"
+	DropRateLimit   = "rate_limit"
+	DropQuota       = "quota"
+	DropNoPeer      = "no_peer"
+	DropStreamError = "stream_error"
+	DropTUNError    = "tun_error"
+	DropQueueFull   = "queue_full"
+	DropDuplicate   = "duplicate"
+	DropHopLimit    = "hop_limit"
+	DropSpoofed     = "spoofed"
+)
+
+var (
+	// RxBytes counts the bytes received from each peer.
+	RxBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "peer_rx_bytes_total",
+		Help:      "Bytes received from a peer.",
+	}, []string{"peer"})
+
+	// TxBytes counts the bytes sent to each peer.
+	TxBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "peer_tx_bytes_total",
+		Help:      "Bytes sent to a peer.",
+	}, []string{"peer"})
+
+	// RxPackets counts the packets received from each peer.
+	RxPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "peer_rx_packets_total",
+		Help:      "Packets received from a peer.",
+	}, []string{"peer"})
+
+	// TxPackets counts the packets sent to each peer.
+	TxPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "peer_tx_packets_total",
+		Help:      "Packets sent to a peer.",
+	}, []string{"peer"})
+
+	// Drops counts the packets dropped by reason.
+	Drops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "dropped_packets_total",
+		Help:      "Packets dropped by reason.",
+	}, []string{"reason"})
+
+	// StreamOpenFailures counts failed attempts to open a stream to each peer.
+	StreamOpenFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "stream_open_failures_total",
+		Help:      "Failed attempts to open a stream to a peer.",
+	}, []string{"peer"})
+
+	// DiscoverLookups counts DHT lookups of peers by result.
+	DiscoverLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "discover_lookups_total",
+		Help:      "DHT lookups of peers by result.",
+	}, []string{"result"})
+
+	// DiscoverLatency measures how long DHT lookups of peers take.
+	DiscoverLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "discover_lookup_seconds",
+		Help:      "Time taken by DHT lookups of peers.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+)
+
+// Registry holds all Hyprspace metrics.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		RxBytes,
+		TxBytes,
+		RxPackets,
+		TxPackets,
+		Drops,
+		StreamOpenFailures,
+		DiscoverLookups,
+		DiscoverLatency,
+	)
+}
+
+// Serve exports the metrics for Prometheus over http at address.
+// Listening errors are returned before any request is served.
+func Serve(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	go http.Serve(ln, mux)
+	return nil
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "peer_connected"),
+		"Whether a peer is currently connected.",
+		[]string{"peer"}, nil,
+	)
+	connectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "", "peer_connections"),
+		"Open connections to a peer by transport.",
+		[]string{"peer", "transport"}, nil,
+	)
+)
+
+// peerCollector reports the connection state of peers when scraped.
+type peerCollector struct {
+	node  host.Host
+	peers map[string]peer.ID
+}
+
+// RegisterPeers exports the connection state and transports of the
+// peers in peerTable, keyed by their address.
+func RegisterPeers(node host.Host, peerTable map[string]peer.ID) error {
+	return Registry.Register(&peerCollector{node: node, peers: peerTable})
+}
+
+func (c *peerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectedDesc
+	ch <- connectionsDesc
+}
+
+func (c *peerCollector) Collect(ch chan<- prometheus.Metric) {
+	for ip, id := range c.peers {
+		connected := 0.0
+		if c.node.Network().Connectedness(id) == network.Connected {
+			connected = 1
+		}
+		ch <- prometheus.MustNewConstMetric(connectedDesc, prometheus.GaugeValue, connected, ip)
+
+		counts := map[string]float64{"quic": 0, "tcp": 0, "relay": 0}
+		for _, conn := range c.node.Network().ConnsToPeer(id) {
+			counts[Transport(conn.RemoteMultiaddr())]++
+		}
+		for transport, n := range counts {
+			ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, n, ip, transport)
+		}
+	}
+}
+
+// Transport names the transport used by a connection to addr.
+func Transport(addr ma.Multiaddr) string {
+	result := "other"
+	ma.ForEach(addr, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_CIRCUIT:
+			result = "relay"
+			return false
+		case ma.P_QUIC:
+			result = "quic"
+		case ma.P_TCP:
+			if result != "quic" {
+				result = "tcp"
+			}
+		}
+		return true
+	})
+	return result
+}
@@ -0,0 +1,182 @@
+//go:build linux
+// +build linux
+
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// nicID is the ID of the only NIC of a stack.
+const nicID = 1
+
+// queueSize is the number of packets a stack holds for the device to
+// be read before it drops them.
+const queueSize = 1024
+
+// Stack is a device backed by a TCP/IP stack running in userspace
+// instead of a system interface, so it needs no privileges. Packets
+// written to the device are delivered to the stack and packets the
+// stack sends are read from it. Connections through the stack to
+// other addresses are opened with Dial.
+type Stack struct {
+	name  string
+	mtu   int
+	stack *stack.Stack
+	ep    *channel.Endpoint
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New creates a userspace stack with an IPv4 address in CIDR
+// notation. Packets to any other address are routed through the
+// device.
+func New(name string, mtu int, address string) (*Stack, error) {
+	ip, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("%s is not an ipv4 address", address)
+	}
+	prefix, _ := network.Mask.Size()
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+		HandleLocal:        true,
+	})
+	sack := tcpip.TCPSACKEnabled(true)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return nil, fmt.Errorf("unable to enable tcp sack: %s", err)
+	}
+
+	ep := channel.New(queueSize, uint32(mtu), "")
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		return nil, fmt.Errorf("unable to create nic: %s", err)
+	}
+	addr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.Address(ip.To4()),
+			PrefixLen: prefix,
+		},
+	}
+	if err := s.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); err != nil {
+		return nil, fmt.Errorf("unable to add address %s: %s", address, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Stack{name: name, mtu: mtu, stack: s, ep: ep, ctx: ctx, cancel: cancel}, nil
+}
+
+// Read reads the next packet the stack sends.
+func (n *Stack) Read(p []byte) (int, error) {
+	info, ok := n.ep.ReadContext(n.ctx)
+	if !ok || info.Pkt == nil {
+		return 0, io.EOF
+	}
+	packet := buffer.NewVectorisedView(info.Pkt.Size(), info.Pkt.Views())
+	size := packet.Size()
+	if _, err := packet.Read(p); err != nil {
+		return 0, err
+	}
+	if len(p) < size {
+		return len(p), io.ErrShortBuffer
+	}
+	return size, nil
+}
+
+// Write delivers an IPv4 packet to the stack.
+func (n *Stack) Write(p []byte) (int, error) {
+	if n.ctx.Err() != nil {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) == 0 || p[0]>>4 != 4 {
+		return 0, fmt.Errorf("packet is not ipv4")
+	}
+	data := buffer.NewViewFromBytes(p)
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: data.ToVectorisedView(),
+	})
+	n.ep.InjectInbound(ipv4.ProtocolNumber, pkt)
+	return len(p), nil
+}
+
+// Dial opens a TCP connection or connected UDP socket through the
+// stack to an IPv4 address and port. Reads and writes on UDP sockets
+// carry whole datagrams.
+func (n *Stack) Dial(ctx context.Context, proto string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%s is not an ipv4 address", host)
+	}
+	num, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid port", port)
+	}
+	remote := tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(ip), Port: uint16(num)}
+
+	var conn net.Conn
+	switch proto {
+	case "tcp":
+		conn, err = gonet.DialContextTCP(ctx, n.stack, remote, ipv4.ProtocolNumber)
+	case "udp":
+		conn, err = gonet.DialUDP(n.stack, nil, &remote, ipv4.ProtocolNumber)
+	default:
+		return nil, fmt.Errorf("unknown protocol %s", proto)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Close stops the stack, closing its connections. The endpoint's queue
+// is left open as closing connections still sends packets to it.
+func (n *Stack) Close() error {
+	n.cancel()
+	n.stack.Close()
+	return nil
+}
+
+// Name returns the name the device was created with.
+func (n *Stack) Name() string {
+	return n.name
+}
+
+// MTU returns the MTU the device was created with.
+func (n *Stack) MTU() int {
+	return n.mtu
+}
+
+// Up does nothing as userspace stacks are always up.
+func (n *Stack) Up() error {
+	return nil
+}
+
+// Down does nothing as userspace stacks are always up.
+func (n *Stack) Down() error {
+	return nil
+}
@@ -0,0 +1,189 @@
+//go:build linux
+// +build linux
+
+package netstack
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// stackPair creates two userspace stacks on 10.1.1.1 and 10.1.1.2
+// passing packets to each other.
+func stackPair(t *testing.T) (*Stack, *Stack) {
+	t.Helper()
+	a, err := New("hs0", 1420, "10.1.1.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New("hs1", 1420, "10.1.1.2/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	link := func(from *Stack, to *Stack) {
+		buf := make([]byte, 1420)
+		for {
+			n, err := from.Read(buf)
+			if err != nil {
+				return
+			}
+			to.Write(buf[:n])
+		}
+	}
+	go link(a, b)
+	go link(b, a)
+	return a, b
+}
+
+func TestTCP(t *testing.T) {
+	a, b := stackPair(t)
+
+	ln, err := gonet.ListenTCP(b.stack, tcpip.FullAddress{NIC: nicID, Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := a.Dial(ctx, "tcp", "10.1.1.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("got %q back, want %q", buf, "ping")
+	}
+
+	// Nothing listens on other ports, so connections are refused.
+	if _, err := a.Dial(ctx, "tcp", "10.1.1.2:81"); err == nil {
+		t.Error("connected to a port nothing listens on")
+	}
+}
+
+func TestUDP(t *testing.T) {
+	a, b := stackPair(t)
+
+	local := tcpip.FullAddress{NIC: nicID, Port: 53}
+	server, err := gonet.DialUDP(b.stack, &local, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1420)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err := a.Dial(context.Background(), "udp", "10.1.1.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Datagrams keep their boundaries.
+	for _, msg := range []string{"one", "datagram"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1420)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != msg {
+			t.Errorf("got %q back, want %q", buf[:n], msg)
+		}
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	dev, err := New("hs0", 1420, "10.1.1.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	tests := []struct {
+		name    string
+		proto   string
+		address string
+	}{
+		{"no port", "tcp", "10.1.1.2"},
+		{"name", "tcp", "db:80"},
+		{"ipv6", "tcp", "[fd00::2]:80"},
+		{"invalid port", "tcp", "10.1.1.2:http"},
+		{"unknown protocol", "sctp", "10.1.1.2:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := dev.Dial(context.Background(), tt.proto, tt.address); err == nil {
+				t.Errorf("dialed %s %s", tt.proto, tt.address)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	dev, err := New("hs0", 1420, "10.1.1.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the device ends reads already waiting.
+	read := make(chan error, 1)
+	go func() {
+		_, err := dev.Read(make([]byte, 1420))
+		read <- err
+	}()
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-read; err != io.EOF {
+		t.Errorf("read returned %v, want %v", err, io.EOF)
+	}
+	if _, err := dev.Write([]byte{0x45}); err != io.ErrClosedPipe {
+		t.Errorf("write returned %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, address := range []string{"10.1.1.1", "fd00::1/64"} {
+		if _, err := New("hs0", 1420, address); err == nil {
+			t.Errorf("created stack with address %s", address)
+		}
+	}
+}
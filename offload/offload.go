@@ -0,0 +1,357 @@
+package offload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// HeaderLen is the size of the virtio-net header ahead of each packet
+// read from or written to a TUN device with offloads enabled.
+const HeaderLen = 10
+
+// Flags and GSO types of a virtio-net header.
+const (
+	FlagNeedsCsum = 1
+
+	GSONone  = 0
+	GSOTCPv4 = 1
+	GSOECN   = 0x80
+)
+
+// Header is a little endian virtio-net header. It describes how the
+// packet following it has to be checksummed and segmented.
+type Header struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+}
+
+// Decode reads a header from the start of b.
+func Decode(b []byte) Header {
+	return Header{
+		Flags:      b[0],
+		GSOType:    b[1],
+		HdrLen:     binary.LittleEndian.Uint16(b[2:4]),
+		GSOSize:    binary.LittleEndian.Uint16(b[4:6]),
+		CsumStart:  binary.LittleEndian.Uint16(b[6:8]),
+		CsumOffset: binary.LittleEndian.Uint16(b[8:10]),
+	}
+}
+
+// Encode writes the header to the start of b.
+func (h Header) Encode(b []byte) {
+	b[0] = h.Flags
+	b[1] = h.GSOType
+	binary.LittleEndian.PutUint16(b[2:4], h.HdrLen)
+	binary.LittleEndian.PutUint16(b[4:6], h.GSOSize)
+	binary.LittleEndian.PutUint16(b[6:8], h.CsumStart)
+	binary.LittleEndian.PutUint16(b[8:10], h.CsumOffset)
+}
+
+// Segmented reports whether the packet following the header is a large
+// segment which has to be split before it's sent on the wire.
+func (h Header) Segmented() bool {
+	return h.GSOType&^GSOECN != GSONone
+}
+
+// Validate checks a header received from a peer describes either a
+// complete packet or a TCP segment of an IPv4 packet, so it's safe to
+// hand to the kernel.
+func (h Header) Validate(packet []byte) error {
+	if !h.Segmented() {
+		if h.Flags != 0 {
+			return errors.New("unsegmented packet with partial checksum")
+		}
+		return nil
+	}
+	if h.GSOType&^GSOECN != GSOTCPv4 {
+		return fmt.Errorf("unsupported gso type %d", h.GSOType)
+	}
+	ihl, thl, err := tcpv4(packet)
+	if err != nil {
+		return err
+	}
+	if h.Flags != FlagNeedsCsum || int(h.CsumStart) != ihl || h.CsumOffset != 16 {
+		return errors.New("invalid tcp checksum offload")
+	}
+	if h.GSOSize == 0 || int(h.HdrLen) > len(packet) || int(h.HdrLen) < ihl+thl {
+		return errors.New("invalid tcp segmentation offload")
+	}
+	return nil
+}
+
+// Checksum completes the partial checksum of an unsegmented packet
+// and clears the header's flag asking for it.
+func Checksum(h *Header, packet []byte) error {
+	if h.Flags&FlagNeedsCsum == 0 {
+		return nil
+	}
+	start, field := int(h.CsumStart), int(h.CsumStart)+int(h.CsumOffset)
+	if start >= len(packet) || field+2 > len(packet) {
+		return errors.New("checksum offset outside of packet")
+	}
+
+	// The checksum field already holds the sum of the pseudo header.
+	binary.BigEndian.PutUint16(packet[field:], ^fold(sum(0, packet[start:])))
+	h.Flags &^= FlagNeedsCsum
+	return nil
+}
+
+// Segment splits a large TCP segment of an IPv4 packet into packets of
+// at most the header's segment size with complete checksums, passing
+// each to fn. Segments are only valid until fn returns. Packets which
+// aren't segmented are passed to fn as they are once their checksum
+// has been completed.
+func Segment(h Header, packet []byte, fn func(segment []byte) error) error {
+	if !h.Segmented() {
+		err := Checksum(&h, packet)
+		if err != nil {
+			return err
+		}
+		return fn(packet)
+	}
+	if h.GSOType&^GSOECN != GSOTCPv4 {
+		return fmt.Errorf("unsupported gso type %d", h.GSOType)
+	}
+	ihl, thl, err := tcpv4(packet)
+	if err != nil {
+		return err
+	}
+	mss := int(h.GSOSize)
+	if mss == 0 {
+		return errors.New("invalid tcp segmentation offload")
+	}
+
+	hdrLen := ihl + thl
+	payload := packet[hdrLen:]
+	seq := binary.BigEndian.Uint32(packet[ihl+4 : ihl+8])
+	id := binary.BigEndian.Uint16(packet[4:6])
+	flags := packet[ihl+13]
+
+	seg := make([]byte, hdrLen+mss)
+	for i, off := 0, 0; off < len(payload); i, off = i+1, off+mss {
+		n := len(payload) - off
+		if n > mss {
+			n = mss
+		}
+		out := seg[:hdrLen+n]
+		copy(out, packet[:hdrLen])
+		copy(out[hdrLen:], payload[off:off+n])
+
+		// Fix up the IPv4 header of the segment.
+		binary.BigEndian.PutUint16(out[2:4], uint16(len(out)))
+		binary.BigEndian.PutUint16(out[4:6], id+uint16(i))
+		out[10], out[11] = 0, 0
+		binary.BigEndian.PutUint16(out[10:12], ^fold(sum(0, out[:ihl])))
+
+		// Only the first segment keeps CWR and only the last keeps
+		// FIN and PSH.
+		tcp := out[ihl:]
+		binary.BigEndian.PutUint32(tcp[4:8], seq+uint32(off))
+		tcp[13] = flags
+		if i > 0 {
+			tcp[13] &^= 0x80
+		}
+		if off+n < len(payload) {
+			tcp[13] &^= 0x09
+		}
+
+		// Checksum the segment along with its pseudo header.
+		tcp[16], tcp[17] = 0, 0
+		s := sum(0, out[12:20])
+		s += 6 + uint32(len(tcp))
+		binary.BigEndian.PutUint16(tcp[16:18], ^fold(sum(s, tcp)))
+
+		err = fn(out)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TCP flags a segment can have and still be merged with others.
+const (
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// Coalescer merges in-order TCP segments of an IPv4 connection received
+// one packet at a time back into one large segment, so it can be
+// written to a TUN device with offloads enabled in one go. Segments are
+// only merged if splitting them up again gives back the same packets.
+type Coalescer struct {
+	frame  []byte
+	size   int
+	segs   int
+	mss    int
+	hdrLen int
+	next   uint32
+	closed bool
+}
+
+// NewCoalescer creates a coalescer building segments of at most max
+// bytes.
+func NewCoalescer(max int) *Coalescer {
+	return &Coalescer{frame: make([]byte, HeaderLen+max)}
+}
+
+// Add merges a packet into the segment being built and reports whether
+// it could. Packets which don't continue the segment, or can't be
+// merged at all, are left to the caller, which has to flush the segment
+// before writing them to keep packets in order.
+func (c *Coalescer) Add(packet []byte) bool {
+	ihl, thl, ok := mergeable(packet)
+	if !ok {
+		return false
+	}
+	hdrLen := ihl + thl
+	payload := packet[hdrLen:]
+	seq := binary.BigEndian.Uint32(packet[ihl+4 : ihl+8])
+	flags := packet[ihl+13]
+
+	// Start a new segment.
+	if c.segs == 0 {
+		if HeaderLen+len(packet) > len(c.frame) {
+			return false
+		}
+		copy(c.frame[HeaderLen:], packet)
+		c.size, c.segs, c.mss, c.hdrLen = len(packet), 1, len(payload), hdrLen
+		c.next = seq + uint32(len(payload))
+		c.closed = flags&tcpPSH != 0
+		return true
+	}
+
+	// Segments end with a push or a short packet, and each packet has
+	// to follow the previous one of the same connection.
+	cur := c.frame[HeaderLen : HeaderLen+c.size]
+	id := binary.BigEndian.Uint16(cur[4:6])
+	if c.closed || hdrLen != c.hdrLen || seq != c.next || len(payload) > c.mss ||
+		HeaderLen+c.size+len(payload) > len(c.frame) ||
+		binary.BigEndian.Uint16(packet[4:6]) != id+uint16(c.segs) ||
+		!sameFlow(cur, packet, ihl, hdrLen) {
+		return false
+	}
+	copy(c.frame[HeaderLen+c.size:], payload)
+	c.size += len(payload)
+	c.segs++
+	c.next += uint32(len(payload))
+	cur[ihl+13] |= flags & tcpPSH
+	c.closed = flags&tcpPSH != 0 || len(payload) < c.mss
+	return true
+}
+
+// Flush returns the segment built so far preceded by its virtio-net
+// header and starts a new one. It returns nil without a segment. A
+// segment of a single packet is returned as it was added. The frame is
+// only valid until the next call to Add.
+func (c *Coalescer) Flush() []byte {
+	if c.segs == 0 {
+		return nil
+	}
+	frame := c.frame[:HeaderLen+c.size]
+	packet := frame[HeaderLen:]
+	var hdr Header
+	if c.segs > 1 {
+		ihl := int(packet[0]&0x0f) * 4
+		binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+		packet[10], packet[11] = 0, 0
+		binary.BigEndian.PutUint16(packet[10:12], ^fold(sum(0, packet[:ihl])))
+
+		// Leave the sum of the pseudo header in the checksum field for
+		// the kernel to complete.
+		tcp := packet[ihl:]
+		binary.BigEndian.PutUint16(tcp[16:18], fold(sum(0, packet[12:20])+6+uint32(len(tcp))))
+		hdr = Header{
+			Flags:      FlagNeedsCsum,
+			GSOType:    GSOTCPv4,
+			HdrLen:     uint16(c.hdrLen),
+			GSOSize:    uint16(c.mss),
+			CsumStart:  uint16(ihl),
+			CsumOffset: 16,
+		}
+	}
+	hdr.Encode(frame)
+	c.segs = 0
+	return frame
+}
+
+// mergeable returns the header lengths of an unfragmented IPv4 packet
+// carrying data on a TCP connection, with nothing but ACK and PSH set
+// and a valid checksum, which can be merged with others.
+func mergeable(packet []byte) (int, int, bool) {
+	ihl, thl, err := tcpv4(packet)
+	if err != nil || int(binary.BigEndian.Uint16(packet[2:4])) != len(packet) ||
+		binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 || ihl+thl == len(packet) {
+		return 0, 0, false
+	}
+	flags := packet[ihl+13]
+	if flags&tcpACK == 0 || flags&^(tcpACK|tcpPSH) != 0 {
+		return 0, 0, false
+	}
+
+	// The kernel trusts merged segments, so check each packet's
+	// checksum as it would have.
+	tcp := packet[ihl:]
+	s := sum(0, packet[12:20]) + 6 + uint32(len(tcp))
+	if fold(sum(s, tcp)) != 0xffff {
+		return 0, 0, false
+	}
+	return ihl, thl, true
+}
+
+// sameFlow reports whether two packets with the same header lengths
+// belong to the same connection and have the same headers apart from
+// the fields which change between segments.
+func sameFlow(a []byte, b []byte, ihl int, hdrLen int) bool {
+	ta, tb := a[ihl:], b[ihl:]
+	return bytes.Equal(a[0:2], b[0:2]) &&
+		bytes.Equal(a[6:10], b[6:10]) &&
+		bytes.Equal(a[12:ihl], b[12:ihl]) &&
+		bytes.Equal(ta[0:4], tb[0:4]) &&
+		bytes.Equal(ta[8:13], tb[8:13]) &&
+		ta[13]&^tcpPSH == tb[13]&^tcpPSH &&
+		bytes.Equal(ta[14:16], tb[14:16]) &&
+		bytes.Equal(ta[18:hdrLen-ihl], tb[18:hdrLen-ihl])
+}
+
+// tcpv4 returns the header lengths of an IPv4 packet carrying TCP.
+func tcpv4(packet []byte) (int, int, error) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return 0, 0, errors.New("not an ipv4 packet")
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	if ihl < 20 || packet[9] != 6 || len(packet) < ihl+20 {
+		return 0, 0, errors.New("not a tcp packet")
+	}
+	thl := int(packet[ihl+12]>>4) * 4
+	if thl < 20 || len(packet) < ihl+thl {
+		return 0, 0, errors.New("invalid tcp header")
+	}
+	return ihl, thl, nil
+}
+
+// sum adds b to an internet checksum as big endian 16 bit words.
+func sum(s uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		s += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+// fold folds a 32 bit sum into a 16 bit internet checksum.
+func fold(s uint32) uint16 {
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
@@ -0,0 +1,259 @@
+package offload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// tcpPacket builds an IPv4 packet carrying a TCP segment with complete
+// checksums.
+func tcpPacket(id uint16, seq uint32, flags byte, payload []byte) []byte {
+	packet := make([]byte, 40+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:6], id)
+	packet[6] = 0x40
+	packet[8] = 64
+	packet[9] = 6
+	copy(packet[12:16], []byte{10, 1, 1, 1})
+	copy(packet[16:20], []byte{10, 1, 1, 2})
+	binary.BigEndian.PutUint16(packet[10:12], ^fold(sum(0, packet[:20])))
+
+	tcp := packet[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 22)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], 7)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 512)
+	copy(tcp[20:], payload)
+	checksum(packet)
+	return packet
+}
+
+// checksum completes the TCP checksum of a packet.
+func checksum(packet []byte) {
+	tcp := packet[20:]
+	tcp[16], tcp[17] = 0, 0
+	s := sum(0, packet[12:20]) + 6 + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:18], ^fold(sum(s, tcp)))
+}
+
+// payload returns n bytes of data starting at seq.
+func payload(seq int, n int) []byte {
+	result := make([]byte, n)
+	for i := range result {
+		result[i] = byte(seq + i)
+	}
+	return result
+}
+
+// gsoHeader is the header of a large TCP segment with the given segment
+// size.
+func gsoHeader(mss int) Header {
+	return Header{
+		Flags:      FlagNeedsCsum,
+		GSOType:    GSOTCPv4,
+		HdrLen:     40,
+		GSOSize:    uint16(mss),
+		CsumStart:  20,
+		CsumOffset: 16,
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	want := tcpPacket(1, 100, tcpACK, payload(100, 33))
+
+	// The checksum field holds the sum of the pseudo header.
+	packet := append([]byte(nil), want...)
+	binary.BigEndian.PutUint16(packet[36:38], fold(sum(0, packet[12:20])+6+uint32(len(packet)-20)))
+	h := Header{Flags: FlagNeedsCsum, CsumStart: 20, CsumOffset: 16}
+	if err := Checksum(&h, packet); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, want) {
+		t.Errorf("got checksum %x, want %x", packet[36:38], want[36:38])
+	}
+	if h.Flags != 0 {
+		t.Errorf("flags %d left after completing the checksum", h.Flags)
+	}
+
+	// Packets without a partial checksum are left alone.
+	h = Header{}
+	if err := Checksum(&h, packet); err != nil || !bytes.Equal(packet, want) {
+		t.Errorf("packet changed without a partial checksum: %v", err)
+	}
+
+	h = Header{Flags: FlagNeedsCsum, CsumStart: 20, CsumOffset: uint16(len(packet))}
+	if err := Checksum(&h, packet); err == nil {
+		t.Error("checksum outside of packet accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	packet := tcpPacket(1, 100, tcpACK, payload(100, 3000))
+	udp := append([]byte(nil), packet...)
+	udp[9] = 17
+	tests := []struct {
+		name   string
+		hdr    func(h *Header)
+		packet []byte
+		ok     bool
+	}{
+		{"complete packet", func(h *Header) { *h = Header{} }, packet, true},
+		{"partial checksum without segmentation", func(h *Header) { *h = Header{Flags: FlagNeedsCsum} }, packet, false},
+		{"tcp segment", func(h *Header) {}, packet, true},
+		{"tcp segment with ecn", func(h *Header) { h.GSOType |= GSOECN }, packet, true},
+		{"udp segmentation", func(h *Header) { h.GSOType = 3 }, packet, false},
+		{"tcp segment of udp packet", func(h *Header) {}, udp, false},
+		{"no checksum", func(h *Header) { h.Flags = 0 }, packet, false},
+		{"checksum elsewhere", func(h *Header) { h.CsumStart = 24 }, packet, false},
+		{"checksum offset", func(h *Header) { h.CsumOffset = 6 }, packet, false},
+		{"no segment size", func(h *Header) { h.GSOSize = 0 }, packet, false},
+		{"headers past packet", func(h *Header) { h.HdrLen = uint16(len(packet) + 1) }, packet, false},
+		{"headers too short", func(h *Header) { h.HdrLen = 30 }, packet, false},
+		{"truncated", func(h *Header) {}, packet[:30], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := gsoHeader(1000)
+			tt.hdr(&h)
+			err := h.Validate(tt.packet)
+			if (err == nil) != tt.ok {
+				t.Errorf("got error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSegment(t *testing.T) {
+	large := tcpPacket(9, 1000, tcpACK|tcpPSH, payload(1000, 2500))
+	var got [][]byte
+	err := Segment(gsoHeader(1000), large, func(segment []byte) error {
+		got = append(got, append([]byte(nil), segment...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Segments carry consecutive ids and sequence numbers and only the
+	// last one pushes.
+	want := [][]byte{
+		tcpPacket(9, 1000, tcpACK, payload(1000, 1000)),
+		tcpPacket(10, 2000, tcpACK, payload(2000, 1000)),
+		tcpPacket(11, 3000, tcpACK|tcpPSH, payload(3000, 500)),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("segment %d is\n%x\nwant\n%x", i, got[i], want[i])
+		}
+	}
+
+	// Unsegmented packets are passed on once checksummed.
+	small := tcpPacket(1, 1, tcpACK, payload(1, 10))
+	n := 0
+	err = Segment(Header{}, small, func(segment []byte) error {
+		n++
+		if !bytes.Equal(segment, small) {
+			t.Error("unsegmented packet changed")
+		}
+		return nil
+	})
+	if err != nil || n != 1 {
+		t.Errorf("got %d packets and error %v, want 1 packet", n, err)
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	seg := func(i int, flags byte, n int) []byte {
+		return tcpPacket(uint16(5+i), uint32(1000+1000*i), flags, payload(1000+1000*i, n))
+	}
+	other := seg(1, tcpACK, 1000)
+	binary.BigEndian.PutUint16(other[20:22], 40001)
+	checksum(other)
+	reorder := tcpPacket(7, 2000, tcpACK, payload(2000, 1000))
+	corrupt := seg(1, tcpACK, 1000)
+	corrupt[100]++
+	tests := []struct {
+		name    string
+		packets [][]byte
+		want    []int
+	}{
+		{"in order", [][]byte{seg(0, tcpACK, 1000), seg(1, tcpACK, 1000), seg(2, tcpACK|tcpPSH, 400)}, []int{3}},
+		{"single packet", [][]byte{seg(0, tcpACK, 1000)}, []int{1}},
+		{"push ends segment", [][]byte{seg(0, tcpACK|tcpPSH, 1000), seg(1, tcpACK, 1000)}, []int{1, 1}},
+		{"short packet ends segment", [][]byte{seg(0, tcpACK, 1000), seg(1, tcpACK, 500), seg(2, tcpACK, 1000)}, []int{2, 1}},
+		{"larger packet", [][]byte{seg(0, tcpACK, 500), seg(1, tcpACK, 1000)}, []int{1, 1}},
+		{"other connection", [][]byte{seg(0, tcpACK, 1000), other}, []int{1, 1}},
+		{"out of order", [][]byte{seg(0, tcpACK, 1000), seg(2, tcpACK, 1000)}, []int{1, 1}},
+		{"ids out of order", [][]byte{seg(0, tcpACK, 1000), reorder}, []int{1, 1}},
+		{"bad checksum", [][]byte{seg(0, tcpACK, 1000), corrupt}, []int{1, 0}},
+		{"syn", [][]byte{seg(0, tcpACK|0x02, 1000)}, []int{0}},
+		{"no data", [][]byte{seg(0, tcpACK, 0)}, []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCoalescer(65535)
+
+			// Feed packets in the way the receiver does, flushing before
+			// those which can't be merged, and split what comes out.
+			var got []int
+			var out [][]byte
+			emit := func(frame []byte) {
+				if frame == nil {
+					return
+				}
+				h := Decode(frame)
+				if err := h.Validate(frame[HeaderLen:]); err != nil {
+					t.Fatalf("invalid segment: %v", err)
+				}
+				n := 0
+				err := Segment(h, frame[HeaderLen:], func(segment []byte) error {
+					n++
+					out = append(out, append([]byte(nil), segment...))
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, n)
+			}
+			for _, p := range tt.packets {
+				if c.Add(p) {
+					continue
+				}
+				emit(c.Flush())
+				if !c.Add(p) {
+					got = append(got, 0)
+					out = append(out, p)
+				}
+			}
+			emit(c.Flush())
+			if c.Flush() != nil {
+				t.Error("flushed segment twice")
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got segments of %v packets, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got segments of %v packets, want %v", got, tt.want)
+				}
+			}
+
+			// Splitting merged segments gives back the same packets.
+			for i, p := range tt.packets {
+				if !bytes.Equal(out[i], p) {
+					t.Errorf("packet %d is\n%x\nwant\n%x", i, out[i], p)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/hyprspace/hyprspace/metrics"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -22,10 +23,14 @@ func Discover(ctx context.Context, h host.Host, dht *dht.IpfsDHT, peerTable map[
 		case <-ticker.C:
 			for _, id := range peerTable {
 				if h.Network().Connectedness(id) != network.Connected {
+					start := time.Now()
 					addrs, err := dht.FindPeer(ctx, id)
+					metrics.DiscoverLatency.Observe(time.Since(start).Seconds())
 					if err != nil {
+						metrics.DiscoverLookups.WithLabelValues("failure").Inc()
 						continue
 					}
+					metrics.DiscoverLookups.WithLabelValues("success").Inc()
 					_, err = h.Network().DialPeer(ctx, addrs.ID)
 					if err != nil {
 						continue
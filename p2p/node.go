@@ -21,6 +21,29 @@ import (
 // Protocol is a descriptor for the Hyprspace P2P Protocol.
 const Protocol = "/hyprspace/0.0.1"
 
+// OffloadProtocol is a descriptor for the Hyprspace P2P Protocol with
+// a virtio-net header ahead of each packet, which lets large TCP
+// segments cross the network in one piece.
+const OffloadProtocol = "/hyprspace/offload/0.0.1"
+
+// ForwardProtocol is a descriptor for the Hyprspace port forwarding
+// protocol, which carries connections to a peer's local ports.
+const ForwardProtocol = "/hyprspace/forward/0.0.1"
+
+// RoutesProtocol is a descriptor for the Hyprspace mesh routing
+// protocol, which announces the peers a peer can relay packets to.
+const RoutesProtocol = "/hyprspace/routes/0.0.1"
+
+// RelayProtocol is a descriptor for the Hyprspace P2P Protocol with a
+// hop limit ahead of each packet, which carries packets relayed
+// between peers with no direct connection.
+const RelayProtocol = "/hyprspace/relay/0.0.1"
+
+// SubnetsProtocol is a descriptor for the Hyprspace subnet protocol,
+// which carries the signed advertisements of the subnets a gateway
+// routes to.
+const SubnetsProtocol = "/hyprspace/subnets/0.0.1"
+
 // CreateNode creates an internal Libp2p nodes and returns it and it's DHT Discovery service.
 func CreateNode(ctx context.Context, inputKey string, port int, handler network.StreamHandler) (node host.Host, dhtOut *dht.IpfsDHT, err error) {
 	// Unmarshal Private Key
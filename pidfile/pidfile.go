@@ -0,0 +1,207 @@
+package pidfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockRetries and lockDelay bound how long Acquire waits for a lock
+// which is only held for a moment, as Owner does while it checks for a
+// live daemon.
+const (
+	lockRetries = 10
+	lockDelay   = 10 * time.Millisecond
+)
+
+// ErrNotRunning is returned when no live daemon holds a pidfile.
+var ErrNotRunning = errors.New("daemon is not running")
+
+// RunningError is returned when another live daemon already holds a
+// pidfile.
+type RunningError struct {
+	PID int
+}
+
+func (e *RunningError) Error() string {
+	return fmt.Sprintf("daemon is already running with pid %d", e.PID)
+}
+
+// PIDFile is a file holding the process id of a running daemon. The
+// daemon keeps an advisory lock on the file for as long as it runs so a
+// file left behind by a crashed daemon is never mistaken for a live one.
+type PIDFile struct {
+	path string
+	file *os.File
+}
+
+// Acquire locks the pidfile at path and writes the current process id
+// to it. A stale pidfile left behind by a crashed daemon is taken over.
+// If a live daemon holds the pidfile a *RunningError is returned.
+func Acquire(path string) (*PIDFile, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace the process id of any previous daemon with our own.
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PIDFile{path: path, file: f}, nil
+}
+
+// open opens and locks the pidfile at path. A daemon releasing the
+// pidfile removes it while holding the lock, so the file locked may no
+// longer be the one at path, in which case it's opened again.
+func open(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		err = lockWaiting(f)
+		if err != nil {
+			f.Close()
+			if isLocked(err) {
+				pid, _ := readPID(path)
+				return nil, &RunningError{PID: pid}
+			}
+			return nil, err
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		pi, err := os.Stat(path)
+		if err == nil && os.SameFile(fi, pi) {
+			return f, nil
+		}
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// lockWaiting locks a file, retrying for a little while if another
+// process holds the lock.
+func lockWaiting(f *os.File) error {
+	err := lock(f)
+	for i := 0; i < lockRetries && isLocked(err); i++ {
+		time.Sleep(lockDelay)
+		err = lock(f)
+	}
+	return err
+}
+
+// Release removes the pidfile and drops its lock.
+func (p *PIDFile) Release() error {
+	// Remove the file while still holding the lock so another daemon
+	// can't acquire it in between.
+	err := os.Remove(p.path)
+	cerr := p.file.Close()
+	if err != nil {
+		// Windows can't remove files which are still open.
+		err = os.Remove(p.path)
+	}
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Owner returns the process id of the live daemon holding the pidfile
+// at path. It returns ErrNotRunning if the file doesn't exist or isn't
+// held by a live Hyprspace process.
+func Owner(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrNotRunning
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	// If we can take the lock nobody else holds it. The lock is only
+	// held until the file is closed, and Acquire waits that long for it.
+	err = lock(f)
+	if err == nil {
+		return 0, ErrNotRunning
+	}
+	if !isLocked(err) {
+		return 0, err
+	}
+
+	pid, err := readPID(path)
+	if err != nil {
+		return 0, err
+	}
+	if !alive(pid) {
+		return 0, ErrNotRunning
+	}
+
+	// Make sure the process is actually Hyprspace before anybody
+	// signals it.
+	self, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	exe, err := executable(pid)
+	if err == nil && !sameFile(exe, self) {
+		return 0, fmt.Errorf("pid %d is %s not hyprspace", pid, exe)
+	}
+	return pid, nil
+}
+
+func readPID(path string) (int, error) {
+	in, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(in)))
+	if err != nil {
+		return 0, fmt.Errorf("%s doesn't contain a valid pid", path)
+	}
+	return pid, nil
+}
+
+// sameFile reports whether two executable paths refer to the same
+// program. Linux marks the executable of a process as deleted once it
+// has been replaced, for example by an update.
+func sameFile(a string, b string) bool {
+	a = strings.TrimSuffix(a, " (deleted)")
+	if a == b {
+		return true
+	}
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
@@ -0,0 +1,104 @@
+package pidfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAcquire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "hyprspace.pid")
+
+	p, err := Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := readPID(path); err != nil || pid != os.Getpid() {
+		t.Fatalf("got pid %d (%v), want %d", pid, err, os.Getpid())
+	}
+
+	// A second daemon finds the first one running.
+	_, err = Acquire(path)
+	var running *RunningError
+	if !errors.As(err, &running) || running.PID != os.Getpid() {
+		t.Fatalf("got error %v, want daemon running with pid %d", err, os.Getpid())
+	}
+
+	if err := p.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("pidfile still exists after release: %v", err)
+	}
+
+	// Once released the pidfile can be acquired again.
+	p, err = Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release()
+}
+
+func TestAcquireStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hyprspace.pid")
+	err := os.WriteFile(path, []byte(strconv.Itoa(1<<22)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A pidfile nobody holds is taken over.
+	p, err := Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Release()
+	if pid, _ := readPID(path); pid != os.Getpid() {
+		t.Errorf("got pid %d, want %d", pid, os.Getpid())
+	}
+}
+
+func TestOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hyprspace.pid")
+	if _, err := Owner(path); err != ErrNotRunning {
+		t.Fatalf("got error %v without a pidfile, want %v", err, ErrNotRunning)
+	}
+
+	p, err := Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release()
+	if _, err := Owner(path); err != ErrNotRunning {
+		t.Fatalf("got error %v after release, want %v", err, ErrNotRunning)
+	}
+}
+
+func TestAcquireWhileProbed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hyprspace.pid")
+	err := os.WriteFile(path, []byte(strconv.Itoa(1<<22)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the lock for a moment the way Owner does while probing.
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lock(f); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(3 * lockDelay)
+		f.Close()
+	}()
+
+	p, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("got error %v acquiring a probed pidfile", err)
+	}
+	p.Release()
+}
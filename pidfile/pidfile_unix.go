@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package pidfile
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// errUnsupported is returned when a process's executable can't be found.
+var errUnsupported = errors.New("finding a process's executable is unsupported")
+
+// lock takes an exclusive advisory lock on a file without blocking.
+func lock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// isLocked reports whether a lock error means another process holds the lock.
+func isLocked(err error) bool {
+	return errors.Is(err, syscall.EWOULDBLOCK)
+}
+
+// alive reports whether a process exists.
+func alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// executable returns the path of the program a process is running.
+func executable(pid int) (string, error) {
+	if runtime.GOOS != "linux" {
+		return "", errUnsupported
+	}
+	return os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+}
@@ -0,0 +1,60 @@
+//go:build windows
+// +build windows
+
+package pidfile
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockOffset is where the locked byte lives. It's far past the process
+// id so the file can still be read while it's locked.
+const lockOffset = 1
+
+// lock takes an exclusive lock on a file without blocking.
+func lock(f *os.File) error {
+	ol := windows.Overlapped{OffsetHigh: lockOffset}
+	return windows.LockFileEx(
+		windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0, 1, 0, &ol,
+	)
+}
+
+// isLocked reports whether a lock error means another process holds the lock.
+func isLocked(err error) bool {
+	return errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
+
+// alive reports whether a process exists.
+func alive(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(h)
+
+	var code uint32
+	err = windows.GetExitCodeProcess(h, &code)
+	return err == nil && code == 259 // STILL_ACTIVE
+}
+
+// executable returns the path of the program a process is running.
+func executable(pid int) (string, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return "", err
+	}
+	defer windows.CloseHandle(h)
+
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	err = windows.QueryFullProcessImageName(h, 0, &buf[0], &size)
+	if err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(buf[:size]), nil
+}
@@ -0,0 +1,165 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyprspace/hyprspace/firewall"
+)
+
+// Any is the tag matching every node.
+const Any = "*"
+
+// Services nodes can provide to each other. Exit is the service of
+// routing packets to the subnets a node advertises, and Relay that of
+// relaying packets between peers which can't connect directly.
+const (
+	Exit  = "exit"
+	Relay = "relay"
+)
+
+// Rule allows nodes tagged with any of the From tags to open connections
+// to and use the Services of nodes tagged with any of the To tags.
+// Proto and Ports optionally restrict which connections are allowed.
+// Rules listing only services don't allow any connections.
+type Rule struct {
+	From     []string
+	To       []string
+	Proto    string
+	Ports    []string
+	Services []string
+}
+
+// String describes the rule.
+func (r Rule) String() string {
+	result := strings.Join(r.From, ",") + " -> " + strings.Join(r.To, ",")
+	if r.Proto != "" {
+		result += " " + r.Proto
+		if len(r.Ports) > 0 {
+			result += "/" + strings.Join(r.Ports, ",")
+		}
+	}
+	if len(r.Services) > 0 {
+		result += " [" + strings.Join(r.Services, ",") + "]"
+	}
+	return result
+}
+
+// Policy evaluates group rules from the point of view of the local node.
+type Policy struct {
+	rules []Rule
+	local []string
+	peers map[string][]string
+}
+
+// New creates a policy for a local node with the given tags. Peers maps
+// the address of each peer to its tags.
+func New(local []string, peers map[string][]string, rules []Rule) (*Policy, error) {
+	for _, r := range rules {
+		for _, s := range r.Services {
+			if s != Exit && s != Relay {
+				return nil, fmt.Errorf("unknown policy service %s", s)
+			}
+		}
+	}
+	return &Policy{
+		rules: rules,
+		local: local,
+		peers: peers,
+	}, nil
+}
+
+// Rules returns the policy's rules.
+func (p *Policy) Rules() []Rule {
+	return p.rules
+}
+
+// FirewallRules returns the firewall rules enforcing which connections
+// the policy allows between the local node and its peers.
+func (p *Policy) FirewallRules() ([]*firewall.Rule, error) {
+	var result []*firewall.Rule
+	for _, r := range p.rules {
+		if len(r.Services) > 0 && r.Proto == "" && len(r.Ports) == 0 {
+			continue
+		}
+
+		// Peers in the From groups may connect to us.
+		if member(p.local, r.To) {
+			if peers := p.members(r.From); len(peers) > 0 {
+				rule, err := firewall.NewRule(peers, "in", r.Proto, r.Ports)
+				if err != nil {
+					return nil, err
+				}
+				rule.Comment = "policy " + r.String()
+				result = append(result, rule)
+			}
+		}
+
+		// We may connect to peers in the To groups.
+		if member(p.local, r.From) {
+			if peers := p.members(r.To); len(peers) > 0 {
+				rule, err := firewall.NewRule(peers, "out", r.Proto, r.Ports)
+				if err != nil {
+					return nil, err
+				}
+				rule.Comment = "policy " + r.String()
+				result = append(result, rule)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Provides reports whether the peer at the given address may use a
+// service provided by the local node.
+func (p *Policy) Provides(service string, peer string) bool {
+	for _, r := range p.rules {
+		if has(r.Services, service) && member(p.local, r.To) && member(p.peers[peer], r.From) {
+			return true
+		}
+	}
+	return false
+}
+
+// Uses reports whether the local node may use a service provided by
+// the peer at the given address.
+func (p *Policy) Uses(service string, peer string) bool {
+	for _, r := range p.rules {
+		if has(r.Services, service) && member(p.local, r.From) && member(p.peers[peer], r.To) {
+			return true
+		}
+	}
+	return false
+}
+
+// members returns the sorted addresses of all peers in any of the groups.
+func (p *Policy) members(groups []string) []string {
+	var result []string
+	for ip, tags := range p.peers {
+		if member(tags, groups) {
+			result = append(result, ip)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// member reports whether a node with the given tags is in any of the groups.
+func member(tags []string, groups []string) bool {
+	for _, g := range groups {
+		if g == Any || has(tags, g) {
+			return true
+		}
+	}
+	return false
+}
+
+func has(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package policy
+
+import (
+	"testing"
+)
+
+func TestFirewallRules(t *testing.T) {
+	peers := map[string][]string{
+		"10.1.1.2": {"laptops"},
+		"10.1.1.3": {"servers"},
+	}
+	rules := []Rule{
+		{From: []string{"laptops"}, To: []string{"servers"}, Proto: "tcp", Ports: []string{"22"}},
+		{From: []string{"servers"}, To: []string{Any}, Services: []string{Relay}},
+		{From: []string{"servers"}, To: []string{"servers"}, Proto: "icmp", Services: []string{Relay}},
+	}
+	p, err := New([]string{"servers"}, peers, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.FirewallRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The services-only rule allows no connections.
+	want := []string{
+		"in 10.1.1.2 tcp/22",
+		"in 10.1.1.3 icmp",
+		"out 10.1.1.3 icmp",
+	}
+	if len(result) != len(want) {
+		t.Fatalf("got %d rules %v, want %v", len(result), result, want)
+	}
+	for i, r := range result {
+		if r.String() != want[i] {
+			t.Errorf("rule %d is %q, want %q", i, r.String(), want[i])
+		}
+	}
+}
+
+func TestServices(t *testing.T) {
+	peers := map[string][]string{
+		"10.1.1.2": {"laptops"},
+		"10.1.1.3": {"servers"},
+	}
+	rules := []Rule{
+		{From: []string{"servers"}, To: []string{Any}, Services: []string{Relay}},
+		{From: []string{"laptops"}, To: []string{"servers"}, Services: []string{Exit}},
+	}
+	p, err := New([]string{"laptops"}, peers, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"provides to servers", p.Provides(Relay, "10.1.1.3"), true},
+		{"provides to laptops", p.Provides(Relay, "10.1.1.2"), false},
+		{"uses servers", p.Uses(Relay, "10.1.1.3"), false},
+		{"provides unknown peer", p.Provides(Relay, "10.1.1.9"), false},
+		{"uses servers as exit", p.Uses(Exit, "10.1.1.3"), true},
+		{"uses laptops as exit", p.Uses(Exit, "10.1.1.2"), false},
+		{"provides exit to servers", p.Provides(Exit, "10.1.1.3"), false},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	_, err = New(nil, peers, []Rule{{From: []string{Any}, To: []string{Any}, Services: []string{"proxy"}}})
+	if err == nil {
+		t.Error("unknown service accepted")
+	}
+}
@@ -0,0 +1,121 @@
+package portfwd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ListenHTTP accepts HTTP proxy clients on a local address and connects
+// them to the hosts they ask for with dial. CONNECT requests are
+// tunnelled as they are, and plain HTTP requests are passed on one per
+// connection. It returns once listening and serves clients until the
+// listener is closed.
+func ListenHTTP(address string, dial HostDialer) (io.Closer, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveHTTPProxy(conn, dial)
+		}
+	}()
+	return ln, nil
+}
+
+// serveHTTPProxy answers a client's request and connects it to its
+// host.
+func serveHTTPProxy(conn net.Conn, dial HostDialer) {
+	defer conn.Close()
+
+	in := bufio.NewReader(conn)
+	req, err := http.ReadRequest(in)
+	if err != nil {
+		return
+	}
+
+	// Requests other than CONNECT carry the host in an absolute URL.
+	host := req.Host
+	if req.Method != http.MethodConnect {
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			replyHTTP(conn, http.StatusBadRequest)
+			return
+		}
+		host = req.URL.Host
+		if req.URL.Port() == "" {
+			host = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		replyHTTP(conn, http.StatusBadRequest)
+		return
+	}
+
+	stream, err := dial(name, port)
+	if errors.Is(err, ErrUnknownHost) {
+		replyHTTP(conn, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		replyHTTP(conn, http.StatusBadGateway)
+		return
+	}
+	defer stream.Close()
+
+	if req.Method == http.MethodConnect {
+		if replyHTTP(conn, http.StatusOK) != nil {
+			return
+		}
+		pipe(&bufferedConn{Conn: conn, in: in}, stream)
+		return
+	}
+
+	// Pass the request on without the proxy's own headers and close the
+	// connection after the response, so it can't carry requests for
+	// other hosts.
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	if req.Write(stream) != nil {
+		return
+	}
+	io.Copy(conn, stream)
+}
+
+// replyHTTP answers a client's request with an empty response. Only
+// successful CONNECT requests keep the connection open.
+func replyHTTP(conn net.Conn, status int) error {
+	header := "Content-Length: 0\r\nConnection: close\r\n"
+	if status == http.StatusOK {
+		header = ""
+	}
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%s\r\n", status, http.StatusText(status), header)
+	return err
+}
+
+// bufferedConn reads from a connection through a reader holding what
+// was read ahead of it.
+type bufferedConn struct {
+	net.Conn
+	in *bufio.Reader
+}
+
+// Read reads from the buffered data before the connection.
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+// CloseWrite closes the writing side of the connection.
+func (c *bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
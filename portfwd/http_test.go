@@ -0,0 +1,144 @@
+package portfwd
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// httpProxyClient starts an HTTP proxy dialing with dial and connects
+// to it.
+func httpProxyClient(t *testing.T, dial HostDialer) net.Conn {
+	t.Helper()
+	ln, err := ListenHTTP("127.0.0.1:0", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conn, err := net.Dial("tcp", ln.(net.Listener).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	var host, port string
+	conn := httpProxyClient(t, func(h string, p string) (io.ReadWriteCloser, error) {
+		host, port = h, p
+		local, remote := net.Pipe()
+		go func() {
+			defer remote.Close()
+			io.Copy(remote, remote)
+		}()
+		return local, nil
+	})
+
+	// Data sent right behind the request is tunnelled as well.
+	if _, err := io.WriteString(conn, "CONNECT db.hyprspace:5432 HTTP/1.1\r\nHost: db.hyprspace:5432\r\n\r\nping"); err != nil {
+		t.Fatal(err)
+	}
+	in := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(in, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if host != "db.hyprspace" || port != "5432" {
+		t.Errorf("dialed %s:%s, want db.hyprspace:5432", host, port)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(in, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("got %q through the proxy, want %q", buf, "ping")
+	}
+}
+
+func TestHTTPProxyRequest(t *testing.T) {
+	var host, port string
+	received := make(chan *http.Request, 1)
+	conn := httpProxyClient(t, func(h string, p string) (io.ReadWriteCloser, error) {
+		host, port = h, p
+		local, remote := net.Pipe()
+		go func() {
+			defer remote.Close()
+			req, err := http.ReadRequest(bufio.NewReader(remote))
+			if err != nil {
+				return
+			}
+			received <- req
+			io.WriteString(remote, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi")
+		}()
+		return local, nil
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, "http://web/index.html", nil)
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hi" {
+		t.Errorf("got status %d and body %q, want %d and %q", resp.StatusCode, body, http.StatusOK, "hi")
+	}
+	if host != "web" || port != "80" {
+		t.Errorf("dialed %s:%s, want web:80", host, port)
+	}
+
+	// The host gets the request for its path without the proxy's
+	// headers.
+	got := <-received
+	if got.RequestURI != "/index.html" || got.Host != "web" {
+		t.Errorf("host got request for %s on %s, want /index.html on web", got.RequestURI, got.Host)
+	}
+	if got.Header.Get("Proxy-Connection") != "" {
+		t.Error("host got the proxy's headers")
+	}
+}
+
+func TestHTTPProxyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		status  int
+	}{
+		{"relative url", "GET /index.html HTTP/1.1\r\nHost: web\r\n\r\n", http.StatusBadRequest},
+		{"https url", "GET https://web/ HTTP/1.1\r\nHost: web\r\n\r\n", http.StatusBadRequest},
+		{"connect without port", "CONNECT web HTTP/1.1\r\nHost: web\r\n\r\n", http.StatusBadRequest},
+		{"unknown host", "CONNECT example:443 HTTP/1.1\r\nHost: example:443\r\n\r\n", http.StatusNotFound},
+		{"unreachable host", "CONNECT db:5432 HTTP/1.1\r\nHost: db:5432\r\n\r\n", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := httpProxyClient(t, func(h string, p string) (io.ReadWriteCloser, error) {
+				if h == "example" {
+					return nil, ErrUnknownHost
+				}
+				return nil, io.ErrClosedPipe
+			})
+			if _, err := io.WriteString(conn, tt.request); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+package portfwd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocols ports can be forwarded with.
+const (
+	TCP = "tcp"
+	UDP = "udp"
+)
+
+// UDPTimeout is how long a forwarded UDP session lasts without any
+// datagrams from the client.
+const UDPTimeout = 2 * time.Minute
+
+// dialTimeout bounds how long the forwarding peer takes to connect on
+// to the address it was asked for.
+const dialTimeout = 10 * time.Second
+
+// maxDatagram is the largest UDP datagram which is forwarded.
+const maxDatagram = 65535
+
+// Opener opens a new stream to the peer ports are forwarded to.
+type Opener func() (io.ReadWriteCloser, error)
+
+// Dialer connects to the address a local port is forwarded to. Reads
+// and writes on connections for UDP carry whole datagrams.
+type Dialer func() (io.ReadWriteCloser, error)
+
+// Rule allows a set of peers to reach an address through port
+// forwarding.
+type Rule struct {
+	Peers   []string
+	Proto   string
+	Address string
+}
+
+// NewRule parses a rule. No peers matches all peers and a proto of
+// "any" matches both TCP and UDP.
+func NewRule(peers []string, proto string, address string) (*Rule, error) {
+	proto = strings.ToLower(proto)
+	switch proto {
+	case "", "any":
+		proto = ""
+	case TCP, UDP:
+	default:
+		return nil, fmt.Errorf("unknown forwarding protocol %s", proto)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, err
+	}
+	return &Rule{Peers: peers, Proto: proto, Address: address}, nil
+}
+
+// Allows reports whether the rule lets peer reach address with proto.
+// Addresses have to match exactly as written.
+func (r *Rule) Allows(peer string, proto string, address string) bool {
+	if r.Proto != "" && r.Proto != proto {
+		return false
+	}
+	if r.Address != address {
+		return false
+	}
+	if len(r.Peers) == 0 {
+		return true
+	}
+	for _, p := range r.Peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// Listen accepts connections or datagrams on a local address and
+// forwards each over a connection of its own from dial. It returns once
+// listening and forwards until the listener is closed.
+func Listen(proto string, listen string, dial Dialer) (io.Closer, error) {
+	switch proto {
+	case TCP:
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return nil, err
+		}
+		go acceptTCP(ln, dial)
+		return ln, nil
+	case UDP:
+		l, err := listenUDP(listen, dial, UDPTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	default:
+		return nil, fmt.Errorf("unknown forwarding protocol %s", proto)
+	}
+}
+
+// Serve answers a request to forward a port received on stream, if
+// allow lets the peer reach the requested address.
+func Serve(stream io.ReadWriteCloser, allow func(proto string, address string) bool) error {
+	defer stream.Close()
+
+	proto, address, err := readRequest(stream)
+	if err != nil {
+		return err
+	}
+	if !allow(proto, address) {
+		err = fmt.Errorf("forwarding to %s %s is not allowed", proto, address)
+		writeReply(stream, err)
+		return err
+	}
+
+	conn, err := net.DialTimeout(proto, address, dialTimeout)
+	if err != nil {
+		writeReply(stream, err)
+		return err
+	}
+	defer conn.Close()
+	err = writeReply(stream, nil)
+	if err != nil {
+		return err
+	}
+
+	if proto == TCP {
+		pipe(conn, stream)
+		return nil
+	}
+
+	// Relay datagrams until the client ends the session.
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				stream.Close()
+				return
+			}
+			if writeFrame(stream, buf[:n]) != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := readFrame(stream, buf)
+		if err != nil {
+			return nil
+		}
+		conn.Write(buf[:n])
+	}
+}
+
+// Request asks the peer at the other end of stream to forward to
+// address with proto and waits for its answer.
+func Request(stream io.ReadWriter, proto string, address string) error {
+	err := writeFrame(stream, []byte(proto+" "+address))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1024)
+	n, err := readFrame(stream, buf)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errors.New(string(buf[:n]))
+	}
+	return nil
+}
+
+// Through returns a Dialer which forwards to address with proto on the
+// peer streams from open lead to.
+func Through(open Opener, proto string, address string) Dialer {
+	return func() (io.ReadWriteCloser, error) {
+		stream, err := open()
+		if err != nil {
+			return nil, err
+		}
+		err = Request(stream, proto, address)
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		if proto == UDP {
+			return datagramStream{stream}, nil
+		}
+		return stream, nil
+	}
+}
+
+// datagramStream carries whole datagrams over a stream by framing
+// them.
+type datagramStream struct {
+	io.ReadWriteCloser
+}
+
+// Read reads the next datagram from the stream.
+func (d datagramStream) Read(p []byte) (int, error) {
+	return readFrame(d.ReadWriteCloser, p)
+}
+
+// Write writes a datagram to the stream.
+func (d datagramStream) Write(p []byte) (int, error) {
+	if err := writeFrame(d.ReadWriteCloser, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// acceptTCP forwards each connection accepted on ln over a new
+// connection from dial.
+func acceptTCP(ln net.Listener, dial Dialer) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+
+			stream, err := dial()
+			if err != nil {
+				return
+			}
+			defer stream.Close()
+			pipe(conn, stream)
+		}()
+	}
+}
+
+// listenUDP forwards the datagrams of each client on a local address
+// over a connection of its own, which ends once the client has been
+// idle for timeout.
+func listenUDP(listen string, dial Dialer, timeout time.Duration) (*udpListener, error) {
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	l := &udpListener{
+		conn:     conn,
+		dial:     dial,
+		timeout:  timeout,
+		sessions: make(map[string]*udpSession),
+	}
+	go l.serve()
+	return l, nil
+}
+
+// udpListener forwards the datagrams of each client over a connection
+// of its own.
+type udpListener struct {
+	conn    net.PacketConn
+	dial    Dialer
+	timeout time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// udpSession is the connection forwarding a client's datagrams. The
+// datagrams are queued until it's connected, dropping those which don't
+// fit.
+type udpSession struct {
+	queue chan []byte
+	timer *time.Timer
+
+	once sync.Once
+	done chan struct{}
+}
+
+// sessionQueue is how many datagrams from a client are queued while its
+// session connects or falls behind.
+const sessionQueue = 64
+
+// serve reads datagrams from clients and queues them on their session.
+func (l *udpListener) serve() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			l.closeSessions()
+			return
+		}
+		s := l.session(addr)
+		s.timer.Reset(l.timeout)
+		select {
+		case s.queue <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+// session returns the session of a client, starting it if needed.
+func (l *udpListener) session(addr net.Addr) *udpSession {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if s, ok := l.sessions[addr.String()]; ok {
+		return s
+	}
+
+	s := &udpSession{
+		queue: make(chan []byte, sessionQueue),
+		done:  make(chan struct{}),
+	}
+	s.timer = time.AfterFunc(l.timeout, func() {
+		l.end(addr.String(), s)
+	})
+	l.sessions[addr.String()] = s
+
+	// Connect without holding up the datagrams of other clients.
+	go l.forward(addr, s)
+	return s
+}
+
+// forward connects a client's session and writes its datagrams to the
+// connection, sending replies back to the client, until the session
+// ends.
+func (l *udpListener) forward(addr net.Addr, s *udpSession) {
+	stream, err := l.dial()
+	if err != nil {
+		l.end(addr.String(), s)
+		return
+	}
+	defer stream.Close()
+
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := stream.Read(buf)
+			if err != nil {
+				l.end(addr.String(), s)
+				return
+			}
+			l.conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case datagram := <-s.queue:
+			if _, err := stream.Write(datagram); err != nil {
+				l.end(addr.String(), s)
+				return
+			}
+		}
+	}
+}
+
+// end closes a client's session.
+func (l *udpListener) end(key string, s *udpSession) {
+	l.lock.Lock()
+	if l.sessions[key] == s {
+		delete(l.sessions, key)
+	}
+	l.lock.Unlock()
+	s.close()
+}
+
+// close stops the session's timer and connection.
+func (s *udpSession) close() {
+	s.once.Do(func() {
+		s.timer.Stop()
+		close(s.done)
+	})
+}
+
+// closeSessions closes the sessions of every client.
+func (l *udpListener) closeSessions() {
+	l.lock.Lock()
+	sessions := l.sessions
+	l.sessions = make(map[string]*udpSession)
+	l.lock.Unlock()
+	for _, s := range sessions {
+		s.close()
+	}
+}
+
+// Close stops listening and ends every session.
+func (l *udpListener) Close() error {
+	return l.conn.Close()
+}
+
+// readRequest reads the protocol and address of a forwarding request.
+func readRequest(r io.Reader) (string, string, error) {
+	buf := make([]byte, 1024)
+	n, err := readFrame(r, buf)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(string(buf[:n]), " ", 2)
+	if len(parts) != 2 || (parts[0] != TCP && parts[0] != UDP) {
+		return "", "", errors.New("invalid forwarding request")
+	}
+	return parts[0], parts[1], nil
+}
+
+// writeReply answers a forwarding request with an error, or an empty
+// message if the port is being forwarded.
+func writeReply(w io.Writer, err error) error {
+	var msg []byte
+	if err != nil {
+		msg = []byte(err.Error())
+	}
+	return writeFrame(w, msg)
+}
+
+// writeFrame writes b to w behind its length.
+func writeFrame(w io.Writer, b []byte) error {
+	frame := make([]byte, 2+len(b))
+	binary.LittleEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a frame written by writeFrame into buf.
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	var size [2]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return 0, err
+	}
+	n := int(binary.LittleEndian.Uint16(size[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("frame of %d bytes is too large", n)
+	}
+	return io.ReadFull(r, buf[:n])
+}
+
+// pipe copies between a connection and a stream in both directions
+// until both are done.
+func pipe(conn net.Conn, stream io.ReadWriteCloser) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(stream, conn)
+		closeWrite(stream)
+		close(done)
+	}()
+	io.Copy(conn, stream)
+	closeWrite(conn)
+	<-done
+}
+
+// closeWrite closes the writing side of c if it can be closed on its
+// own, and all of c otherwise.
+func closeWrite(c io.Closer) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
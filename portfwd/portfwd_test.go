@@ -0,0 +1,391 @@
+package portfwd
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tcpEcho starts a TCP server on the loopback address which echoes
+// what it receives and returns its address.
+func tcpEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// udpEcho starts a UDP server on the loopback address which echoes the
+// datagrams it receives and returns its address.
+func udpEcho(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// serving returns an Opener whose streams are served by Serve, allowing
+// every request.
+func serving() Opener {
+	return func() (io.ReadWriteCloser, error) {
+		local, remote := net.Pipe()
+		go Serve(remote, func(string, string) bool { return true })
+		return local, nil
+	}
+}
+
+func TestNewRule(t *testing.T) {
+	tests := []struct {
+		proto   string
+		address string
+		want    string
+		err     bool
+	}{
+		{"tcp", "127.0.0.1:22", TCP, false},
+		{"UDP", "127.0.0.1:53", UDP, false},
+		{"any", "127.0.0.1:53", "", false},
+		{"", "127.0.0.1:53", "", false},
+		{"icmp", "127.0.0.1:53", "", true},
+		{"tcp", "127.0.0.1", "", true},
+	}
+	for _, tt := range tests {
+		r, err := NewRule(nil, tt.proto, tt.address)
+		if (err != nil) != tt.err {
+			t.Errorf("NewRule(%q, %q) returned error %v, want error %v", tt.proto, tt.address, err, tt.err)
+			continue
+		}
+		if err == nil && r.Proto != tt.want {
+			t.Errorf("NewRule(%q, %q) has proto %q, want %q", tt.proto, tt.address, r.Proto, tt.want)
+		}
+	}
+}
+
+func TestRuleAllows(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		peer    string
+		proto   string
+		address string
+		want    bool
+	}{
+		{"any peer", Rule{Proto: TCP, Address: "127.0.0.1:22"}, "10.1.1.2", TCP, "127.0.0.1:22", true},
+		{"listed peer", Rule{Peers: []string{"10.1.1.2", "10.1.1.3"}, Proto: TCP, Address: "127.0.0.1:22"}, "10.1.1.3", TCP, "127.0.0.1:22", true},
+		{"unlisted peer", Rule{Peers: []string{"10.1.1.2"}, Proto: TCP, Address: "127.0.0.1:22"}, "10.1.1.3", TCP, "127.0.0.1:22", false},
+		{"any proto", Rule{Address: "127.0.0.1:53"}, "10.1.1.2", UDP, "127.0.0.1:53", true},
+		{"other proto", Rule{Proto: TCP, Address: "127.0.0.1:53"}, "10.1.1.2", UDP, "127.0.0.1:53", false},
+		{"other port", Rule{Proto: TCP, Address: "127.0.0.1:22"}, "10.1.1.2", TCP, "127.0.0.1:23", false},
+		{"other spelling", Rule{Proto: TCP, Address: "localhost:22"}, "10.1.1.2", TCP, "127.0.0.1:22", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Allows(tt.peer, tt.proto, tt.address); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	echo := tcpEcho(t)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		proto   string
+		address string
+		err     string
+	}{
+		{"allowed", TCP, echo, ""},
+		{"denied", TCP, "127.0.0.1:22", "is not allowed"},
+		{"unreachable", TCP, closed.Addr().String(), "refused"},
+		{"unknown proto", "icmp", echo, "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			local.SetDeadline(time.Now().Add(5 * time.Second))
+			served := make(chan error, 1)
+			go func() {
+				served <- Serve(remote, func(proto string, address string) bool {
+					return address != "127.0.0.1:22"
+				})
+			}()
+
+			err := Request(local, tt.proto, tt.address)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				if <-served == nil {
+					t.Error("Serve returned no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The stream is piped to the connection once accepted.
+			if _, err := local.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(local, buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "ping" {
+				t.Errorf("got %q back, want %q", buf, "ping")
+			}
+		})
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	ln, err := Listen(TCP, "127.0.0.1:0", Through(serving(), TCP, tcpEcho(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.(net.Listener).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	data := bytes.Repeat([]byte("hyprspace"), 10000)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data piped through the forwarded port differs")
+	}
+}
+
+func TestListenUDP(t *testing.T) {
+	ln, err := Listen(UDP, "127.0.0.1:0", Through(serving(), UDP, udpEcho(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.(*udpListener).conn.LocalAddr()
+
+	// Each client gets its own replies with datagram boundaries kept.
+	for _, client := range []string{"first", "second"} {
+		conn, err := net.Dial("udp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, msg := range []string{client, client + " again"} {
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, maxDatagram)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != msg {
+				t.Errorf("got %q back, want %q", buf[:n], msg)
+			}
+		}
+	}
+	l := ln.(*udpListener)
+	l.lock.Lock()
+	n := len(l.sessions)
+	l.lock.Unlock()
+	if n != 2 {
+		t.Errorf("got %d sessions, want 2", n)
+	}
+}
+
+// countingDialer dials pipes whose other end is drained, counting the
+// dials and closes.
+type countingDialer struct {
+	lock   sync.Mutex
+	dials  int
+	closed chan struct{}
+}
+
+func (d *countingDialer) dial() (io.ReadWriteCloser, error) {
+	d.lock.Lock()
+	d.dials++
+	d.lock.Unlock()
+	local, remote := net.Pipe()
+	go func() {
+		io.Copy(io.Discard, remote)
+		d.closed <- struct{}{}
+	}()
+	return local, nil
+}
+
+func (d *countingDialer) count() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.dials
+}
+
+func TestUDPTimeout(t *testing.T) {
+	d := &countingDialer{closed: make(chan struct{}, 4)}
+	l, err := listenUDP("127.0.0.1:0", d.dial, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("udp", l.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Datagrams within the timeout share a session.
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := d.count(); n != 1 {
+		t.Fatalf("dialed %d times, want 1", n)
+	}
+
+	// The session ends once the client is idle.
+	select {
+	case <-d.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session was not closed")
+	}
+	l.lock.Lock()
+	n := len(l.sessions)
+	l.lock.Unlock()
+	if n != 0 {
+		t.Errorf("got %d sessions after the timeout, want 0", n)
+	}
+
+	// The next datagram starts a new session.
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for d.count() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := d.count(); n != 2 {
+		t.Errorf("dialed %d times, want 2", n)
+	}
+
+	// Closing the listener ends the remaining sessions.
+	l.Close()
+	select {
+	case <-d.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not closed with the listener")
+	}
+}
+
+func TestUDPSlowDial(t *testing.T) {
+	echo := Through(serving(), UDP, udpEcho(t))
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	var once sync.Once
+	dial := func() (io.ReadWriteCloser, error) {
+		first := false
+		once.Do(func() { first = true })
+		if first {
+			close(dialing)
+			<-release
+		}
+		return echo()
+	}
+	l, err := listenUDP("127.0.0.1:0", dial, UDPTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The first client's session is still connecting.
+	slow, err := net.Dial("udp", l.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	if _, err := slow.Write([]byte("slow")); err != nil {
+		t.Fatal(err)
+	}
+	<-dialing
+
+	// Other clients are forwarded in the meantime.
+	conn, err := net.Dial("udp", l.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("fast")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxDatagram)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "fast" {
+		t.Errorf("got %q back, want %q", buf[:n], "fast")
+	}
+
+	// Datagrams queued while connecting are sent once connected.
+	release <- struct{}{}
+	slow.SetDeadline(time.Now().Add(5 * time.Second))
+	n, err = slow.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "slow" {
+		t.Errorf("got %q back, want %q", buf[:n], "slow")
+	}
+}
@@ -0,0 +1,139 @@
+package portfwd
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// ErrUnknownHost is returned by a SOCKS dialer for hosts it can't reach.
+var ErrUnknownHost = errors.New("unknown host")
+
+// SOCKS versions, commands, address types and replies.
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+
+	socksConnect = 1
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+
+	socksSucceeded          = 0
+	socksFailure            = 1
+	socksHostUnreachable    = 4
+	socksCommandUnsupported = 7
+	socksAddressUnsupported = 8
+)
+
+// HostDialer connects to a port of a host requested by a proxy client.
+type HostDialer func(host string, port string) (io.ReadWriteCloser, error)
+
+// ListenSOCKS accepts SOCKS5 clients on a local address and connects
+// them to the hosts they ask for with dial. Only the CONNECT command is
+// supported, without authentication. It returns once listening and
+// serves clients until the listener is closed.
+func ListenSOCKS(address string, dial HostDialer) (io.Closer, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS(conn, dial)
+		}
+	}()
+	return ln, nil
+}
+
+// serveSOCKS answers a client's request and connects it to its host.
+func serveSOCKS(conn net.Conn, dial HostDialer) {
+	defer conn.Close()
+
+	// Agree on not authenticating.
+	var buf [256]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != socksVersion {
+		return
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil || method != socksNoAuth {
+		return
+	}
+
+	// Read the command and the host and port it's for.
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[0] != socksVersion {
+		return
+	}
+	cmd, atyp := buf[1], buf[3]
+	var host string
+	switch atyp {
+	case socksIPv4, socksIPv6:
+		n := net.IPv4len
+		if atyp == socksIPv6 {
+			n = net.IPv6len
+		}
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return
+		}
+		host = net.IP(buf[:n]).String()
+	case socksDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return
+		}
+		host = string(buf[:n])
+	default:
+		replySOCKS(conn, socksAddressUnsupported)
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	port := strconv.Itoa(int(buf[0])<<8 | int(buf[1]))
+	if cmd != socksConnect {
+		replySOCKS(conn, socksCommandUnsupported)
+		return
+	}
+
+	stream, err := dial(host, port)
+	if errors.Is(err, ErrUnknownHost) {
+		replySOCKS(conn, socksHostUnreachable)
+		return
+	}
+	if err != nil {
+		replySOCKS(conn, socksFailure)
+		return
+	}
+	defer stream.Close()
+	if replySOCKS(conn, socksSucceeded) != nil {
+		return
+	}
+	pipe(conn, stream)
+}
+
+// replySOCKS answers a client's request. The bound address is left
+// empty as it means nothing for connections through a peer.
+func replySOCKS(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
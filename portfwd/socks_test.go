@@ -0,0 +1,167 @@
+package portfwd
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// socksAddr starts a SOCKS proxy dialing with dial and returns its
+// address.
+func socksAddr(t *testing.T, dial HostDialer) string {
+	t.Helper()
+	ln, err := ListenSOCKS("127.0.0.1:0", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln.(net.Listener).Addr().String()
+}
+
+// socksClient connects to a proxy and sends it a greeting offering
+// methods.
+func socksClient(t *testing.T, addr string, methods []byte) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readReply reads n bytes of a proxy's reply.
+func readReply(t *testing.T, conn net.Conn, n int) []byte {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestSOCKSGreeting(t *testing.T) {
+	all := make([]byte, 255)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	tests := []struct {
+		name    string
+		methods []byte
+		want    byte
+	}{
+		{"no auth", []byte{socksNoAuth}, socksNoAuth},
+		{"no auth among others", []byte{2, socksNoAuth, 1}, socksNoAuth},
+		{"only password", []byte{2}, socksNoAcceptable},
+		{"no methods", nil, socksNoAcceptable},
+		{"every method", all, socksNoAuth},
+	}
+	addr := socksAddr(t, func(host string, port string) (io.ReadWriteCloser, error) {
+		return nil, ErrUnknownHost
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := socksClient(t, addr, tt.methods)
+			reply := readReply(t, conn, 2)
+			if !bytes.Equal(reply, []byte{socksVersion, tt.want}) {
+				t.Errorf("got reply %v, want method %d", reply, tt.want)
+			}
+		})
+	}
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		host    string
+		port    string
+		reply   byte
+	}{
+		{
+			name:    "ipv4",
+			request: []byte{socksVersion, socksConnect, 0, socksIPv4, 10, 1, 1, 2, 0x1f, 0x90},
+			host:    "10.1.1.2",
+			port:    "8080",
+			reply:   socksSucceeded,
+		},
+		{
+			name:    "domain",
+			request: append(append([]byte{socksVersion, socksConnect, 0, socksDomain, 12}, "db.hyprspace"...), 0x15, 0x38),
+			host:    "db.hyprspace",
+			port:    "5432",
+			reply:   socksSucceeded,
+		},
+		{
+			name:    "ipv6",
+			request: append(append([]byte{socksVersion, socksConnect, 0, socksIPv6}, net.ParseIP("fd00::2")...), 0, 80),
+			host:    "fd00::2",
+			port:    "80",
+			reply:   socksSucceeded,
+		},
+		{
+			name:    "unknown host",
+			request: append(append([]byte{socksVersion, socksConnect, 0, socksDomain, 7}, "example"...), 0, 80),
+			host:    "example",
+			port:    "80",
+			reply:   socksHostUnreachable,
+		},
+		{
+			name:    "bind",
+			request: []byte{socksVersion, 2, 0, socksIPv4, 10, 1, 1, 2, 0, 80},
+			reply:   socksCommandUnsupported,
+		},
+		{
+			name:    "unknown address type",
+			request: []byte{socksVersion, socksConnect, 0, 9},
+			reply:   socksAddressUnsupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var host, port string
+			addr := socksAddr(t, func(h string, p string) (io.ReadWriteCloser, error) {
+				host, port = h, p
+				if h == "example" {
+					return nil, ErrUnknownHost
+				}
+				local, remote := net.Pipe()
+				go func() {
+					defer remote.Close()
+					io.Copy(remote, remote)
+				}()
+				return local, nil
+			})
+			conn := socksClient(t, addr, []byte{socksNoAuth})
+			readReply(t, conn, 2)
+			if _, err := conn.Write(tt.request); err != nil {
+				t.Fatal(err)
+			}
+			reply := readReply(t, conn, 10)
+			if reply[1] != tt.reply {
+				t.Fatalf("got reply %d, want %d", reply[1], tt.reply)
+			}
+			if tt.reply != socksSucceeded {
+				return
+			}
+			if host != tt.host || port != tt.port {
+				t.Errorf("dialed %s:%s, want %s:%s", host, port, tt.host, tt.port)
+			}
+
+			// The connection is piped through to the dialed stream.
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if got := readReply(t, conn, 4); string(got) != "ping" {
+				t.Errorf("got %q through the proxy, want %q", got, "ping")
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package subnet
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// signaturePrefix is signed along with advertisements so their
+// signatures can't be mistaken for those of anything else the key
+// signs.
+const signaturePrefix = "hyprspace subnets:"
+
+// ErrBadSignature is returned for advertisements which weren't signed
+// by the gateway they came from.
+var ErrBadSignature = errors.New("invalid advertisement signature")
+
+// Advertisement lists the subnets a gateway routes to. Gateways pick a
+// random Boot each time they start and number their advertisements in
+// increasing Seq order from there, so older ones can be ignored without
+// relying on their clock, and withdraw their subnets by advertising
+// none. Gateways with a lower Priority are preferred for the same
+// subnet.
+type Advertisement struct {
+	Subnets  []string `json:"subnets"`
+	Boot     uint64   `json:"boot"`
+	Seq      uint64   `json:"seq"`
+	Priority int      `json:"priority,omitempty"`
+}
+
+// Signed is an advertisement signed by its gateway's key.
+type Signed struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// Sign signs an advertisement with a gateway's private key.
+func Sign(key crypto.PrivKey, ad Advertisement) (Signed, error) {
+	payload, err := json.Marshal(ad)
+	if err != nil {
+		return Signed{}, err
+	}
+	sig, err := key.Sign(append([]byte(signaturePrefix), payload...))
+	if err != nil {
+		return Signed{}, err
+	}
+	return Signed{Payload: payload, Signature: sig}, nil
+}
+
+// Verify checks an advertisement was signed by the gateway with the
+// given ID and returns it.
+func (s Signed) Verify(id peer.ID) (Advertisement, error) {
+	key, err := id.ExtractPublicKey()
+	if err != nil {
+		return Advertisement{}, err
+	}
+	ok, err := key.Verify(append([]byte(signaturePrefix), s.Payload...), s.Signature)
+	if err != nil {
+		return Advertisement{}, err
+	}
+	if !ok {
+		return Advertisement{}, ErrBadSignature
+	}
+	var ad Advertisement
+	err = json.Unmarshal(s.Payload, &ad)
+	return ad, err
+}
+
+// Table routes packets for subnets to the gateways advertising them.
+// Each subnet has one active gateway, chosen by priority among those
+// which are up, which it fails over from once it goes down. With
+// failback, subnets move back to a preferred gateway as soon as it's
+// up again. Gateways' subnets are withdrawn once they haven't
+// advertised them again within the table's TTL.
+type Table struct {
+	ttl      time.Duration
+	failback bool
+
+	lock     sync.RWMutex
+	gateways map[string]gateway
+	prefixes map[string]*prefix
+	down     map[string]bool
+}
+
+// gateway holds the subnets a gateway last advertised.
+type gateway struct {
+	boot     uint64
+	seq      uint64
+	priority int
+	subnets  []*net.IPNet
+	at       time.Time
+}
+
+// prefix holds the gateways to a subnet, ordered by priority and then
+// by when they advertised it, and the one packets are sent to. Failed
+// is set once the subnet failed over from a gateway.
+type prefix struct {
+	network  *net.IPNet
+	gateways []string
+	active   string
+	failed   bool
+}
+
+// Route describes a subnet, its gateways in order of preference and
+// the active one.
+type Route struct {
+	Subnet   string
+	Gateways []string
+	Active   string
+}
+
+// Failover describes a subnet moving from one gateway to another.
+type Failover struct {
+	Subnet string
+	From   string
+	To     string
+}
+
+// NewTable creates an empty table.
+func NewTable(ttl time.Duration, failback bool) *Table {
+	return &Table{
+		ttl:      ttl,
+		failback: failback,
+		gateways: make(map[string]gateway),
+		prefixes: make(map[string]*prefix),
+		down:     make(map[string]bool),
+	}
+}
+
+// Update replaces the subnets a gateway routes to with those of an
+// advertisement numbered seq since the gateway's boot, with the
+// gateway's priority. Gateways with lower priorities are preferred. It
+// returns the subnets which became reachable and those which no longer
+// are, and reports false when the advertisement is older than the
+// gateway's last one. Advertisements from another boot always replace
+// the last one, as the gateway restarted.
+func (t *Table) Update(gw string, boot uint64, seq uint64, priority int, subnets []*net.IPNet) (added, removed []*net.IPNet, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	old, ok := t.gateways[gw]
+	if ok && boot == old.boot && seq <= old.seq {
+		return nil, nil, false
+	}
+	t.gateways[gw] = gateway{boot: boot, seq: seq, priority: priority, subnets: subnets, at: time.Now()}
+
+	// Gateways keep their place for subnets they advertise again.
+	for _, n := range old.subnets {
+		if !contains(subnets, n) && t.removeFrom(gw, n) {
+			removed = append(removed, n)
+		}
+	}
+	for _, n := range subnets {
+		if t.addTo(gw, n) {
+			added = append(added, n)
+		}
+	}
+	return added, removed, true
+}
+
+// Withdraw removes the subnets of a gateway which went away and returns
+// the subnets which are no longer reachable.
+func (t *Table) Withdraw(gw string) []*net.IPNet {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.withdraw(gw)
+}
+
+// Expire withdraws the subnets of gateways which haven't advertised
+// them within the TTL and returns the subnets which are no longer
+// reachable.
+func (t *Table) Expire() []*net.IPNet {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var removed []*net.IPNet
+	for gw, g := range t.gateways {
+		if len(g.subnets) > 0 && time.Since(g.at) > t.ttl {
+			removed = append(removed, t.withdraw(gw)...)
+		}
+	}
+	return removed
+}
+
+// SetUp records whether a gateway is up, failing its subnets over to
+// other gateways while it's down. It returns the subnets which moved.
+func (t *Table) SetUp(gw string, up bool) []Failover {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.down[gw] == !up {
+		return nil
+	}
+	if up {
+		delete(t.down, gw)
+	} else {
+		t.down[gw] = true
+	}
+
+	var result []Failover
+	for _, n := range t.gateways[gw].subnets {
+		p := t.prefixes[n.String()]
+		from := p.active
+		t.choose(p)
+		if p.active != from {
+			result = append(result, Failover{Subnet: n.String(), From: from, To: p.active})
+		}
+	}
+	return result
+}
+
+// Gateways returns the gateways currently advertising subnets.
+func (t *Table) Gateways() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var result []string
+	for gw, g := range t.gateways {
+		if len(g.subnets) > 0 {
+			result = append(result, gw)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Lookup returns the active gateway for the most specific subnet
+// containing ip.
+func (t *Table) Lookup(ip net.IP) (string, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var best *prefix
+	bestOnes := -1
+	for _, p := range t.prefixes {
+		ones, _ := p.network.Mask.Size()
+		if ones > bestOnes && p.network.Contains(ip) {
+			best, bestOnes = p, ones
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.active, true
+}
+
+// Through reports whether ip is within a subnet gateway gw advertises,
+// whether or not it's the subnet's active gateway.
+func (t *Table) Through(gw string, ip net.IP) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for _, n := range t.gateways[gw].subnets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Routes returns every subnet in the table ordered by subnet.
+func (t *Table) Routes() []Route {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	result := make([]Route, 0, len(t.prefixes))
+	for cidr, p := range t.prefixes {
+		result = append(result, Route{
+			Subnet:   cidr,
+			Gateways: append([]string(nil), p.gateways...),
+			Active:   p.active,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Subnet < result[j].Subnet })
+	return result
+}
+
+// withdraw removes a gateway's subnets while keeping its boot and
+// sequence number so older advertisements stay ignored.
+func (t *Table) withdraw(gw string) []*net.IPNet {
+	g, ok := t.gateways[gw]
+	if !ok {
+		return nil
+	}
+	t.gateways[gw] = gateway{boot: g.boot, seq: g.seq}
+	var removed []*net.IPNet
+	for _, n := range g.subnets {
+		if t.removeFrom(gw, n) {
+			removed = append(removed, n)
+		}
+	}
+	return removed
+}
+
+// addTo adds a gateway to a subnet in order of priority and reports
+// whether the subnet had no gateways before.
+func (t *Table) addTo(gw string, n *net.IPNet) bool {
+	p, ok := t.prefixes[n.String()]
+	if !ok {
+		p = &prefix{network: n}
+		t.prefixes[n.String()] = p
+	}
+	if !has(p.gateways, gw) {
+		p.gateways = append(p.gateways, gw)
+	}
+	sort.SliceStable(p.gateways, func(i, j int) bool {
+		return t.gateways[p.gateways[i]].priority < t.gateways[p.gateways[j]].priority
+	})
+	t.choose(p)
+	return len(p.gateways) == 1
+}
+
+// removeFrom removes a gateway from a subnet and reports whether the
+// subnet has no gateways left.
+func (t *Table) removeFrom(gw string, n *net.IPNet) bool {
+	p, ok := t.prefixes[n.String()]
+	if !ok {
+		return false
+	}
+	for i, other := range p.gateways {
+		if other == gw {
+			p.gateways = append(p.gateways[:i], p.gateways[i+1:]...)
+			break
+		}
+	}
+	if len(p.gateways) > 0 {
+		t.choose(p)
+		return false
+	}
+	delete(t.prefixes, n.String())
+	return true
+}
+
+// choose picks the active gateway of a subnet, which is the preferred
+// one which is up. Once the subnet failed over, the active gateway is
+// kept while it's up unless failback prefers another one. When every
+// gateway is down the active one is kept if it's still a gateway of
+// the subnet.
+func (t *Table) choose(p *prefix) {
+	best := ""
+	for _, gw := range p.gateways {
+		if !t.down[gw] {
+			best = gw
+			break
+		}
+	}
+	switch {
+	case best == "":
+		if !has(p.gateways, p.active) {
+			p.active = p.gateways[0]
+		}
+	case p.active == "" || t.down[p.active] || !has(p.gateways, p.active):
+		p.failed = p.active != ""
+		p.active = best
+	case t.failback || !p.failed:
+		p.active = best
+	}
+}
+
+// contains reports whether list holds the subnet n.
+func contains(list []*net.IPNet, n *net.IPNet) bool {
+	for _, other := range list {
+		if other.String() == n.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// has reports whether list holds the gateway gw.
+func has(list []string, gw string) bool {
+	for _, other := range list {
+		if other == gw {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package subnet
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// cidrs parses subnets in CIDR notation.
+func cidrs(t *testing.T, list ...string) []*net.IPNet {
+	t.Helper()
+	var result []*net.IPNet
+	for _, s := range list {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+// strings returns subnets in CIDR notation.
+func strings(nets []*net.IPNet) []string {
+	var result []string
+	for _, n := range nets {
+		result = append(result, n.String())
+	}
+	return result
+}
+
+// equal reports whether two lists hold the same strings in order.
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSign(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := peer.IDFromPrivateKey(key)
+	otherID, _ := peer.IDFromPrivateKey(other)
+
+	signed, err := Sign(key, Advertisement{Subnets: []string{"192.168.1.0/24"}, Seq: 7, Priority: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad, err := signed.Verify(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(ad.Subnets, []string{"192.168.1.0/24"}) || ad.Seq != 7 || ad.Priority != 1 {
+		t.Errorf("got advertisement %+v", ad)
+	}
+
+	// Advertisements only verify for the gateway which signed them
+	// and can't be changed.
+	if _, err := signed.Verify(otherID); err != ErrBadSignature {
+		t.Errorf("got error %v verifying another gateway, want %v", err, ErrBadSignature)
+	}
+	signed.Payload = []byte(`{"subnets":["0.0.0.0/0"],"seq":8}`)
+	if _, err := signed.Verify(id); err != ErrBadSignature {
+		t.Errorf("got error %v verifying a changed advertisement, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	table := NewTable(time.Minute, false)
+	added, removed, ok := table.Update("a", 1, 1, 0, cidrs(t, "192.168.1.0/24", "192.168.0.0/16"))
+	if !ok || !equal(strings(added), []string{"192.168.1.0/24", "192.168.0.0/16"}) || len(removed) != 0 {
+		t.Fatalf("got %v, %v, %v", added, removed, ok)
+	}
+
+	// Subnets already routed through another gateway aren't added
+	// again, and subnets no gateway routes any more are removed.
+	added, removed, ok = table.Update("b", 1, 1, 0, cidrs(t, "192.168.1.0/24"))
+	if !ok || len(added) != 0 || len(removed) != 0 {
+		t.Fatalf("got %v, %v, %v", added, removed, ok)
+	}
+	added, removed, ok = table.Update("a", 1, 2, 0, cidrs(t, "192.168.1.0/24"))
+	if !ok || len(added) != 0 || !equal(strings(removed), []string{"192.168.0.0/16"}) {
+		t.Fatalf("got %v, %v, %v", added, removed, ok)
+	}
+
+	// Older advertisements are ignored.
+	if _, _, ok := table.Update("a", 1, 1, 0, nil); ok {
+		t.Error("older advertisement applied")
+	}
+
+	// The gateway which advertised first stays active.
+	if gw, ok := table.Lookup(net.ParseIP("192.168.1.9")); !ok || gw != "a" {
+		t.Errorf("got gateway %q, %v, want a", gw, ok)
+	}
+	if !table.Through("b", net.ParseIP("192.168.1.9")) || table.Through("b", net.ParseIP("192.168.2.9")) {
+		t.Error("subnets through b are wrong")
+	}
+
+	// Withdrawing both gateways removes the subnet.
+	if removed := table.Withdraw("a"); len(removed) != 0 {
+		t.Errorf("withdrawing a removed %v", removed)
+	}
+	if removed := table.Withdraw("b"); !equal(strings(removed), []string{"192.168.1.0/24"}) {
+		t.Errorf("withdrawing b removed %v", removed)
+	}
+	if _, ok := table.Lookup(net.ParseIP("192.168.1.9")); ok {
+		t.Error("withdrawn subnet still routed")
+	}
+	if _, _, ok := table.Update("b", 1, 1, 0, cidrs(t, "192.168.1.0/24")); ok {
+		t.Error("advertisement from before withdrawing applied")
+	}
+
+	// Gateways which restarted count their advertisements from the
+	// start again.
+	added, removed, ok = table.Update("b", 2, 1, 0, cidrs(t, "192.168.1.0/24"))
+	if !ok || !equal(strings(added), []string{"192.168.1.0/24"}) || len(removed) != 0 {
+		t.Fatalf("got %v, %v, %v after restarting", added, removed, ok)
+	}
+	if _, _, ok := table.Update("b", 2, 1, 0, nil); ok {
+		t.Error("repeated advertisement after restarting applied")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	table := NewTable(time.Minute, false)
+	table.Update("a", 1, 1, 0, cidrs(t, "192.168.0.0/16"))
+	table.Update("b", 1, 1, 0, cidrs(t, "192.168.1.0/24"))
+	tests := []struct {
+		ip string
+		gw string
+		ok bool
+	}{
+		{"192.168.1.9", "b", true},
+		{"192.168.2.9", "a", true},
+		{"10.0.0.1", "", false},
+	}
+	for _, tt := range tests {
+		gw, ok := table.Lookup(net.ParseIP(tt.ip))
+		if gw != tt.gw || ok != tt.ok {
+			t.Errorf("Lookup(%s) = %q, %v, want %q, %v", tt.ip, gw, ok, tt.gw, tt.ok)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	table := NewTable(-time.Second, false)
+	table.Update("a", 1, 1, 0, cidrs(t, "192.168.1.0/24"))
+	if removed := table.Expire(); !equal(strings(removed), []string{"192.168.1.0/24"}) {
+		t.Errorf("expired %v", removed)
+	}
+	if len(table.Gateways()) != 0 || len(table.Routes()) != 0 {
+		t.Error("expired gateway still routed")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	// Each step marks a gateway up or down and lists the active
+	// gateway after it and the gateways the subnet moved between.
+	type step struct {
+		gw     string
+		up     bool
+		active string
+		moved  []string
+	}
+	tests := []struct {
+		name     string
+		failback bool
+		steps    []step
+	}{
+		{
+			name: "fails over by priority",
+			steps: []step{
+				{"primary", false, "secondary", []string{"primary", "secondary"}},
+				{"secondary", false, "tertiary", []string{"secondary", "tertiary"}},
+				{"tertiary", false, "tertiary", nil},
+				{"primary", true, "primary", []string{"tertiary", "primary"}},
+			},
+		},
+		{
+			name: "stays without failback",
+			steps: []step{
+				{"primary", false, "secondary", []string{"primary", "secondary"}},
+				{"primary", true, "secondary", nil},
+				{"tertiary", false, "secondary", nil},
+				{"secondary", false, "primary", []string{"secondary", "primary"}},
+			},
+		},
+		{
+			name:     "fails back to the preferred gateway",
+			failback: true,
+			steps: []step{
+				{"primary", false, "secondary", []string{"primary", "secondary"}},
+				{"secondary", false, "tertiary", []string{"secondary", "tertiary"}},
+				{"secondary", true, "secondary", []string{"tertiary", "secondary"}},
+				{"primary", true, "primary", []string{"secondary", "primary"}},
+				{"primary", true, "primary", nil},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Gateways advertise in the opposite order of their
+			// priorities, which decide the order.
+			table := NewTable(time.Minute, tt.failback)
+			table.Update("tertiary", 1, 1, 3, cidrs(t, "192.168.1.0/24"))
+			table.Update("secondary", 1, 1, 2, cidrs(t, "192.168.1.0/24"))
+			table.Update("primary", 1, 1, 1, cidrs(t, "192.168.1.0/24"))
+			routes := table.Routes()
+			if len(routes) != 1 || !equal(routes[0].Gateways, []string{"primary", "secondary", "tertiary"}) {
+				t.Fatalf("got routes %+v", routes)
+			}
+			if gw, _ := table.Lookup(net.ParseIP("192.168.1.1")); gw != "primary" {
+				t.Fatalf("got active gateway %s, want primary", gw)
+			}
+
+			for i, s := range tt.steps {
+				moved := table.SetUp(s.gw, s.up)
+				var got []string
+				for _, f := range moved {
+					got = append(got, f.From, f.To)
+				}
+				if !equal(got, s.moved) {
+					t.Errorf("step %d moved %v, want %v", i, got, s.moved)
+				}
+				if gw, _ := table.Lookup(net.ParseIP("192.168.1.1")); gw != s.active {
+					t.Errorf("step %d active gateway is %s, want %s", i, gw, s.active)
+				}
+			}
+		})
+	}
+}
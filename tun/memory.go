@@ -0,0 +1,99 @@
+package tun
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// memoryQueue is the number of packets an in-memory device holds
+// before writes to it block.
+const memoryQueue = 64
+
+// Memory is a Device which passes packets to and from its peer in
+// memory instead of through the kernel. It lets packets be forwarded
+// without root or a system TUN device.
+type Memory struct {
+	name string
+	mtu  int
+	in   <-chan []byte
+	out  chan<- []byte
+
+	// The ends of a pipe share done so closing either closes both.
+	done chan struct{}
+	once *sync.Once
+}
+
+// NewPipe creates a pair of connected in-memory devices. Packets
+// written to either of them are read from the other.
+func NewPipe(name string, mtu int) (*Memory, *Memory) {
+	a, b := make(chan []byte, memoryQueue), make(chan []byte, memoryQueue)
+	done, once := make(chan struct{}), new(sync.Once)
+	return &Memory{name: name, mtu: mtu, in: a, out: b, done: done, once: once},
+		&Memory{name: name, mtu: mtu, in: b, out: a, done: done, once: once}
+}
+
+// Read reads the next packet written to the other end of the pipe.
+func (m *Memory) Read(p []byte) (int, error) {
+	select {
+	case packet := <-m.in:
+		n := copy(p, packet)
+		if n < len(packet) {
+			return n, io.ErrShortBuffer
+		}
+		return n, nil
+	case <-m.done:
+		return 0, io.EOF
+	}
+}
+
+// Write queues a copy of a packet for the other end of the pipe,
+// blocking while the other end is behind on reading.
+func (m *Memory) Write(p []byte) (int, error) {
+	if m.mtu > 0 && len(p) > m.mtu {
+		return 0, fmt.Errorf("packet of %d bytes exceeds mtu %d", len(p), m.mtu)
+	}
+	packet := make([]byte, len(p))
+	copy(packet, p)
+
+	// Check for the pipe being closed first as select picks at random.
+	select {
+	case <-m.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	select {
+	case m.out <- packet:
+		return len(p), nil
+	case <-m.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// Close closes both ends of the pipe.
+func (m *Memory) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+	})
+	return nil
+}
+
+// Name returns the name the device was created with.
+func (m *Memory) Name() string {
+	return m.name
+}
+
+// MTU returns the MTU the device was created with.
+func (m *Memory) MTU() int {
+	return m.mtu
+}
+
+// Up does nothing as in-memory devices are always up.
+func (m *Memory) Up() error {
+	return nil
+}
+
+// Down does nothing as in-memory devices are always up.
+func (m *Memory) Down() error {
+	return nil
+}
@@ -0,0 +1,104 @@
+package tun
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestPipe(t *testing.T) {
+	dev, app := NewPipe("hs0", 1420)
+	defer dev.Close()
+
+	// Packets pass in both directions, one per read.
+	tests := []struct {
+		name   string
+		from   *Memory
+		to     *Memory
+		packet []byte
+	}{
+		{"to device", app, dev, []byte{0x45, 1, 2, 3}},
+		{"from device", dev, app, []byte{0x45, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.from.Write(tt.packet); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 1420)
+			n, err := tt.to.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], tt.packet) {
+				t.Errorf("read %x, want %x", buf[:n], tt.packet)
+			}
+		})
+	}
+}
+
+func TestPipeCopies(t *testing.T) {
+	dev, app := NewPipe("hs0", 0)
+	defer dev.Close()
+
+	// Buffers can be reused as soon as a write returns.
+	packet := []byte{0x45, 1, 2, 3}
+	if _, err := app.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	packet[1] = 9
+
+	buf := make([]byte, 4)
+	if _, err := dev.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[1] != 1 {
+		t.Errorf("read %x after the written buffer changed", buf)
+	}
+}
+
+func TestPipeLimits(t *testing.T) {
+	dev, app := NewPipe("hs0", 4)
+	defer dev.Close()
+
+	if _, err := app.Write(make([]byte, 5)); err == nil {
+		t.Error("wrote packet exceeding the mtu")
+	}
+
+	if _, err := app.Write([]byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if n, err := dev.Read(buf); err != io.ErrShortBuffer || n != 2 {
+		t.Errorf("read %d bytes with error %v, want 2 and %v", n, err, io.ErrShortBuffer)
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	dev, app := NewPipe("hs0", 0)
+
+	// Closing one end closes both, including reads already waiting.
+	read := make(chan error, 1)
+	go func() {
+		_, err := app.Read(make([]byte, 4))
+		read <- err
+	}()
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-read; err != io.EOF {
+		t.Errorf("read returned %v, want %v", err, io.EOF)
+	}
+
+	for _, end := range []*Memory{dev, app} {
+		if _, err := end.Write([]byte{0x45}); err != io.ErrClosedPipe {
+			t.Errorf("write returned %v, want %v", err, io.ErrClosedPipe)
+		}
+		if _, err := end.Read(make([]byte, 4)); err != io.EOF {
+			t.Errorf("read returned %v, want %v", err, io.EOF)
+		}
+	}
+	if err := app.Close(); err != nil {
+		t.Errorf("closing the other end returned %v", err)
+	}
+}
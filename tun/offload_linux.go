@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package tun
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Offloads a TUN device can be asked to hand over to userspace.
+const (
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+)
+
+// openOffload opens a queue of the TUN device name with a virtio-net
+// header ahead of each packet, and asks the kernel to hand over TCP
+// segments of IPv4 packets without segmenting or checksumming them.
+func openOffload(name string, multiQueue bool) (*os.File, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifr struct {
+		name  [unix.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], name)
+	ifr.flags = unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR
+	if multiQueue {
+		ifr.flags |= unix.IFF_MULTI_QUEUE
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		unix.Close(fd)
+		return nil, errno
+	}
+
+	// Always use little endian headers so they mean the same thing
+	// to peers on any host.
+	le := int32(1)
+	_, _, errno = unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETVNETLE, uintptr(unsafe.Pointer(&le)))
+	if errno != 0 {
+		unix.Close(fd)
+		return nil, errno
+	}
+
+	err = unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, tunFCsum|tunFTSO4)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// Let the runtime poller handle the device so closing it stops
+	// any blocked reads.
+	err = unix.SetNonblock(fd, true)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
@@ -1,5 +1,7 @@
 package tun
 
+import "net"
+
 // Option defines a TUN device modifier option.
 type Option func(tun *TUN) error
 
@@ -26,3 +28,79 @@ func DestAddress(address string) Option {
 		return tun.setDestAddress(address)
 	}
 }
+
+// Queues creates the interface with n queues which can be read and
+// written in parallel. Only use this option on Linux devices.
+func Queues(n int) Option {
+	return func(tun *TUN) error {
+		return tun.setQueues(n)
+	}
+}
+
+// Offload enables TCP segmentation and checksum offloads. Packets read
+// from and written to the device are preceded by a virtio-net header,
+// which lets large TCP segments cross the device in one piece. Only use
+// this option on Linux devices.
+func Offload() Option {
+	return func(tun *TUN) error {
+		return tun.setOffload()
+	}
+}
+
+// TAP creates an Ethernet TAP device instead of a TUN device, so
+// frames are read and written rather than IP packets. Only use this
+// option on Linux devices.
+func TAP() Option {
+	return func(tun *TUN) error {
+		return tun.setTAP()
+	}
+}
+
+// Bridge attaches the interface to an existing Linux bridge when it's
+// brought up. Only use this option on Linux TAP devices.
+func Bridge(name string) Option {
+	return func(tun *TUN) error {
+		return tun.setBridge(name)
+	}
+}
+
+// Namespace moves the interface into the named network namespace,
+// creating it if it doesn't exist. The daemon's own sockets stay in
+// its namespace. Only use this option on Linux devices.
+func Namespace(name string) Option {
+	return func(tun *TUN) error {
+		return tun.setNamespace(name)
+	}
+}
+
+// Route adds a route to a network in CIDR notation through the
+// interface. Routes are added when the interface is brought up and
+// removed when it's brought down.
+func Route(cidr string) Option {
+	return func(tun *TUN) error {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		tun.Routes = append(tun.Routes, network)
+		return nil
+	}
+}
+
+// DNS adds nameservers the system resolver should use for queries
+// on the interface. Only use this option on Linux devices.
+func DNS(servers ...string) Option {
+	return func(tun *TUN) error {
+		return tun.setDNS(servers)
+	}
+}
+
+// Domains adds search and routing domains the system resolver
+// should send to the interface's nameservers. Prefix a domain with
+// "~" to route queries without adding it to the search list.
+// Only use this option on Linux devices.
+func Domains(domains ...string) Option {
+	return func(tun *TUN) error {
+		return tun.setDomains(domains)
+	}
+}
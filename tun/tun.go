@@ -1,15 +1,116 @@
 package tun
 
-import "github.com/songgao/water"
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Device is a network device packets are read from and written to
+// one at a time.
+type Device interface {
+	io.ReadWriteCloser
+
+	// Name returns the name of the device.
+	Name() string
+
+	// MTU returns the largest packet the device carries.
+	MTU() int
+
+	// Up brings up the device.
+	Up() error
+
+	// Down brings down the device.
+	Down() error
+}
 
 // TUN is a struct containing the fields necessary
 // to configure a system TUN device. Access the
-// internal TUN device through TUN.Iface
+// internal TUN device through TUN.Iface, or each of
+// its queues through TUN.Queues. When Offload is set
+// every packet read from or written to the device is
+// preceded by a virtio-net header. When TAP is set the
+// device carries Ethernet frames instead of IP packets.
 type TUN struct {
-	Iface *water.Interface
-	MTU   int
-	Src   string
-	Dst   string
+	Iface   io.ReadWriteCloser
+	Queues  []io.ReadWriteCloser
+	Offload bool
+	TAP     bool
+	Bridge  string
+	Src     string
+	Dst     string
+	DNS     []string
+	Domains []string
+	Routes  []*net.IPNet
+	Netns   string
+
+	name   string
+	mtu    int
+	queues int
+
+	// createdNetns is set when the network namespace was created for
+	// the interface, so it's removed along with it.
+	createdNetns bool
+
+	lock  sync.Mutex
+	added map[string]*net.IPNet
+}
+
+// Read reads a packet from the first queue of the device.
+func (t *TUN) Read(p []byte) (int, error) {
+	return t.Iface.Read(p)
+}
+
+// Write writes a packet to the first queue of the device.
+func (t *TUN) Write(p []byte) (int, error) {
+	return t.Iface.Write(p)
+}
+
+// Name returns the name of the interface.
+func (t *TUN) Name() string {
+	return t.name
+}
+
+// MTU returns the MTU the interface was configured with.
+func (t *TUN) MTU() int {
+	return t.mtu
+}
+
+// AddRoute adds a route to a network through the interface while it's
+// up. Added routes are removed when the interface is brought down.
+func (t *TUN) AddRoute(network *net.IPNet) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	err := t.addRoute(network)
+	if err != nil {
+		return err
+	}
+	if t.added == nil {
+		t.added = make(map[string]*net.IPNet)
+	}
+	t.added[network.String()] = network
+	return nil
+}
+
+// DelRoute removes a route added with AddRoute.
+func (t *TUN) DelRoute(network *net.IPNet) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.added, network.String())
+	return t.delRoute(network)
+}
+
+// routes returns the interface's routes along with those added while
+// it's up, which are forgotten.
+func (t *TUN) routes() []*net.IPNet {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := append([]*net.IPNet(nil), t.Routes...)
+	for _, network := range t.added {
+		result = append(result, network)
+	}
+	t.added = nil
+	return result
 }
 
 // Apply configures the specified options for a TUN device.
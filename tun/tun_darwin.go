@@ -4,7 +4,10 @@
 package tun
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os/exec"
 
 	"github.com/songgao/water"
@@ -25,7 +28,9 @@ func New(name string, opts ...Option) (*TUN, error) {
 
 	// Create TUN result struct
 	result := TUN{
-		Iface: iface,
+		Iface:  iface,
+		Queues: []io.ReadWriteCloser{iface},
+		name:   iface.Name(),
 	}
 
 	// Apply options to set TUN config values
@@ -36,7 +41,8 @@ func New(name string, opts ...Option) (*TUN, error) {
 // SetMTU sets the Maximum Tansmission Unit Size for a
 // Packet on the interface.
 func (t *TUN) setMTU(mtu int) error {
-	return ifconfig(t.Iface.Name(), "mtu", fmt.Sprintf("%d", mtu))
+	t.mtu = mtu
+	return ifconfig(t.name, "mtu", fmt.Sprintf("%d", mtu))
 }
 
 // SetDestAddress sets the interface's address.
@@ -51,14 +57,80 @@ func (t *TUN) setDestAddress(address string) error {
 	return nil
 }
 
+// setQueues only supports a single queue under MacOS.
+func (t *TUN) setQueues(n int) error {
+	if n != 1 {
+		return errors.New("multiple queues are not supported under mac")
+	}
+	return nil
+}
+
+// setOffload isn't supported under MacOS.
+func (t *TUN) setOffload() error {
+	return errors.New("offloads are not supported under mac")
+}
+
+// setTAP isn't supported under MacOS.
+func (t *TUN) setTAP() error {
+	return errors.New("tap devices are not supported under mac")
+}
+
+// setBridge isn't supported under MacOS.
+func (t *TUN) setBridge(name string) error {
+	return errors.New("bridges are not supported under mac")
+}
+
+// setNamespace isn't supported under MacOS.
+func (t *TUN) setNamespace(name string) error {
+	return errors.New("network namespaces are not supported under mac")
+}
+
+// setDNS isn't supported under MacOS.
+func (t *TUN) setDNS(servers []string) error {
+	return errors.New("interface dns servers are not supported under mac")
+}
+
+// setDomains isn't supported under MacOS.
+func (t *TUN) setDomains(domains []string) error {
+	return errors.New("interface dns domains are not supported under mac")
+}
+
 // Up brings up an interface to allow it to start accepting connections.
 func (t *TUN) Up() error {
-	return ifconfig(t.Iface.Name(), "inet", t.Src, t.Dst, "up")
+	err := ifconfig(t.name, "inet", t.Src, t.Dst, "up")
+	if err != nil {
+		return err
+	}
+	for _, network := range t.Routes {
+		err = route("add", "-net", network.String(), "-interface", t.name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Down brings down an interface stopping active connections.
 func (t *TUN) Down() error {
-	return ifconfig(t.Iface.Name(), "down")
+	for _, network := range t.routes() {
+		route("delete", "-net", network.String(), "-interface", t.name)
+	}
+	return ifconfig(t.name, "down")
+}
+
+// addRoute adds a route to a network through the interface.
+func (t *TUN) addRoute(network *net.IPNet) error {
+	return route("add", "-net", network.String(), "-interface", t.name)
+}
+
+// delRoute removes a route to a network through the interface.
+func (t *TUN) delRoute(network *net.IPNet) error {
+	return route("delete", "-net", network.String(), "-interface", t.name)
+}
+
+// Close releases the interface's device, which removes it from the host.
+func (t *TUN) Close() error {
+	return t.Iface.Close()
 }
 
 // Delete removes a TUN device from the host.
@@ -70,3 +142,8 @@ func ifconfig(args ...string) error {
 	cmd := exec.Command("ifconfig", args...)
 	return cmd.Run()
 }
+
+func route(args ...string) error {
+	cmd := exec.Command("route", append([]string{"-n"}, args...)...)
+	return cmd.Run()
+}
@@ -5,56 +5,163 @@ package tun
 
 import (
 	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
 
 	"github.com/songgao/water"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 )
 
 // New creates and returns a new TUN interface for the application.
 func New(name string, opts ...Option) (*TUN, error) {
+	result := TUN{name: name, queues: 1}
+
+	// Apply options early to know how to create the interface.
+	err := result.Apply(opts...)
+	if err != nil {
+		return nil, err
+	}
+
 	// Setup TUN Config
 	cfg := water.Config{
 		DeviceType: water.TUN,
 	}
 	cfg.Name = name
+	cfg.MultiQueue = result.queues > 1
+	if result.TAP {
+		if result.Offload {
+			return nil, errors.New("offloads are not supported for tap devices")
+		}
+		cfg.DeviceType = water.TAP
+	}
 
-	// Create Water Interface
-	iface, err := water.New(cfg)
+	// Create Water Interface, opening the same device once for each
+	// of its queues. Water can't enable offloads so open the device
+	// ourselves when they're wanted.
+	for i := 0; i < result.queues; i++ {
+		var queue io.ReadWriteCloser
+		if result.Offload {
+			queue, err = openOffload(name, cfg.MultiQueue)
+		} else {
+			queue, err = water.New(cfg)
+		}
+		if err != nil {
+			result.closeQueues()
+			return nil, err
+		}
+		result.Queues = append(result.Queues, queue)
+	}
+	result.Iface = result.Queues[0]
+
+	// Configure the interface now that all options are known, since
+	// it may have to be moved into a network namespace first.
+	err = result.setup()
 	if err != nil {
+		result.Close()
 		return nil, err
 	}
+	return &result, nil
+}
+
+// setup moves the interface into its network namespace and sets its
+// MTU and address.
+func (t *TUN) setup() error {
+	if t.Netns != "" {
+		err := t.moveToNamespace()
+		if err != nil {
+			return err
+		}
+	}
 
-	// Create TUN result struct
-	result := TUN{
-		Iface: iface,
+	h, link, err := t.link()
+	if err != nil {
+		return err
 	}
+	defer h.Delete()
 
-	// Apply options to set TUN config values
-	err = result.Apply(opts...)
-	return &result, err
+	if t.mtu > 0 {
+		err = h.LinkSetMTU(link, t.mtu)
+		if err != nil {
+			return err
+		}
+	}
+	if t.Src != "" {
+		addr, err := netlink.ParseAddr(t.Src)
+		if err != nil {
+			return err
+		}
+		return h.AddrAdd(link, addr)
+	}
+	return nil
 }
 
-// setMTU sets the Maximum Tansmission Unit Size for a
-// Packet on the interface.
-func (t *TUN) setMTU(mtu int) error {
-	link, err := netlink.LinkByName(t.Iface.Name())
+// moveToNamespace moves the interface into its network namespace,
+// creating the namespace if it doesn't exist yet. The device itself
+// stays open in the daemon's namespace.
+func (t *TUN) moveToNamespace() error {
+	ns, err := netns.GetFromName(t.Netns)
+	if err != nil {
+		err = exec.Command("ip", "netns", "add", t.Netns).Run()
+		if err != nil {
+			return err
+		}
+		t.createdNetns = true
+		ns, err = netns.GetFromName(t.Netns)
+		if err != nil {
+			return err
+		}
+	}
+	defer ns.Close()
+
+	link, err := netlink.LinkByName(t.name)
 	if err != nil {
 		return err
 	}
-	return netlink.LinkSetMTU(link, mtu)
+	return netlink.LinkSetNsFd(link, int(ns))
 }
 
-// setDestAddress sets the interface's destination address and subnet.
-func (t *TUN) setAddress(address string) error {
-	addr, err := netlink.ParseAddr(address)
+// link returns a netlink handle for the interface's network namespace
+// along with the interface's link. The handle must be deleted after use.
+func (t *TUN) link() (*netlink.Handle, netlink.Link, error) {
+	var h *netlink.Handle
+	var err error
+	if t.Netns == "" {
+		h, err = netlink.NewHandle()
+	} else {
+		var ns netns.NsHandle
+		ns, err = netns.GetFromName(t.Netns)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer ns.Close()
+		h, err = netlink.NewHandleAt(ns)
+	}
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	link, err := netlink.LinkByName(t.Iface.Name())
+
+	link, err := h.LinkByName(t.name)
 	if err != nil {
-		return err
+		h.Delete()
+		return nil, nil, err
 	}
-	return netlink.AddrAdd(link, addr)
+	return h, link, nil
+}
+
+// setMTU sets the Maximum Tansmission Unit Size for a
+// Packet on the interface.
+func (t *TUN) setMTU(mtu int) error {
+	t.mtu = mtu
+	return nil
+}
+
+// setAddress sets the interface's address and subnet.
+func (t *TUN) setAddress(address string) error {
+	t.Src = address
+	return nil
 }
 
 // SetDestAddress isn't supported under Linux.
@@ -64,22 +171,202 @@ func (t *TUN) setDestAddress(address string) error {
 	return errors.New("destination addresses are not supported under linux")
 }
 
+// setQueues sets the number of queues the interface is created with.
+func (t *TUN) setQueues(n int) error {
+	if n < 1 {
+		return errors.New("an interface needs at least one queue")
+	}
+	t.queues = n
+	return nil
+}
+
+// setOffload enables offloads for the interface.
+func (t *TUN) setOffload() error {
+	t.Offload = true
+	return nil
+}
+
+// setTAP makes the interface a TAP device.
+func (t *TUN) setTAP() error {
+	t.TAP = true
+	return nil
+}
+
+// setBridge sets the bridge the interface is attached to.
+func (t *TUN) setBridge(name string) error {
+	t.Bridge = name
+	return nil
+}
+
+// setNamespace sets the network namespace the interface is moved into.
+func (t *TUN) setNamespace(name string) error {
+	t.Netns = name
+	return nil
+}
+
+// setDNS adds nameservers for the interface. They're handed to
+// systemd-resolved when the interface is brought up.
+func (t *TUN) setDNS(servers []string) error {
+	t.DNS = append(t.DNS, servers...)
+	return nil
+}
+
+// setDomains adds search and routing domains for the interface.
+// They're handed to systemd-resolved when the interface is brought up.
+func (t *TUN) setDomains(domains []string) error {
+	t.Domains = append(t.Domains, domains...)
+	return nil
+}
+
 // Up brings up an interface to allow it to start accepting connections.
 func (t *TUN) Up() error {
-	link, err := netlink.LinkByName(t.Iface.Name())
+	h, link, err := t.link()
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	err = h.LinkSetUp(link)
 	if err != nil {
 		return err
 	}
-	return netlink.LinkSetUp(link)
+
+	// Attach the interface to its bridge.
+	if t.Bridge != "" {
+		br, err := h.LinkByName(t.Bridge)
+		if err != nil {
+			return err
+		}
+		err = h.LinkSetMaster(link, br)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Routes can only be added once the link is up.
+	for _, network := range t.Routes {
+		err = h.RouteReplace(t.route(link, network))
+		if err != nil {
+			return err
+		}
+	}
+	return t.setupResolver()
 }
 
 // Down brings down an interface stopping active connections.
 func (t *TUN) Down() error {
-	link, err := netlink.LinkByName(t.Iface.Name())
+	if t.Netns == "" && (len(t.DNS) > 0 || len(t.Domains) > 0) {
+		resolvectl("revert", t.name)
+	}
+	h, link, err := t.link()
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	// The kernel removes routes along with the link, so don't worry
+	// if they're already gone.
+	for _, network := range t.routes() {
+		h.RouteDel(t.route(link, network))
+	}
+	return h.LinkSetDown(link)
+}
+
+// addRoute adds a route to a network through the interface.
+func (t *TUN) addRoute(network *net.IPNet) error {
+	h, link, err := t.link()
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	return h.RouteReplace(t.route(link, network))
+}
+
+// delRoute removes a route to a network through the interface.
+func (t *TUN) delRoute(network *net.IPNet) error {
+	h, link, err := t.link()
 	if err != nil {
 		return err
 	}
-	return netlink.LinkSetDown(link)
+	defer h.Delete()
+	return h.RouteDel(t.route(link, network))
+}
+
+// route describes a route to a network through the interface.
+func (t *TUN) route(link netlink.Link, network *net.IPNet) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       network,
+		Scope:     netlink.SCOPE_LINK,
+	}
+}
+
+// setupResolver configures systemd-resolved to send queries for the
+// interface's domains to the interface's nameservers.
+func (t *TUN) setupResolver() error {
+	if len(t.DNS) == 0 && len(t.Domains) == 0 {
+		return nil
+	}
+	if t.Netns != "" {
+		return errors.New("interface dns is not supported inside a network namespace")
+	}
+	name := t.name
+	if len(t.DNS) > 0 {
+		err := resolvectl(append([]string{"dns", name}, t.DNS...)...)
+		if err != nil {
+			return err
+		}
+	}
+	if len(t.Domains) == 0 {
+		return nil
+	}
+	err := resolvectl(append([]string{"domain", name}, t.Domains...)...)
+	if err != nil {
+		return err
+	}
+
+	// Keep queries outside of the interface's domains on the
+	// system's default resolvers unless it has search domains.
+	for _, d := range t.Domains {
+		if !strings.HasPrefix(d, "~") {
+			return nil
+		}
+	}
+	return resolvectl("default-route", name, "false")
+}
+
+// Close removes the interface from the host and releases its device.
+func (t *TUN) Close() error {
+	h, link, err := t.link()
+	if err == nil {
+		err = h.LinkDel(link)
+		h.Delete()
+	}
+	if cerr := t.closeQueues(); err == nil {
+		err = cerr
+	}
+
+	// Remove the network namespace if it was created for the
+	// interface. Namespaces which already existed are left alone.
+	if t.createdNetns {
+		nerr := exec.Command("ip", "netns", "delete", t.Netns).Run()
+		if err == nil {
+			err = nerr
+		}
+		t.createdNetns = false
+	}
+	return err
+}
+
+// closeQueues closes every queue of the interface's device.
+func (t *TUN) closeQueues() error {
+	var err error
+	for _, q := range t.Queues {
+		if cerr := q.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 // Delete removes a TUN device from the host.
@@ -90,3 +377,8 @@ func Delete(name string) error {
 	}
 	return netlink.LinkDel(link)
 }
+
+func resolvectl(args ...string) error {
+	cmd := exec.Command("resolvectl", args...)
+	return cmd.Run()
+}
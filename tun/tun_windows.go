@@ -6,6 +6,7 @@ package tun
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os/exec"
 
@@ -58,6 +59,8 @@ func New(name string, opts ...Option) (*TUN, error) {
 
 	// Set TUN interface to newly created interface
 	result.Iface = iface
+	result.Queues = []io.ReadWriteCloser{iface}
+	result.name = iface.Name()
 
 	// Apply options to setup TUN interface configuration
 	// Setup interface address
@@ -67,7 +70,7 @@ func New(name string, opts ...Option) (*TUN, error) {
 	}
 
 	// Setup interface mtu size
-	err = result.setupMTU(result.MTU)
+	err = result.setupMTU(result.mtu)
 	if err != nil {
 		return nil, err
 	}
@@ -77,7 +80,7 @@ func New(name string, opts ...Option) (*TUN, error) {
 
 // setMTU configures the interface's MTU.
 func (t *TUN) setMTU(mtu int) error {
-	t.MTU = mtu
+	t.mtu = mtu
 	return nil
 }
 
@@ -90,12 +93,12 @@ func (t *TUN) setAddress(address string) error {
 // setupMTU sets the Maximum Tansmission Unit Size for a
 // Packet on the interface.
 func (t *TUN) setupMTU(mtu int) error {
-	return netsh("interface", "ipv4", "set", "subinterface", t.Iface.Name(), "mtu=", fmt.Sprintf("%d", mtu))
+	return netsh("interface", "ipv4", "set", "subinterface", t.name, "mtu=", fmt.Sprintf("%d", mtu))
 }
 
 // setupAddress sets the interface's destination address and subnet.
 func (t *TUN) setupAddress(address string) error {
-	return netsh("interface", "ip", "set", "address", "name=", t.Iface.Name(), "static", address)
+	return netsh("interface", "ip", "set", "address", "name=", t.name, "static", address)
 }
 
 // SetDestAddress isn't supported under Windows.
@@ -105,16 +108,82 @@ func (t *TUN) setDestAddress(address string) error {
 	return errors.New("destination addresses are not supported under windows")
 }
 
+// setQueues only supports a single queue under Windows.
+func (t *TUN) setQueues(n int) error {
+	if n != 1 {
+		return errors.New("multiple queues are not supported under windows")
+	}
+	return nil
+}
+
+// setOffload isn't supported under Windows.
+func (t *TUN) setOffload() error {
+	return errors.New("offloads are not supported under windows")
+}
+
+// setTAP isn't supported under Windows.
+func (t *TUN) setTAP() error {
+	return errors.New("tap devices are not supported under windows")
+}
+
+// setBridge isn't supported under Windows.
+func (t *TUN) setBridge(name string) error {
+	return errors.New("bridges are not supported under windows")
+}
+
+// setNamespace isn't supported under Windows.
+func (t *TUN) setNamespace(name string) error {
+	return errors.New("network namespaces are not supported under windows")
+}
+
+// setDNS isn't supported under Windows.
+func (t *TUN) setDNS(servers []string) error {
+	return errors.New("interface dns servers are not supported under windows")
+}
+
+// setDomains isn't supported under Windows.
+func (t *TUN) setDomains(domains []string) error {
+	return errors.New("interface dns domains are not supported under windows")
+}
+
 // Up brings up an interface to allow it to start accepting connections.
 func (t *TUN) Up() error {
+	for _, network := range t.Routes {
+		err := netsh("interface", "ipv4", "add", "route", network.String(), t.name, "store=active")
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // Down brings down an interface stopping active connections.
 func (t *TUN) Down() error {
+	for _, network := range t.routes() {
+		netsh("interface", "ipv4", "delete", "route", network.String(), t.name)
+	}
 	return nil
 }
 
+// addRoute adds a route to a network through the interface.
+func (t *TUN) addRoute(network *net.IPNet) error {
+	return netsh("interface", "ipv4", "add", "route", network.String(), t.name, "store=active")
+}
+
+// delRoute removes a route to a network through the interface.
+func (t *TUN) delRoute(network *net.IPNet) error {
+	return netsh("interface", "ipv4", "delete", "route", network.String(), t.name)
+}
+
+// Close releases the interface's device and disables the adapter.
+func (t *TUN) Close() error {
+	err := t.Iface.Close()
+	if derr := Delete(t.name); err == nil {
+		err = derr
+	}
+	return err
+}
+
 // Delete removes a TUN device from the host.
 func Delete(name string) error {
 	return netsh("interface", "set", "interface", "name=", name, "disable")